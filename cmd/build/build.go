@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,20 +13,67 @@ import (
 type BuildParams struct {
 	InputDir  string
 	OutputDir string
+
+	// Preset is the name of a preset, see [LookupPreset].
+	Preset string
+
+	// TemplateFile and HeaderIncludesFile are optional files from InputDir.
+	// TemplateFile replaces the preset template,
+	// HeaderIncludesFile is appended to the template preamble.
+	TemplateFile       string
+	HeaderIncludesFile string
+
+	// BibliographyFile is an optional file from InputDir.
+	// If it is empty, citations are processed when main.md declares
+	// a bibliography or when bibliography files are found in InputDir.
+	BibliographyFile string
+
+	// CSL is an optional CSL style name from CSLDir or a .csl file from InputDir.
+	// CSLDir defaults to DefaultCSLDir.
+	CSL    string
+	CSLDir string
+
+	// Engine is the name of an engine, see [LookupEngine].
+	Engine string
+
+	// LogWriter is an optional writer that receives the log as it is written,
+	// so stages can be followed while the build runs.
+	LogWriter io.Writer
 }
 
 type BuildResult struct {
 	PDFFile  string
 	LogFile  string
 	ExitCode int
+	Engine   string
 }
 
 func Build(params *BuildParams) (*BuildResult, error) {
 	result := BuildResult{ExitCode: -1}
 
+	preset, err := LookupPreset(params.Preset)
+	if err != nil {
+		return nil, fmt.Errorf("Build: %w", err)
+	}
+	engine, err := LookupEngine(params.Engine)
+	if err != nil {
+		return nil, fmt.Errorf("Build: %w", err)
+	}
+	writer, err := engine.Writer(preset)
+	if err != nil {
+		return nil, fmt.Errorf("Build: %w", err)
+	}
+	result.Engine = engine.Name
+	for _, file := range []string{params.TemplateFile, params.HeaderIncludesFile} {
+		if file != "" && !filepath.IsLocal(file) {
+			return nil, fmt.Errorf("Build: %s file is not local", file)
+		}
+	}
+
 	// Create log file for Pandoc and Latexmk.
+	// Every line of the log is written through logWriter, so LogWriter receives the whole log.
 	logFile := filepath.Join(params.OutputDir, "log")
-	if err := os.MkdirAll(params.OutputDir, 0o777); err != nil {
+	if err = os.MkdirAll(params.OutputDir, 0o777); err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
 	openLogFile, err := os.Create(logFile)
@@ -33,6 +82,10 @@ func Build(params *BuildParams) (*BuildResult, error) {
 	}
 	defer openLogFile.Close()
 	result.LogFile = logFile
+	var logWriter io.Writer = openLogFile
+	if params.LogWriter != nil {
+		logWriter = io.MultiWriter(openLogFile, params.LogWriter)
+	}
 
 	// Create metadata file for Pandoc.
 	metadataFile := filepath.Join(params.OutputDir, "pandoc-input", "metadata.yaml")
@@ -67,35 +120,70 @@ monofontfallback:
 		return nil, fmt.Errorf("Build: %w", err)
 	}
 
+	// Create preset files for Pandoc.
+	presetFiles, err := writePresetFiles(preset, filepath.Dir(absMetadataFile))
+	if err != nil {
+		return nil, fmt.Errorf("Build: %w", err)
+	}
+
+	// Find bibliography for Pandoc.
+	cp, err := findCiteproc(params)
+	if err != nil {
+		return nil, fmt.Errorf("Build: %w", err)
+	}
+
 	// Run Pandoc.
-	texFile := filepath.Join(params.OutputDir, "pandoc-output", "main.tex")
-	if err = os.MkdirAll(filepath.Dir(texFile), 0o777); err != nil {
+	pandocOutputFile := filepath.Join(params.OutputDir, "pandoc-output", "main"+engine.ext)
+	if err = os.MkdirAll(filepath.Dir(pandocOutputFile), 0o777); err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
-	absTexFile, err := filepath.Abs(texFile)
+	absPandocOutputFile, err := filepath.Abs(pandocOutputFile)
 	if err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
-	if _, err = openLogFile.Write([]byte("$ pandoc\n")); err != nil {
+	if _, err = logWriter.Write([]byte("$ pandoc\n")); err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
-	pandoc := exec.Command(
-		"pandoc",
+	reader := "gfm"
+	if cp != nil {
+		reader = citeprocReader
+	}
+	pandocArgs := []string{
 		"--verbose",
 		"--from",
-		"gfm",
+		reader,
 		"--to",
-		"latex",
+		writer,
 		"--output",
-		absTexFile,
+		absPandocOutputFile,
 		"--standalone",
 		"--metadata-file",
 		absMetadataFile,
-		"main.md",
-	)
+		"--metadata-file",
+		presetFiles.MetadataFile,
+	}
+	if engine.LaTeX {
+		templateFile := presetFiles.TemplateFile
+		if params.TemplateFile != "" {
+			templateFile = params.TemplateFile
+		}
+		if templateFile != "" {
+			pandocArgs = append(pandocArgs, "--template", templateFile)
+		}
+		if params.HeaderIncludesFile != "" {
+			pandocArgs = append(pandocArgs, "--include-in-header", params.HeaderIncludesFile)
+		}
+	}
+	pandocArgs = append(pandocArgs, engine.PandocArgs(filepath.Dir(absPandocOutputFile))...)
+	if cp != nil {
+		pandocArgs = append(pandocArgs, cp.Args()...)
+	}
+	pandocArgs = append(pandocArgs, "main.md")
+	pandocOutput := new(bytes.Buffer)
+	pandoc := exec.Command("pandoc", pandocArgs...)
 	pandoc.Dir = params.InputDir
-	pandoc.Stdout = openLogFile
-	pandoc.Stderr = openLogFile
+	pandoc.Stdout = io.MultiWriter(logWriter, pandocOutput)
+	pandoc.Stderr = pandoc.Stdout
 	if err = pandoc.Run(); err != nil {
 		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
 			result.ExitCode = exitErr.ExitCode()
@@ -103,9 +191,14 @@ monofontfallback:
 		}
 		return nil, fmt.Errorf("Build: %w", err)
 	}
+	if cp != nil {
+		if err = writeMissingCitations(logWriter, pandocOutput.Bytes()); err != nil {
+			return nil, fmt.Errorf("Build: %w", err)
+		}
+	}
 
-	// Run Latexmk.
-	pdfFile := filepath.Join(params.OutputDir, "latexmk-output", "main.pdf")
+	// Run engine.
+	pdfFile := filepath.Join(params.OutputDir, engine.Command+"-output", "main.pdf")
 	if err = os.MkdirAll(filepath.Dir(pdfFile), 0o777); err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
@@ -113,23 +206,14 @@ monofontfallback:
 	if err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
-	if _, err = openLogFile.Write([]byte("$ latexmk\n")); err != nil {
+	if _, err = fmt.Fprintf(logWriter, "$ %s\n", engine.Command); err != nil {
 		return nil, fmt.Errorf("Build: %w", err)
 	}
-	latexmk := exec.Command(
-		"latexmk",
-		"-lualatex",
-		"-interaction=nonstopmode",
-		"-halt-on-error",
-		"-file-line-error",
-		"-shell-escape", // has security implications
-		"-output-directory="+filepath.Dir(absPDFFile),
-		absTexFile,
-	)
-	latexmk.Dir = params.InputDir
-	latexmk.Stdout = openLogFile
-	latexmk.Stderr = openLogFile
-	if err = latexmk.Run(); err != nil {
+	engineCmd := engine.Cmd(absPandocOutputFile, filepath.Dir(absPDFFile))
+	engineCmd.Dir = params.InputDir
+	engineCmd.Stdout = logWriter
+	engineCmd.Stderr = logWriter
+	if err = engineCmd.Run(); err != nil {
 		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
 			result.ExitCode = exitErr.ExitCode()
 			return &result, nil
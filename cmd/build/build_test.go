@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -58,7 +60,8 @@ Text with кириллица.
 		}
 
 		outputDir := filepath.Join(tempDir, "output")
-		result, err := Build(&BuildParams{InputDir: inputDir, OutputDir: outputDir})
+		logStream := new(bytes.Buffer)
+		result, err := Build(&BuildParams{InputDir: inputDir, OutputDir: outputDir, LogWriter: logStream})
 		if err != nil {
 			t.Fatalf("got %q err", err)
 		}
@@ -69,7 +72,52 @@ Text with кириллица.
 			t.Error("got empty PDFFile")
 		}
 		if got := result.LogFile; got == "" {
-			t.Error("got empty LogFile")
+			t.Fatal("got empty LogFile")
+		}
+
+		// The streamed log is the whole log from the first stage.
+		logData, err := os.ReadFile(result.LogFile)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := logStream.String(), string(logData); got != want {
+			t.Errorf("got %q streamed log, want %q", got, want)
+		}
+		if got := logStream.String(); !strings.HasPrefix(got, "$ pandoc\n") || !strings.Contains(got, "\n$ latexmk\n") {
+			t.Errorf("got %q streamed log, want pandoc and latexmk stages", got)
+		}
+	})
+
+	t.Run("streams the log of failed builds", func(t *testing.T) {
+		tempDir := t.TempDir()
+		inputDir := filepath.Join(tempDir, "input")
+		if err := os.MkdirAll(inputDir, 0o777); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if err := os.WriteFile(filepath.Join(inputDir, "main.md"), []byte("# Title\n"), 0o666); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		// Only the engine is found, so the build fails when it runs pandoc.
+		binDir := filepath.Join(tempDir, "bin")
+		if err := os.MkdirAll(binDir, 0o777); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if err := os.WriteFile(filepath.Join(binDir, "latexmk"), []byte("#!/bin/sh\n"), 0o777); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		t.Setenv("PATH", binDir)
+
+		logStream := new(bytes.Buffer)
+		_, err := Build(&BuildParams{InputDir: inputDir, OutputDir: filepath.Join(tempDir, "output"), LogWriter: logStream})
+		if err == nil {
+			t.Fatal("got nil err")
+		}
+		logData, err := os.ReadFile(filepath.Join(tempDir, "output", "log"))
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := logStream.String(), string(logData); got != want || got != "$ pandoc\n" {
+			t.Errorf("got %q streamed log and %q log file, want %q", got, want, "$ pandoc\n")
 		}
 	})
 }
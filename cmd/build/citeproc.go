@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefaultCSLDir is the directory with CSL styles bundled in the build image.
+const DefaultCSLDir = "/opt/app/share/csl"
+
+// citeprocReader is the Pandoc input format used when citations are processed.
+// It is GFM with citations, so the rest of the document renders the same,
+// and with YAML metadata blocks, so a bibliography can be declared in main.md.
+const citeprocReader = "gfm+citations+yaml_metadata_block"
+
+// bibliographyExts are extensions of files that are used as bibliography
+// when they are found in the input directory.
+var bibliographyExts = []string{".bib", ".bibtex"}
+
+// citeproc is the citation processing setup for Pandoc.
+type citeproc struct {
+	BibliographyFiles []string // optional if declared in metadata
+	CSLFile           string   // optional, Pandoc uses Chicago author-date by default
+}
+
+// findCiteproc returns nil if citation processing isn't needed.
+// It is needed when params.BibliographyFile is set, when main.md metadata
+// declares a bibliography, or when a bibliography file is found in params.InputDir.
+func findCiteproc(params *BuildParams) (*citeproc, error) {
+	cp := &citeproc{}
+
+	declared, err := frontMatterHasKey(filepath.Join(params.InputDir, "main.md"), "bibliography")
+	if err != nil {
+		return nil, err
+	}
+
+	var foundBibliographyFiles, foundCSLFiles []string
+	err = filepath.WalkDir(params.InputDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(params.InputDir, p)
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if slices.Contains(bibliographyExts, ext) {
+			foundBibliographyFiles = append(foundBibliographyFiles, rel)
+		}
+		if ext == ".csl" {
+			foundCSLFiles = append(foundCSLFiles, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case params.BibliographyFile != "":
+		if !filepath.IsLocal(params.BibliographyFile) {
+			return nil, fmt.Errorf("%s file is not local", params.BibliographyFile)
+		}
+		cp.BibliographyFiles = []string{params.BibliographyFile}
+	case declared:
+		// Pandoc reads the bibliography from metadata.
+	case len(foundBibliographyFiles) > 0:
+		cp.BibliographyFiles = foundBibliographyFiles
+	default:
+		return nil, nil
+	}
+
+	switch {
+	case strings.HasSuffix(params.CSL, ".csl"):
+		if !filepath.IsLocal(params.CSL) {
+			return nil, fmt.Errorf("%s file is not local", params.CSL)
+		}
+		cp.CSLFile = params.CSL
+	case params.CSL != "":
+		cslDir := params.CSLDir
+		if cslDir == "" {
+			cslDir = DefaultCSLDir
+		}
+		cp.CSLFile = filepath.Join(cslDir, params.CSL+".csl")
+		if _, err = os.Stat(cp.CSLFile); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("unknown CSL style %q", params.CSL)
+			}
+			return nil, err
+		}
+	case len(foundCSLFiles) == 1:
+		cp.CSLFile = foundCSLFiles[0]
+	}
+
+	return cp, nil
+}
+
+// Args returns Pandoc arguments for citation processing.
+func (cp *citeproc) Args() []string {
+	args := []string{"--citeproc"}
+	for _, f := range cp.BibliographyFiles {
+		args = append(args, "--bibliography", f)
+	}
+	if cp.CSLFile != "" {
+		args = append(args, "--csl", cp.CSLFile)
+	}
+	return args
+}
+
+// frontMatterHasKey reports whether the YAML front matter of a Markdown file
+// has the top-level key. It doesn't parse YAML, it only looks for "key:" lines.
+func frontMatterHasKey(file string, key string) (bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "---" {
+		return false, nil
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "---" || trimmed == "..." {
+			break
+		}
+		if strings.HasPrefix(line, key+":") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+var missingCitationRegexp = regexp.MustCompile(`\[WARNING\] Citeproc: citation (\S+) not found`)
+
+// writeMissingCitations writes a summary of citation keys
+// that Pandoc didn't find in the bibliography.
+func writeMissingCitations(w io.Writer, pandocOutput []byte) error {
+	var keys []string
+	keyExist := make(map[string]struct{})
+	for _, m := range missingCitationRegexp.FindAllSubmatch(pandocOutput, -1) {
+		key := string(m[1])
+		if _, exist := keyExist[key]; !exist {
+			keys = append(keys, key)
+			keyExist[key] = struct{}{}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w, "warning: citations not found in bibliography: %s\n", strings.Join(keys, ", "))
+	return err
+}
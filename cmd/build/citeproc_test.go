@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindCiteproc(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  *citeproc
+	}{
+		{
+			name:  "without bibliography",
+			files: map[string]string{"main.md": "# Title\n"},
+			want:  nil,
+		},
+		{
+			name:  "with found bibliography",
+			files: map[string]string{"main.md": "# Title\n", "refs/main.bib": "", "style.csl": ""},
+			want:  &citeproc{BibliographyFiles: []string{filepath.Join("refs", "main.bib")}, CSLFile: "style.csl"},
+		},
+		{
+			name:  "with declared bibliography",
+			files: map[string]string{"main.md": "---\nbibliography: refs.json\n---\n# Title\n"},
+			want:  &citeproc{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputDir := t.TempDir()
+			for name, content := range tt.files {
+				file := filepath.Join(inputDir, name)
+				if err := os.MkdirAll(filepath.Dir(file), 0o777); err != nil {
+					t.Fatalf("got %q err", err)
+				}
+				if err := os.WriteFile(file, []byte(content), 0o666); err != nil {
+					t.Fatalf("got %q err", err)
+				}
+			}
+
+			got, err := findCiteproc(&BuildParams{InputDir: inputDir})
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteMissingCitations(t *testing.T) {
+	pandocOutput := []byte(`[INFO] Running filter
+[WARNING] Citeproc: citation knuth1984 not found
+[WARNING] Citeproc: citation lamport1994 not found
+[WARNING] Citeproc: citation knuth1984 not found
+`)
+	buf := new(bytes.Buffer)
+	if err := writeMissingCitations(buf, pandocOutput); err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	if got, want := buf.String(), "warning: citations not found in bibliography: knuth1984, lamport1994\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
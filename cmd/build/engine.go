@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// DefaultEngine is used when [BuildParams.Engine] is empty.
+const DefaultEngine = "lualatex"
+
+// Engine turns Pandoc output into a PDF file.
+type Engine struct {
+	Name    string
+	Command string // executable that must be in PATH
+	LaTeX   bool   // whether Pandoc output is LaTeX, the preset writer is used then
+
+	writer     string // Pandoc output format for non-LaTeX engines
+	ext        string // Pandoc output file extension
+	pandocArgs func(pandocOutputDir string) []string
+	args       func(inputFile, outputDir string) []string
+}
+
+var engines = map[string]*Engine{
+	"lualatex": {
+		Name:    "lualatex",
+		Command: "latexmk",
+		LaTeX:   true,
+		ext:     ".tex",
+		args:    latexmkArgs("-lualatex"),
+	},
+	"xelatex": {
+		Name:    "xelatex",
+		Command: "latexmk",
+		LaTeX:   true,
+		ext:     ".tex",
+		args:    latexmkArgs("-xelatex"),
+	},
+	"pdflatex": {
+		Name:    "pdflatex",
+		Command: "latexmk",
+		LaTeX:   true,
+		ext:     ".tex",
+		args:    latexmkArgs("-pdf"),
+	},
+	"tectonic": {
+		Name:    "tectonic",
+		Command: "tectonic",
+		LaTeX:   true,
+		ext:     ".tex",
+		args: func(inputFile, outputDir string) []string {
+			return []string{
+				"-Z", "shell-escape", // has security implications
+				"--keep-logs",
+				"--outdir", outputDir,
+				inputFile,
+			}
+		},
+	},
+	"typst": {
+		Name:    "typst",
+		Command: "typst",
+		writer:  "typst",
+		ext:     ".typ",
+		pandocArgs: func(pandocOutputDir string) []string {
+			// Typst resolves relative paths from the input file which is outside the input dir.
+			// Extracted media get absolute paths which Typst resolves from the root.
+			return []string{"--extract-media", filepath.Join(pandocOutputDir, "media")}
+		},
+		args: func(inputFile, outputDir string) []string {
+			return []string{"compile", "--root", "/", inputFile, filepath.Join(outputDir, "main.pdf")}
+		},
+	},
+	"weasyprint": {
+		Name:    "weasyprint",
+		Command: "weasyprint",
+		writer:  "html5",
+		ext:     ".html",
+		args: func(inputFile, outputDir string) []string {
+			return []string{"--base-url", ".", inputFile, filepath.Join(outputDir, "main.pdf")}
+		},
+	},
+}
+
+func latexmkArgs(engineFlag string) func(inputFile, outputDir string) []string {
+	return func(inputFile, outputDir string) []string {
+		return []string{
+			engineFlag,
+			"-interaction=nonstopmode",
+			"-halt-on-error",
+			"-file-line-error",
+			"-shell-escape", // has security implications
+			"-output-directory=" + outputDir,
+			inputFile,
+		}
+	}
+}
+
+// LookupEngine returns the engine with the given name.
+// If name is empty, it returns the default engine.
+// It fails if the engine command isn't available.
+func LookupEngine(name string) (*Engine, error) {
+	if name == "" {
+		name = DefaultEngine
+	}
+	e, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %q", name)
+	}
+	if _, err := exec.LookPath(e.Command); err != nil {
+		return nil, fmt.Errorf("engine %q isn't available: %w", name, err)
+	}
+	return e, nil
+}
+
+// Writer returns the Pandoc output format for the engine and the preset.
+func (e *Engine) Writer(p *Preset) (string, error) {
+	if e.LaTeX {
+		return p.Writer, nil
+	}
+	if p.Writer != "latex" {
+		return "", fmt.Errorf("preset %q requires a LaTeX engine", p.Name)
+	}
+	return e.writer, nil
+}
+
+// PandocArgs returns additional Pandoc arguments for the engine.
+func (e *Engine) PandocArgs(pandocOutputDir string) []string {
+	if e.pandocArgs == nil {
+		return nil
+	}
+	return e.pandocArgs(pandocOutputDir)
+}
+
+// Cmd returns the command that builds main.pdf in outputDir from inputFile.
+func (e *Engine) Cmd(inputFile, outputDir string) *exec.Cmd {
+	return exec.Command(e.Command, e.args(inputFile, outputDir)...)
+}
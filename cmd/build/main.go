@@ -1,16 +1,31 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"time"
 )
 
 var (
 	inputFile  = flag.String("i", "", "Markdown input file")
 	outputFile = flag.String("o", "", "PDF output file")
 	cacheDir   = flag.String("c", "", "cache dir")
+
+	preset             = flag.String("preset", DefaultPreset, "preset name")
+	templateFile       = flag.String("template", "", "LaTeX template file, overrides preset template")
+	headerIncludesFile = flag.String("header-includes", "", "LaTeX file included in the preamble")
+	bibliographyFile   = flag.String("bibliography", "", "bibliography file, found automatically if empty")
+	csl                = flag.String("csl", "", "CSL style name or .csl file")
+	cslDir             = flag.String("csl-dir", DefaultCSLDir, "dir with bundled CSL styles")
+	engine             = flag.String("engine", DefaultEngine, "PDF engine: lualatex, xelatex, pdflatex, tectonic, typst or weasyprint")
+
+	watch         = flag.Bool("watch", false, "rebuild when input files change")
+	watchInterval = flag.Duration("watch-interval", 500*time.Millisecond, "how often input files are checked for changes")
+	watchDebounce = flag.Duration("watch-debounce", 300*time.Millisecond, "how long input files must stay unchanged before a rebuild")
 )
 
 func main() {
@@ -39,10 +54,56 @@ func main() {
 			return 2
 		}
 
-		result, err := Build(&BuildParams{
+		buildParams := &BuildParams{
 			InputDir:  ".",
 			OutputDir: *cacheDir,
-		})
+
+			Preset:             *preset,
+			TemplateFile:       *templateFile,
+			HeaderIncludesFile: *headerIncludesFile,
+			BibliographyFile:   *bibliographyFile,
+			CSL:                *csl,
+			CSLDir:             *cslDir,
+			Engine:             *engine,
+		}
+
+		if *watch {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			err := Watch(ctx, &WatchParams{
+				Dir:      buildParams.InputDir,
+				Exclude:  []string{*cacheDir, *outputFile},
+				Interval: *watchInterval,
+				Debounce: *watchDebounce,
+			}, func() {
+				startTime := time.Now()
+				result, err := Build(buildParams)
+				if err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+					return
+				}
+				if result.ExitCode == 0 {
+					if err = copyFile(*outputFile, result.PDFFile); err != nil {
+						_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+						return
+					}
+				}
+				if err = writeSummary(os.Stdout, result, *outputFile, time.Since(startTime)); err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+					return
+				}
+			})
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+
+		// Stream the log, so a caller such as build.Doer can follow stages.
+		buildParams.LogWriter = os.Stdout
+		result, err := Build(buildParams)
 		if err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			return 1
@@ -71,21 +132,35 @@ func main() {
 			return 1
 		}
 
-		openResultLogFile, err := os.Open(result.LogFile)
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			return 1
-		}
-		defer func() {
-			_ = openResultLogFile.Close()
-		}()
-		_, err = io.Copy(os.Stdout, openResultLogFile)
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			return 1
-		}
-
 		return result.ExitCode
 	}
 	os.Exit(run())
 }
+
+// copyFile copies src to dst through a temporary file
+// so dst is never left half-written when it is opened by a PDF viewer.
+func copyFile(dst, src string) error {
+	openSrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer openSrc.Close()
+
+	tmp := dst + ".tmp"
+	openTmp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp)
+	}()
+	if _, err = io.Copy(openTmp, openSrc); err != nil {
+		_ = openTmp.Close()
+		return err
+	}
+	if err = openTmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// DefaultPreset is used when [BuildParams.Preset] is empty.
+const DefaultPreset = "article"
+
+// Preset is a named Pandoc setup shipped with the binary.
+// Its metadata and optional template are stored in presetdata/<name>.
+type Preset struct {
+	Name   string
+	Writer string // Pandoc output format
+}
+
+var presets = map[string]*Preset{
+	"article": {Name: "article", Writer: "latex"},
+	"report":  {Name: "report", Writer: "latex"},
+	"letter":  {Name: "letter", Writer: "latex"},
+	"slides":  {Name: "slides", Writer: "beamer"},
+}
+
+//go:embed presetdata
+var presetData embed.FS
+
+// LookupPreset returns the preset with the given name.
+// If name is empty, it returns the default preset.
+func LookupPreset(name string) (*Preset, error) {
+	if name == "" {
+		name = DefaultPreset
+	}
+	p, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", name)
+	}
+	return p, nil
+}
+
+// presetFiles holds files written by writePresetFiles.
+// TemplateFile is empty if the preset uses the Pandoc default template.
+type presetFiles struct {
+	MetadataFile string
+	TemplateFile string
+}
+
+// writePresetFiles copies the preset metadata and template to dir
+// because Pandoc can only read them from the file system.
+func writePresetFiles(p *Preset, dir string) (*presetFiles, error) {
+	files := &presetFiles{}
+
+	metadata, err := presetData.ReadFile(path.Join("presetdata", p.Name, "metadata.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	files.MetadataFile = filepath.Join(dir, "preset-metadata.yaml")
+	if err = os.WriteFile(files.MetadataFile, metadata, 0o666); err != nil {
+		return nil, err
+	}
+
+	template, err := presetData.ReadFile(path.Join("presetdata", p.Name, "template.latex"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return files, nil
+		}
+		return nil, err
+	}
+	files.TemplateFile = filepath.Join(dir, "preset-template.latex")
+	if err = os.WriteFile(files.TemplateFile, template, 0o666); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWritePresetFiles(t *testing.T) {
+	for name := range presets {
+		t.Run(name, func(t *testing.T) {
+			p, err := LookupPreset(name)
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+
+			files, err := writePresetFiles(p, t.TempDir())
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			if _, err = os.Stat(files.MetadataFile); err != nil {
+				t.Errorf("got %q err", err)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := LookupPreset("unknown"); err == nil {
+			t.Error("got nil err")
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/k11v/brick/internal/buildlog"
+)
+
+// maxSummaryDiagnostics is the number of errors and warnings printed in a watch summary.
+const maxSummaryDiagnostics = 5
+
+type WatchParams struct {
+	Dir      string
+	Exclude  []string      // files and dirs that don't trigger builds, e.g. the cache dir
+	Interval time.Duration // how often Dir is scanned
+	Debounce time.Duration // how long Dir must stay unchanged before a build
+}
+
+// Watch calls onChange once at the start and then after Dir changes
+// until ctx is done. Changes are found by polling file sizes and modification times.
+// Changes made while onChange runs trigger another call.
+func Watch(ctx context.Context, params *WatchParams, onChange func()) error {
+	exclude := make(map[string]struct{}, len(params.Exclude))
+	for _, p := range params.Exclude {
+		absP, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		exclude[absP] = struct{}{}
+	}
+
+	prev, err := snapshotDir(params.Dir, exclude)
+	if err != nil {
+		return err
+	}
+	onChange()
+
+	ticker := time.NewTicker(params.Interval)
+	defer ticker.Stop()
+	var changedAt time.Time // zero if there are no pending changes
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			next, err := snapshotDir(params.Dir, exclude)
+			if err != nil {
+				return err
+			}
+			if !maps.Equal(prev, next) {
+				prev = next
+				changedAt = now
+				continue
+			}
+			if !changedAt.IsZero() && now.Sub(changedAt) >= params.Debounce {
+				changedAt = time.Time{}
+				onChange()
+			}
+		}
+	}
+}
+
+type fileState struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// snapshotDir returns states of regular files in dir.
+func snapshotDir(dir string, exclude map[string]struct{}) (map[string]fileState, error) {
+	snapshot := make(map[string]fileState)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		absP, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if _, excluded := exclude[absP]; excluded {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		snapshot[p] = fileState{Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// writeSummary writes a short summary of a build result instead of the whole log.
+// It includes the first few errors and warnings parsed from the log.
+func writeSummary(w io.Writer, result *BuildResult, outputFile string, duration time.Duration) error {
+	var diagnostics []*buildlog.Diagnostic
+	if result.LogFile != "" {
+		openLogFile, err := os.Open(result.LogFile)
+		if err != nil {
+			return err
+		}
+		defer openLogFile.Close()
+		diagnostics, err = buildlog.Parse(openLogFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	errorsCount, warningsCount := 0, 0
+	for _, d := range diagnostics {
+		switch d.Severity {
+		case buildlog.SeverityError:
+			errorsCount++
+		case buildlog.SeverityWarning:
+			warningsCount++
+		}
+	}
+
+	duration = duration.Round(100 * time.Millisecond)
+	var err error
+	if result.ExitCode == 0 {
+		_, err = fmt.Fprintf(w, "%s built %s in %s, %d warnings\n", time.Now().Format(time.TimeOnly), outputFile, duration, warningsCount)
+	} else {
+		_, err = fmt.Fprintf(w, "%s failed with exit code %d in %s, %d errors, %d warnings\n", time.Now().Format(time.TimeOnly), result.ExitCode, duration, errorsCount, warningsCount)
+	}
+	if err != nil {
+		return err
+	}
+
+	printed := 0
+	for _, d := range diagnostics {
+		if printed >= maxSummaryDiagnostics {
+			break
+		}
+		if d.Severity == buildlog.SeverityInfo {
+			continue
+		}
+		location := d.Stage
+		if d.File != "" {
+			location = d.File
+			if d.Line > 0 {
+				location = fmt.Sprintf("%s:%d", d.File, d.Line)
+			}
+		}
+		if _, err = fmt.Fprintf(w, "  %s: %s: %s\n", d.Severity, location, d.Message); err != nil {
+			return err
+		}
+		printed++
+	}
+
+	return nil
+}
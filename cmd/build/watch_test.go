@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	t.Run("calls onChange on start and after changes", func(t *testing.T) {
+		dir := t.TempDir()
+		cacheDir := filepath.Join(dir, "cache")
+		if err := os.MkdirAll(cacheDir, 0o777); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		calls := 0
+		err := Watch(ctx, &WatchParams{
+			Dir:      dir,
+			Exclude:  []string{cacheDir},
+			Interval: 10 * time.Millisecond,
+			Debounce: 30 * time.Millisecond,
+		}, func() {
+			calls++
+			switch calls {
+			case 1:
+				// Excluded changes don't trigger builds.
+				if err := os.WriteFile(filepath.Join(cacheDir, "log"), []byte("log"), 0o666); err != nil {
+					t.Errorf("got %q err", err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "main.md"), []byte("# Title"), 0o666); err != nil {
+					t.Errorf("got %q err", err)
+				}
+			case 2:
+				cancel()
+			}
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := calls, 2; got != want {
+			t.Errorf("got %d calls, want %d", got, want)
+		}
+	})
+}
@@ -0,0 +1,992 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/k11v/brick/internal/build"
+	"github.com/k11v/brick/internal/storage"
+)
+
+const (
+	HeaderAuthorization      = "Authorization"
+	HeaderXIdempotencyKey    = "X-Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+type buildJSON struct {
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	IdempotencyKey uuid.UUID `json:"idempotency_key"`
+	UserID         uuid.UUID `json:"user_id"`
+
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	ExitCode *int   `json:"exit_code"`
+
+	Preset             string `json:"preset"`
+	TemplateFile       string `json:"template_file,omitempty"`
+	HeaderIncludesFile string `json:"header_includes_file,omitempty"`
+	BibliographyFile   string `json:"bibliography_file,omitempty"`
+	CSL                string `json:"csl,omitempty"`
+	Engine             string `json:"engine"`
+
+	CachedFromID *uuid.UUID `json:"cached_from_id,omitempty"`
+
+	Labels   []string `json:"labels"`
+	Priority string   `json:"priority"`
+
+	ParentBuildID *uuid.UUID `json:"parent_build_id,omitempty"`
+
+	StartedAt    *time.Time `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+	Stage        string     `json:"stage,omitempty"`
+	QueueSeconds *float64   `json:"queue_seconds"`
+	RunSeconds   *float64   `json:"run_seconds"`
+}
+
+func newBuildJSON(b *build.Build) *buildJSON {
+	var exitCode *int
+	if b.ExitCode >= 0 {
+		exitCode = &b.ExitCode
+	}
+	var cachedFromID *uuid.UUID
+	if b.CachedFromID != uuid.Nil {
+		cachedFromID = &b.CachedFromID
+	}
+	var parentBuildID *uuid.UUID
+	if b.ParentBuildID != uuid.Nil {
+		parentBuildID = &b.ParentBuildID
+	}
+	var startedAt, finishedAt *time.Time
+	var queueSeconds, runSeconds *float64
+	if !b.StartedAt.IsZero() {
+		startedAt = &b.StartedAt
+		queueSeconds = new(float64)
+		*queueSeconds = b.QueueDuration().Seconds()
+	}
+	if !b.FinishedAt.IsZero() {
+		finishedAt = &b.FinishedAt
+	}
+	if !b.StartedAt.IsZero() && !b.FinishedAt.IsZero() {
+		runSeconds = new(float64)
+		*runSeconds = b.RunDuration().Seconds()
+	}
+	return &buildJSON{
+		ID:             b.ID,
+		CreatedAt:      b.CreatedAt,
+		IdempotencyKey: b.IdempotencyKey,
+		UserID:         b.UserID,
+
+		Status:   string(b.Status),
+		Error:    string(b.Error),
+		ExitCode: exitCode,
+
+		Preset:             string(b.Preset),
+		TemplateFile:       b.TemplateFile,
+		HeaderIncludesFile: b.HeaderIncludesFile,
+		BibliographyFile:   b.BibliographyFile,
+		CSL:                b.CSL,
+		Engine:             string(b.Engine),
+
+		CachedFromID: cachedFromID,
+
+		Labels:   b.Labels,
+		Priority: string(b.Priority),
+
+		ParentBuildID: parentBuildID,
+
+		StartedAt:    startedAt,
+		FinishedAt:   finishedAt,
+		Stage:        b.Stage,
+		QueueSeconds: queueSeconds,
+		RunSeconds:   runSeconds,
+	}
+}
+
+type diagnosticJSON struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+	Stage    string `json:"stage,omitempty"`
+}
+
+func newDiagnosticJSON(d *build.Diagnostic) *diagnosticJSON {
+	return &diagnosticJSON{
+		Severity: string(d.Severity),
+		File:     d.File,
+		Line:     d.Line,
+		Message:  d.Message,
+		Stage:    d.Stage,
+	}
+}
+
+// GetBuild handles GET /v1/builds/{id}.
+func (h *Handler) GetBuild(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+
+	getter := build.NewGetter(h.db, h.st)
+	b, err := getter.Get(r.Context(), &build.GetterGetParams{ID: id, UserID: userID})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	h.serveJSON(w, r, newBuildJSON(b), http.StatusOK)
+}
+
+type quotaLimitJSON struct {
+	Name     string     `json:"name"`
+	Max      *int64     `json:"max"`
+	Used     int64      `json:"used"`
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+func newQuotaLimitJSON(l *build.QuotaLimit) *quotaLimitJSON {
+	var maxValue *int64
+	if l.Max >= 0 {
+		maxValue = &l.Max
+	}
+	var resetsAt *time.Time
+	if !l.ResetsAt.IsZero() {
+		resetsAt = &l.ResetsAt
+	}
+	return &quotaLimitJSON{
+		Name:     string(l.Name),
+		Max:      maxValue,
+		Used:     l.Used,
+		ResetsAt: resetsAt,
+	}
+}
+
+// GetQuota handles GET /v1/quota.
+// Unlimited limits have null max.
+func (h *Handler) GetQuota(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	getter := build.NewGetter(h.db, h.st)
+	q, err := getter.GetQuota(r.Context(), &build.GetterGetQuotaParams{UserID: userID})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type response struct {
+		Plan          string            `json:"plan"`
+		WindowSeconds int64             `json:"window_seconds"`
+		Limits        []*quotaLimitJSON `json:"limits"`
+	}
+	resp := response{
+		Plan:          q.Plan,
+		WindowSeconds: int64(q.Window.Seconds()),
+		Limits:        make([]*quotaLimitJSON, 0, len(q.Limits)),
+	}
+	for _, l := range q.Limits {
+		resp.Limits = append(resp.Limits, newQuotaLimitJSON(l))
+	}
+	h.serveJSON(w, r, &resp, http.StatusOK)
+}
+
+// ListBuilds handles GET /v1/builds.
+// Query parameters status, error, label, created_after and created_before (RFC 3339) filter builds.
+// Query parameters limit and cursor paginate them, cursor is next_cursor of the previous page.
+func (h *Handler) ListBuilds(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	params := &build.GetterListParams{
+		UserID: userID,
+		Status: build.Status(query.Get("status")),
+		Error:  build.Error(query.Get("error")),
+		Label:  query.Get("label"),
+		Cursor: query.Get("cursor"),
+	}
+	for name, t := range map[string]*time.Time{
+		"created_after":  &params.CreatedAfter,
+		"created_before": &params.CreatedBefore,
+	} {
+		if value := query.Get(name); value != "" {
+			*t, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				h.serveAPIError(w, r, fmt.Errorf("%w: invalid %s query parameter", errBadRequest, name))
+				return
+			}
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		params.Limit, err = strconv.Atoi(value)
+		if err != nil || params.Limit <= 0 {
+			h.serveAPIError(w, r, fmt.Errorf("%w: invalid limit query parameter", errBadRequest))
+			return
+		}
+	}
+
+	getter := build.NewGetter(h.db, h.st)
+	page, err := getter.List(r.Context(), params)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type response struct {
+		Builds     []*buildJSON `json:"builds"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+	}
+	resp := response{
+		Builds:     make([]*buildJSON, 0, len(page.Builds)),
+		NextCursor: page.NextCursor,
+	}
+	for _, b := range page.Builds {
+		resp.Builds = append(resp.Builds, newBuildJSON(b))
+	}
+	h.serveJSON(w, r, &resp, http.StatusOK)
+}
+
+// GetBuildDiagnostics handles GET /v1/builds/{id}/diagnostics.
+func (h *Handler) GetBuildDiagnostics(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+
+	getter := build.NewGetter(h.db, h.st)
+	diagnostics, err := getter.GetDiagnostics(r.Context(), &build.GetterGetParams{ID: id, UserID: userID})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type response struct {
+		Diagnostics []*diagnosticJSON `json:"diagnostics"`
+	}
+	resp := response{Diagnostics: make([]*diagnosticJSON, 0, len(diagnostics))}
+	for _, d := range diagnostics {
+		resp.Diagnostics = append(resp.Diagnostics, newDiagnosticJSON(d))
+	}
+	h.serveJSON(w, r, &resp, http.StatusOK)
+}
+
+type fileJSON struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Size   *int64 `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func newFileJSON(f *build.File) *fileJSON {
+	var size *int64
+	if f.Size >= 0 {
+		size = &f.Size
+	}
+	return &fileJSON{
+		Name:   f.Name,
+		Type:   string(f.Type),
+		Size:   size,
+		SHA256: f.SHA256,
+	}
+}
+
+// CreateBuild handles POST /v1/builds.
+// The body is a project archive, its format is chosen by the Content-Type header.
+// Options are query parameters named like fields of buildJSON, labels are repeated label parameters.
+func (h *Handler) CreateBuild(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	idempotencyKey, err := uuid.Parse(r.Header.Get(HeaderXIdempotencyKey))
+	if err != nil {
+		h.serveAPIError(w, r, fmt.Errorf("%w: missing or invalid %s header", errBadRequest, HeaderXIdempotencyKey))
+		return
+	}
+
+	format, err := archiveFormat(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	noCache, err := noCacheQuery(query)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	creator := build.NewCreator(h.db, h.queue, h.st, h.creatorParams)
+	b, err := creator.Create(r.Context(), &build.CreatorCreateParams{
+		IdempotencyKey:     idempotencyKey,
+		UserID:             userID,
+		Archive:            r.Body,
+		ArchiveFormat:      format,
+		Preset:             build.Preset(query.Get("preset")),
+		TemplateFile:       query.Get("template_file"),
+		HeaderIncludesFile: query.Get("header_includes_file"),
+		BibliographyFile:   query.Get("bibliography_file"),
+		CSL:                query.Get("csl"),
+		Engine:             build.Engine(query.Get("engine")),
+		NoCache:            noCache,
+		Labels:             query["label"],
+		Priority:           build.Priority(query.Get("priority")),
+	})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	h.serveJSON(w, r, newBuildJSON(b), createdStatusCode(w, b))
+}
+
+// RerunBuild handles POST /v1/builds/{id}/rerun.
+// The build is rerun with the same inputs and options.
+// Query parameters override options like in CreateBuild, labels override all labels.
+// The optional body is an archive with files that replace files with the same names.
+func (h *Handler) RerunBuild(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+	idempotencyKey, err := uuid.Parse(r.Header.Get(HeaderXIdempotencyKey))
+	if err != nil {
+		h.serveAPIError(w, r, fmt.Errorf("%w: missing or invalid %s header", errBadRequest, HeaderXIdempotencyKey))
+		return
+	}
+
+	params := &build.CreatorRerunParams{
+		IdempotencyKey: idempotencyKey,
+		UserID:         userID,
+		ParentID:       id,
+	}
+	if r.Header.Get("Content-Type") != "" {
+		params.ArchiveFormat, err = archiveFormat(r)
+		if err != nil {
+			h.serveAPIError(w, r, err)
+			return
+		}
+		params.Archive = r.Body
+	}
+
+	query := r.URL.Query()
+	params.NoCache, err = noCacheQuery(query)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	optionQuery := func(name string) *string {
+		if !query.Has(name) {
+			return nil
+		}
+		value := query.Get(name)
+		return &value
+	}
+	if preset := optionQuery("preset"); preset != nil {
+		params.Preset = (*build.Preset)(preset)
+	}
+	params.TemplateFile = optionQuery("template_file")
+	params.HeaderIncludesFile = optionQuery("header_includes_file")
+	params.BibliographyFile = optionQuery("bibliography_file")
+	params.CSL = optionQuery("csl")
+	if engine := optionQuery("engine"); engine != nil {
+		params.Engine = (*build.Engine)(engine)
+	}
+	params.Labels = query["label"]
+	if priority := optionQuery("priority"); priority != nil {
+		params.Priority = (*build.Priority)(priority)
+	}
+
+	creator := build.NewCreator(h.db, h.queue, h.st, h.creatorParams)
+	b, err := creator.Rerun(r.Context(), params)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	h.serveJSON(w, r, newBuildJSON(b), createdStatusCode(w, b))
+}
+
+// archiveFormat returns the format of the project archive in the request body.
+func archiveFormat(r *http.Request) (build.ArchiveFormat, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/zip":
+		return build.ArchiveFormatZip, nil
+	case "application/gzip", "application/x-gzip":
+		return build.ArchiveFormatTarGz, nil
+	case "application/x-tar":
+		return build.ArchiveFormatTar, nil
+	default:
+		return "", fmt.Errorf("%w: unsupported Content-Type %q", errBadRequest, mediaType)
+	}
+}
+
+func noCacheQuery(query url.Values) (bool, error) {
+	noCacheValue := query.Get("no_cache")
+	if noCacheValue == "" {
+		return false, nil
+	}
+	noCache, err := strconv.ParseBool(noCacheValue)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid no_cache query parameter", errBadRequest)
+	}
+	return noCache, nil
+}
+
+// createdStatusCode returns the status code of a response with a created build.
+// Replays of requests with a used idempotency key respond with the same build
+// and mark the response with the Idempotent-Replayed header.
+func createdStatusCode(w http.ResponseWriter, b *build.Build) int {
+	if b.Replayed {
+		w.Header().Set(HeaderIdempotentReplayed, "true")
+		return http.StatusOK
+	}
+	return http.StatusCreated
+}
+
+// CreateBuildReservation handles POST /v1/builds/reservations.
+// It reserves a build and responds with presigned upload URLs for its files.
+// Files with content the user already uploaded are linked without uploads.
+func (h *Handler) CreateBuildReservation(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	idempotencyKey, err := uuid.Parse(r.Header.Get(HeaderXIdempotencyKey))
+	if err != nil {
+		h.serveAPIError(w, r, fmt.Errorf("%w: missing or invalid %s header", errBadRequest, HeaderXIdempotencyKey))
+		return
+	}
+
+	type request struct {
+		Files []*fileJSON `json:"files"`
+
+		Preset             string   `json:"preset"`
+		TemplateFile       string   `json:"template_file"`
+		HeaderIncludesFile string   `json:"header_includes_file"`
+		BibliographyFile   string   `json:"bibliography_file"`
+		CSL                string   `json:"csl"`
+		Engine             string   `json:"engine"`
+		NoCache            bool     `json:"no_cache"`
+		Labels             []string `json:"labels"`
+		Priority           string   `json:"priority"`
+	}
+	var req request
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.serveAPIError(w, r, fmt.Errorf("%w: %w", errBadRequest, err))
+		return
+	}
+
+	params := &build.CreatorReserveParams{
+		IdempotencyKey:     idempotencyKey,
+		UserID:             userID,
+		Files:              make([]*build.CreatorReserveFileParams, 0, len(req.Files)),
+		Preset:             build.Preset(req.Preset),
+		TemplateFile:       req.TemplateFile,
+		HeaderIncludesFile: req.HeaderIncludesFile,
+		BibliographyFile:   req.BibliographyFile,
+		CSL:                req.CSL,
+		Engine:             build.Engine(req.Engine),
+		NoCache:            req.NoCache,
+		Labels:             req.Labels,
+		Priority:           build.Priority(req.Priority),
+	}
+	for _, f := range req.Files {
+		typ, known := build.ParseFileType(f.Type)
+		if !known {
+			h.serveAPIError(w, r, fmt.Errorf("%w: %s: unknown file type", errBadRequest, f.Name))
+			return
+		}
+		var size int64
+		if f.Size != nil {
+			size = *f.Size
+		} else if typ == build.FileTypeRegular {
+			h.serveAPIError(w, r, fmt.Errorf("%w: %s: missing size", errBadRequest, f.Name))
+			return
+		}
+		params.Files = append(params.Files, &build.CreatorReserveFileParams{Name: f.Name, Type: typ, Size: size, SHA256: f.SHA256})
+	}
+
+	creator := build.NewCreator(h.db, h.queue, h.st, h.creatorParams)
+	reservation, err := creator.Reserve(r.Context(), params)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type uploadJSON struct {
+		File    *fileJSON         `json:"file"`
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	}
+	type response struct {
+		Build   *buildJSON    `json:"build"`
+		Uploads []*uploadJSON `json:"uploads"`
+	}
+	resp := response{
+		Build:   newBuildJSON(reservation.Build),
+		Uploads: make([]*uploadJSON, 0, len(reservation.Uploads)),
+	}
+	for _, u := range reservation.Uploads {
+		headers := make(map[string]string, len(u.Request.Header))
+		for k := range u.Request.Header {
+			headers[k] = u.Request.Header.Get(k)
+		}
+		resp.Uploads = append(resp.Uploads, &uploadJSON{
+			File:    newFileJSON(u.File),
+			Method:  http.MethodPut,
+			URL:     u.Request.URL,
+			Headers: headers,
+		})
+	}
+	h.serveJSON(w, r, &resp, createdStatusCode(w, reservation.Build))
+}
+
+// FinalizeBuild handles POST /v1/builds/{id}/finalize.
+// It enqueues a reserved build after its files are uploaded.
+func (h *Handler) FinalizeBuild(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+
+	creator := build.NewCreator(h.db, h.queue, h.st, h.creatorParams)
+	b, err := creator.Finalize(r.Context(), &build.CreatorFinalizeParams{ID: id, UserID: userID})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	h.serveJSON(w, r, newBuildJSON(b), http.StatusOK)
+}
+
+// GetBuildOutput handles GET /v1/builds/{id}/output.pdf.
+func (h *Handler) GetBuildOutput(w http.ResponseWriter, r *http.Request) {
+	getter := build.NewGetter(h.db, h.st)
+	h.serveBuildData(w, r, getter.PresignOutputData, getter.CopyOutputData, build.OutputContentType, build.OutputFilename)
+}
+
+// GetBuildLog handles GET /v1/builds/{id}/log.
+func (h *Handler) GetBuildLog(w http.ResponseWriter, r *http.Request) {
+	getter := build.NewGetter(h.db, h.st)
+	h.serveBuildData(w, r, getter.PresignLogData, getter.CopyLogData, build.LogContentType, build.LogFilename)
+}
+
+// GetBuildInputZip handles GET /v1/builds/{id}/input.zip.
+func (h *Handler) GetBuildInputZip(w http.ResponseWriter, r *http.Request) {
+	h.serveBuildInputArchive(w, r, build.ArchiveFormatZip)
+}
+
+// GetBuildInputTarGz handles GET /v1/builds/{id}/input.tar.gz.
+func (h *Handler) GetBuildInputTarGz(w http.ResponseWriter, r *http.Request) {
+	h.serveBuildInputArchive(w, r, build.ArchiveFormatTarGz)
+}
+
+// serveBuildInputArchive streams input files of the build as an archive.
+// Errors are served as JSON only if nothing was written yet.
+func (h *Handler) serveBuildInputArchive(w http.ResponseWriter, r *http.Request, format build.ArchiveFormat) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("brick-%s-input.%s", id, format)
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	cw := &countWriter{w: w}
+	getter := build.NewGetter(h.db, h.st)
+	err = getter.CopyInputArchive(r.Context(), cw, &build.GetterGetParams{ID: id, UserID: userID}, format)
+	if err != nil {
+		if cw.n > 0 {
+			slog.Error("didn't write input archive", "err", err)
+			return
+		}
+		w.Header().Del("Content-Disposition")
+		h.serveAPIError(w, r, err)
+		return
+	}
+}
+
+// countWriter counts bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// serveBuildData redirects to a presigned URL of build data.
+// If the storage can't presign URLs, the data is proxied through the server.
+func (h *Handler) serveBuildData(
+	w http.ResponseWriter,
+	r *http.Request,
+	presign func(context.Context, *build.GetterGetParams) (string, error),
+	copyData func(context.Context, io.Writer, *build.GetterGetParams) error,
+	contentType string,
+	filename func(*build.Build) string,
+) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+	params := &build.GetterGetParams{ID: id, UserID: userID}
+
+	u, err := presign(r.Context(), params)
+	if err == nil {
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		return
+	}
+	if !errors.Is(err, storage.ErrPresignUnsupported) {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	// The data is buffered so errors can still be served as JSON.
+	var buf bytes.Buffer
+	if err = copyData(r.Context(), &buf, params); err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	b, err := build.NewGetter(h.db, h.st).Get(r.Context(), params)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename(b)}))
+	w.WriteHeader(http.StatusOK)
+	if _, err = buf.WriteTo(w); err != nil {
+		slog.Error("didn't write build data", "err", err)
+	}
+}
+
+type webhookJSON struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	BuildID   *uuid.UUID `json:"build_id,omitempty"`
+	URL       string     `json:"url"`
+	Secret    string     `json:"secret,omitempty"` // only in the response of CreateWebhook
+}
+
+func newWebhookJSON(wh *build.Webhook) *webhookJSON {
+	var buildID *uuid.UUID
+	if wh.BuildID != uuid.Nil {
+		buildID = &wh.BuildID
+	}
+	return &webhookJSON{
+		ID:        wh.ID,
+		CreatedAt: wh.CreatedAt,
+		BuildID:   buildID,
+		URL:       wh.URL,
+	}
+}
+
+// CreateWebhook handles POST /v1/webhooks.
+// The webhook is notified about all builds of the user unless build_id is set.
+// The response has the secret that signs requests to the webhook, it isn't shown again.
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type request struct {
+		URL     string     `json:"url"`
+		BuildID *uuid.UUID `json:"build_id"`
+	}
+	var req request
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.serveAPIError(w, r, fmt.Errorf("%w: %w", errBadRequest, err))
+		return
+	}
+	params := &build.NotifierCreateWebhookParams{UserID: userID, URL: req.URL}
+	if req.BuildID != nil {
+		params.BuildID = *req.BuildID
+	}
+
+	notifier := build.NewNotifier(h.db, &build.NotifierParams{})
+	wh, err := notifier.CreateWebhook(r.Context(), params)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	resp := newWebhookJSON(wh)
+	resp.Secret = wh.Secret
+	h.serveJSON(w, r, resp, http.StatusCreated)
+}
+
+// ListWebhooks handles GET /v1/webhooks.
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	notifier := build.NewNotifier(h.db, &build.NotifierParams{})
+	webhooks, err := notifier.ListWebhooks(r.Context(), &build.NotifierListWebhooksParams{UserID: userID})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type response struct {
+		Webhooks []*webhookJSON `json:"webhooks"`
+	}
+	resp := response{Webhooks: make([]*webhookJSON, 0, len(webhooks))}
+	for _, wh := range webhooks {
+		resp.Webhooks = append(resp.Webhooks, newWebhookJSON(wh))
+	}
+	h.serveJSON(w, r, &resp, http.StatusOK)
+}
+
+// DeleteWebhook handles DELETE /v1/webhooks/{id}.
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+
+	notifier := build.NewNotifier(h.db, &build.NotifierParams{})
+	err = notifier.DeleteWebhook(r.Context(), &build.NotifierDeleteWebhookParams{ID: id, UserID: userID})
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type webhookDeliveryJSON struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"event"`
+	BuildID   uuid.UUID `json:"build_id"`
+
+	State          string     `json:"state"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+func newWebhookDeliveryJSON(d *build.WebhookDelivery) *webhookDeliveryJSON {
+	var nextAttemptAt, lastAttemptAt *time.Time
+	if !d.NextAttemptAt.IsZero() {
+		nextAttemptAt = &d.NextAttemptAt
+	}
+	if !d.LastAttemptAt.IsZero() {
+		lastAttemptAt = &d.LastAttemptAt
+	}
+	return &webhookDeliveryJSON{
+		ID:        d.ID,
+		CreatedAt: d.CreatedAt,
+		Event:     string(d.Event),
+		BuildID:   d.BuildID,
+
+		State:          string(d.State),
+		Attempts:       d.Attempts,
+		NextAttemptAt:  nextAttemptAt,
+		LastAttemptAt:  lastAttemptAt,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+	}
+}
+
+// ListWebhookDeliveries handles GET /v1/webhooks/{id}/deliveries.
+// It responds with the latest deliveries, the limit query parameter sets their number.
+func (h *Handler) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveAPIError(w, r, build.ErrNotFound)
+		return
+	}
+	params := &build.NotifierListDeliveriesParams{WebhookID: id, UserID: userID}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		params.Limit, err = strconv.Atoi(value)
+		if err != nil || params.Limit <= 0 {
+			h.serveAPIError(w, r, fmt.Errorf("%w: invalid limit query parameter", errBadRequest))
+			return
+		}
+	}
+
+	notifier := build.NewNotifier(h.db, &build.NotifierParams{})
+	deliveries, err := notifier.ListDeliveries(r.Context(), params)
+	if err != nil {
+		h.serveAPIError(w, r, err)
+		return
+	}
+
+	type response struct {
+		Deliveries []*webhookDeliveryJSON `json:"deliveries"`
+	}
+	resp := response{Deliveries: make([]*webhookDeliveryJSON, 0, len(deliveries))}
+	for _, d := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, newWebhookDeliveryJSON(d))
+	}
+	h.serveJSON(w, r, &resp, http.StatusOK)
+}
+
+func (h *Handler) serveJSON(w http.ResponseWriter, r *http.Request, v any, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("didn't encode JSON", "err", err)
+	}
+}
+
+// serveAPIError serves err as a JSON error with a status code from apiStatusCode.
+// Messages of internal errors aren't exposed.
+func (h *Handler) serveAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	statusCode := apiStatusCode(err)
+	message := err.Error()
+	if statusCode == http.StatusInternalServerError {
+		slog.Error("error", "err", err)
+		message = http.StatusText(statusCode)
+	}
+	if limitErr := (*build.LimitError)(nil); errors.As(err, &limitErr) && !limitErr.Limit.ResetsAt.IsZero() {
+		retryAfter := int(math.Ceil(time.Until(limitErr.Limit.ResetsAt).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 0)))
+	}
+
+	type response struct {
+		Error string `json:"error"`
+	}
+	h.serveJSON(w, r, &response{Error: message}, statusCode)
+}
+
+// errBadRequest is wrapped by errors of malformed API requests.
+var errBadRequest = errors.New("bad request")
+
+func apiStatusCode(err error) int {
+	switch {
+	case errors.Is(err, errBadRequest),
+		errors.Is(err, build.ErrInvalidCursor):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, build.ErrAccessDenied), errors.Is(err, build.ErrNotFound):
+		// Access denied is reported as not found to hide the existence of builds.
+		return http.StatusNotFound
+	case errors.Is(err, build.ErrNotDone),
+		errors.Is(err, build.ErrDoneWithError),
+		errors.Is(err, build.ErrAlreadyDoing),
+		errors.Is(err, build.ErrAlreadyDone),
+		errors.Is(err, build.ErrNotReserved),
+		errors.Is(err, build.ErrReserved):
+		return http.StatusConflict
+	case errors.Is(err, build.ErrLimitExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, build.ErrIdempotencyKeyAlreadyUsed):
+		return http.StatusConflict
+	case errors.Is(err, build.ErrFileTooLarge),
+		errors.Is(err, build.ErrFilesTooLarge),
+		errors.Is(err, build.ErrTooManyFiles),
+		errors.Is(err, build.ErrArchiveTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, build.ErrUnknownPreset),
+		errors.Is(err, build.ErrUnknownCSLStyle),
+		errors.Is(err, build.ErrUnknownEngine),
+		errors.Is(err, build.ErrUnknownPriority),
+		errors.Is(err, build.ErrOptionFileNotFound),
+		errors.Is(err, build.ErrFileNotUploaded),
+		errors.Is(err, build.ErrFileSizeMismatch),
+		errors.Is(err, build.ErrFileChecksumMismatch),
+		errors.Is(err, build.ErrInvalidSHA256),
+		errors.Is(err, build.ErrInvalidArchive),
+		errors.Is(err, build.ErrNoFiles),
+		errors.Is(err, build.ErrInvalidFileName),
+		errors.Is(err, build.ErrDuplicateFileName),
+		errors.Is(err, build.ErrUnknownFileType),
+		errors.Is(err, build.ErrInvalidLabel),
+		errors.Is(err, build.ErrTooManyLabels),
+		errors.Is(err, build.ErrInvalidWebhookURL):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, build.ErrExpired):
+		return http.StatusGone
+	case errors.Is(err, storage.ErrPresignUnsupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+const cookieToken = "token"
+
+// readJWTVerificationKey reads a PEM-encoded Ed25519 public key.
+// See cmd/setup for how the key is generated.
+func readJWTVerificationKey(file string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("public key PEM block not found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed25519Key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not Ed25519")
+	}
+	return ed25519Key, nil
+}
+
+// authenticate returns the ID of the user that made the request.
+// The request token is taken from the Authorization header
+// or, for pages, from the token cookie.
+// Unsafe requests authenticated with the cookie must come from the same origin,
+// otherwise any site could make them on behalf of the user.
+func (h *Handler) authenticate(r *http.Request) (uuid.UUID, error) {
+	token := ""
+	if authorization := r.Header.Get(HeaderAuthorization); authorization != "" {
+		var found bool
+		token, found = strings.CutPrefix(authorization, "Bearer ")
+		if !found {
+			return uuid.UUID{}, fmt.Errorf("%w: %s header isn't bearer", ErrUnauthenticated, HeaderAuthorization)
+		}
+	} else if cookie, err := r.Cookie(cookieToken); err == nil {
+		token = cookie.Value
+		if !isSafeMethod(r.Method) {
+			if err = checkSameOrigin(r); err != nil {
+				return uuid.UUID{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+			}
+		}
+	}
+	if token == "" {
+		return uuid.UUID{}, fmt.Errorf("%w: token missing", ErrUnauthenticated)
+	}
+
+	userID, _, err := verifyJWT(h.jwtVerificationKey, token, time.Now())
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	return userID, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkSameOrigin returns an error if the request may have been made by another site.
+// Sec-Fetch-Site is preferred, Origin is checked for browsers that don't send it.
+// Requests with neither header are rejected.
+func checkSameOrigin(r *http.Request) error {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		if site != "same-origin" && site != "none" {
+			return fmt.Errorf("request is %s", site)
+		}
+		return nil
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return errors.New("request origin missing")
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("request origin: %w", err)
+	}
+	if originURL.Host != r.Host {
+		return fmt.Errorf("request origin is %s", origin)
+	}
+	return nil
+}
+
+// setTokenCookie makes the browser send the token with page requests until the token expires.
+// SameSite=Strict keeps the cookie off requests started by other sites.
+func setTokenCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieToken,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func deleteTokenCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieToken,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type ExecuteLoginParams struct {
+	Invalid bool
+}
+
+func (h *Handler) GetLoginPage(w http.ResponseWriter, r *http.Request) {
+	page, err := h.execute("login.html.tmpl", &ExecuteLoginParams{})
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+	h.serveHTML(w, r, page)
+}
+
+// Login verifies the token submitted with the login form and stores it in the token cookie.
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	// The login form is checked too, another site could otherwise log the user in as someone else.
+	if err := checkSameOrigin(r); err != nil {
+		h.serveErrorPage(w, r, http.StatusForbidden)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	_, expires, err := verifyJWT(h.jwtVerificationKey, token, time.Now())
+	if err != nil {
+		page, err := h.execute("login.html.tmpl", &ExecuteLoginParams{Invalid: true})
+		if err != nil {
+			h.serveError(w, r, err)
+			return
+		}
+		h.serveHTMLWithStatusCode(w, r, page, http.StatusUnauthorized)
+		return
+	}
+
+	setTokenCookie(w, r, token, expires)
+	http.Redirect(w, r, "/builds", http.StatusSeeOther)
+}
+
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := checkSameOrigin(r); err != nil {
+		h.serveErrorPage(w, r, http.StatusForbidden)
+		return
+	}
+
+	deleteTokenCookie(w, r)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// verifyJWT verifies an EdDSA-signed JWT and returns its sub and exp claims.
+// The token must have the exp claim.
+func verifyJWT(key ed25519.PublicKey, token string, now time.Time) (uuid.UUID, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return uuid.UUID{}, time.Time{}, errors.New("token is malformed")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return uuid.UUID{}, time.Time{}, fmt.Errorf("token header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return uuid.UUID{}, time.Time{}, fmt.Errorf("token header: %w", err)
+	}
+	if header.Alg != "EdDSA" {
+		return uuid.UUID{}, time.Time{}, fmt.Errorf("token alg is %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return uuid.UUID{}, time.Time{}, fmt.Errorf("token signature: %w", err)
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return uuid.UUID{}, time.Time{}, errors.New("token signature is invalid")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return uuid.UUID{}, time.Time{}, fmt.Errorf("token claims: %w", err)
+	}
+	var claims struct {
+		Sub *uuid.UUID `json:"sub"`
+		Exp *int64     `json:"exp"`
+	}
+	if err = json.Unmarshal(claimsJSON, &claims); err != nil {
+		return uuid.UUID{}, time.Time{}, fmt.Errorf("token claims: %w", err)
+	}
+	if claims.Exp == nil || !now.Before(time.Unix(*claims.Exp, 0)) {
+		return uuid.UUID{}, time.Time{}, errors.New("token is expired")
+	}
+	if claims.Sub == nil {
+		return uuid.UUID{}, time.Time{}, errors.New("token sub claim missing")
+	}
+
+	return *claims.Sub, time.Unix(*claims.Exp, 0), nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"io/fs"
@@ -12,19 +13,48 @@ import (
 	"text/template"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 
-	"github.com/k11v/brick/internal/app"
+	"github.com/k11v/brick/internal/build"
+	"github.com/k11v/brick/internal/storage"
 )
 
-func NewServer(db *pgxpool.Pool, mq *app.AMQPClient, st *s3.Client, staticFsys fs.FS, cfg *Config) (*http.Server, error) {
+func NewServer(db *pgxpool.Pool, queue build.Queue, st storage.Storage, staticFsys fs.FS, cfg *Config) (*http.Server, error) {
 	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
 
-	h := NewHandler(db, mq, st, staticFsys)
+	jwtVerificationKey, err := readJWTVerificationKey(cfg.JWTVerificationKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewHandler(db, queue, st, staticFsys, jwtVerificationKey, &build.CreatorParams{
+		ImageVersion: cfg.BuildImageVersion,
+	})
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/builds", h.ListBuilds)
+	mux.HandleFunc("POST /v1/builds", h.CreateBuild)
+	mux.HandleFunc("POST /v1/builds/reservations", h.CreateBuildReservation)
+	mux.HandleFunc("GET /v1/builds/{id}", h.GetBuild)
+	mux.HandleFunc("POST /v1/builds/{id}/finalize", h.FinalizeBuild)
+	mux.HandleFunc("POST /v1/builds/{id}/rerun", h.RerunBuild)
+	mux.HandleFunc("GET /v1/builds/{id}/diagnostics", h.GetBuildDiagnostics)
+	mux.HandleFunc("GET /v1/builds/{id}/output.pdf", h.GetBuildOutput)
+	mux.HandleFunc("GET /v1/builds/{id}/log", h.GetBuildLog)
+	mux.HandleFunc("GET /v1/builds/{id}/input.zip", h.GetBuildInputZip)
+	mux.HandleFunc("GET /v1/builds/{id}/input.tar.gz", h.GetBuildInputTarGz)
+	mux.HandleFunc("GET /v1/quota", h.GetQuota)
+	mux.HandleFunc("GET /v1/webhooks", h.ListWebhooks)
+	mux.HandleFunc("POST /v1/webhooks", h.CreateWebhook)
+	mux.HandleFunc("DELETE /v1/webhooks/{id}", h.DeleteWebhook)
+	mux.HandleFunc("GET /v1/webhooks/{id}/deliveries", h.ListWebhookDeliveries)
 	mux.HandleFunc("GET /{$}", h.GetRoot)
+	mux.HandleFunc("GET /login", h.GetLoginPage)
+	mux.HandleFunc("POST /login", h.Login)
+	mux.HandleFunc("POST /logout", h.Logout)
+	mux.HandleFunc("GET /builds", h.GetBuildsPage)
+	mux.HandleFunc("POST /builds/{id}/cancel", h.CancelBuildRow)
+	mux.HandleFunc("GET /builds/{id}", h.GetBuildPage)
 	mux.HandleFunc("GET /static/", h.GetStatic)
 	mux.HandleFunc("GET /", h.GetDefault)
 
@@ -39,22 +69,30 @@ func NewServer(db *pgxpool.Pool, mq *app.AMQPClient, st *s3.Client, staticFsys f
 }
 
 type Handler struct {
-	db         *pgxpool.Pool
-	mq         *app.AMQPClient
-	st         *s3.Client
-	staticFsys fs.FS
+	db                 *pgxpool.Pool
+	queue              build.Queue
+	st                 storage.Storage
+	staticFsys         fs.FS
+	jwtVerificationKey ed25519.PublicKey
+	creatorParams      *build.CreatorParams
 }
 
-func NewHandler(db *pgxpool.Pool, mq *app.AMQPClient, st *s3.Client, staticFsys fs.FS) *Handler {
+func NewHandler(db *pgxpool.Pool, queue build.Queue, st storage.Storage, staticFsys fs.FS, jwtVerificationKey ed25519.PublicKey, creatorParams *build.CreatorParams) *Handler {
 	return &Handler{
-		db:         db,
-		mq:         mq,
-		st:         st,
-		staticFsys: staticFsys,
+		db:                 db,
+		queue:              queue,
+		st:                 st,
+		staticFsys:         staticFsys,
+		jwtVerificationKey: jwtVerificationKey,
+		creatorParams:      creatorParams,
 	}
 }
 
-type ExecuteBuildParams struct{}
+type ExecuteBuildParams struct {
+	Build       *build.Build
+	Files       []*build.File
+	Diagnostics []*build.Diagnostic
+}
 
 func (h *Handler) GetRoot(w http.ResponseWriter, r *http.Request) {
 	page, err := h.execute("build.html.tmpl", &ExecuteBuildParams{})
@@ -65,6 +103,152 @@ func (h *Handler) GetRoot(w http.ResponseWriter, r *http.Request) {
 	h.serveHTML(w, r, page)
 }
 
+func (h *Handler) GetBuildPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveErrorPage(w, r, http.StatusUnauthorized)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveErrorPage(w, r, http.StatusNotFound)
+		return
+	}
+
+	getter := build.NewGetter(h.db, h.st)
+	getParams := &build.GetterGetParams{ID: id, UserID: userID}
+	b, err := getter.Get(r.Context(), getParams)
+	if err != nil {
+		if errors.Is(err, build.ErrNotFound) || errors.Is(err, build.ErrAccessDenied) {
+			h.serveErrorPage(w, r, http.StatusNotFound)
+			return
+		}
+		h.serveError(w, r, err)
+		return
+	}
+	files, err := getter.GetFiles(r.Context(), getParams)
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+	diagnostics, err := getter.GetDiagnostics(r.Context(), getParams)
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+
+	page, err := h.execute("build.html.tmpl", &ExecuteBuildParams{
+		Build:       b,
+		Files:       files,
+		Diagnostics: diagnostics,
+	})
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+	h.serveHTML(w, r, page)
+}
+
+type ExecuteBuildsParams struct {
+	Builds []*build.Build
+
+	// NextURL loads the next page of rows, it is empty on the last page.
+	NextURL string
+
+	Status string
+	Label  string
+}
+
+// GetBuildsPage renders the history of the user builds.
+// Pages after the first are requested by htmx when the last row is revealed,
+// they are rendered as rows only.
+func (h *Handler) GetBuildsPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveErrorPage(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	getter := build.NewGetter(h.db, h.st)
+	buildPage, err := getter.List(r.Context(), &build.GetterListParams{
+		UserID: userID,
+		Status: build.Status(query.Get("status")),
+		Label:  query.Get("label"),
+		Cursor: query.Get("cursor"),
+	})
+	if err != nil {
+		if errors.Is(err, build.ErrInvalidCursor) {
+			h.serveErrorPage(w, r, http.StatusBadRequest)
+			return
+		}
+		h.serveError(w, r, err)
+		return
+	}
+
+	params := &ExecuteBuildsParams{
+		Builds: buildPage.Builds,
+		Status: query.Get("status"),
+		Label:  query.Get("label"),
+	}
+	if buildPage.NextCursor != "" {
+		query.Set("cursor", buildPage.NextCursor)
+		params.NextURL = "/builds?" + query.Encode()
+	}
+
+	name := "builds.html.tmpl"
+	if r.Header.Get("HX-Request") == "true" {
+		name = "builds_rows"
+	}
+	page, err := h.execute(name, params)
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+	h.serveHTML(w, r, page)
+}
+
+// CancelBuildRow cancels the build and renders its updated row of the builds page.
+func (h *Handler) CancelBuildRow(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.authenticate(r)
+	if err != nil {
+		h.serveErrorPage(w, r, http.StatusUnauthorized)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		h.serveErrorPage(w, r, http.StatusNotFound)
+		return
+	}
+
+	canceler := build.NewCanceler(h.db)
+	b, err := canceler.Cancel(r.Context(), &build.CancelerCancelParams{ID: id, UserID: userID})
+	if err != nil {
+		switch {
+		case errors.Is(err, build.ErrNotFound), errors.Is(err, build.ErrAccessDenied):
+			h.serveErrorPage(w, r, http.StatusNotFound)
+			return
+		case errors.Is(err, build.ErrAlreadyDoing), errors.Is(err, build.ErrAlreadyDone):
+			// Render the current row, the build can't be canceled anymore.
+			b, err = build.NewGetter(h.db, h.st).Get(r.Context(), &build.GetterGetParams{ID: id, UserID: userID})
+			if err != nil {
+				h.serveError(w, r, err)
+				return
+			}
+		default:
+			h.serveError(w, r, err)
+			return
+		}
+	}
+
+	page, err := h.execute("builds_row", b)
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+	h.serveHTML(w, r, page)
+}
+
 func (h *Handler) GetStatic(w http.ResponseWriter, r *http.Request) {
 	staticHandler := http.StripPrefix("/static/", http.FileServerFS(h.staticFsys))
 	staticHandler.ServeHTTP(w, r)
@@ -75,14 +259,18 @@ type ExecuteErrorParams struct {
 }
 
 func (h *Handler) GetDefault(w http.ResponseWriter, r *http.Request) {
+	h.serveErrorPage(w, r, http.StatusNotFound)
+}
+
+func (h *Handler) serveErrorPage(w http.ResponseWriter, r *http.Request, statusCode int) {
 	page, err := h.execute("error.html.tmpl", &ExecuteErrorParams{
-		StatusCode: http.StatusNotFound,
+		StatusCode: statusCode,
 	})
 	if err != nil {
 		h.serveError(w, r, err)
 		return
 	}
-	h.serveHTMLWithStatusCode(w, r, page, http.StatusNotFound)
+	h.serveHTMLWithStatusCode(w, r, page, statusCode)
 }
 
 func (h *Handler) serveHTML(w http.ResponseWriter, r *http.Request, data []byte) {
@@ -115,6 +303,15 @@ func (h *Handler) execute(name string, data any) ([]byte, error) {
 		"time": func(loc *time.Location, t *time.Time) string {
 			return t.In(loc).Format("2006-01-02 15:04")
 		},
+		"datetime": func(t time.Time) string {
+			return t.UTC().Format("2006-01-02 15:04 UTC")
+		},
+		"duration": func(d time.Duration) string {
+			return d.Round(time.Second).String()
+		},
+		"nilUUID": func(id uuid.UUID) bool {
+			return id == uuid.Nil
+		},
 		"uuid": func() string {
 			return uuid.New().String()
 		},
@@ -2,11 +2,55 @@ package app
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/rabbitmq/amqp091-go"
 )
 
-const AMQPQueueBuildCreated = "build.created"
+// AMQPQueueBuildCreated is the priority queue of builds to do.
+// It replaced the build.created queue, which was declared without priorities:
+// RabbitMQ refuses to redeclare a queue with other arguments, so a new name was needed.
+// Messages left in the build.created queue aren't consumed anymore,
+// builds of them can be sent again by finalizing or rerunning them.
+const AMQPQueueBuildCreated = "build.created.priority"
+
+// AMQPQueueBuildCreatedMaxPriority is the x-max-priority argument of the build created queue.
+// A queue with other arguments needs another name too.
+const AMQPQueueBuildCreatedMaxPriority = 9
+
+// NewAMQPQueueBuildCreatedDeclareParams returns the declaration of the build created priority queue
+// shared by its publishers and consumers.
+func NewAMQPQueueBuildCreatedDeclareParams() *AMQPQueueDeclareParams {
+	return &AMQPQueueDeclareParams{
+		Name: AMQPQueueBuildCreated,
+		Args: amqp091.Table{"x-max-priority": int32(AMQPQueueBuildCreatedMaxPriority)},
+	}
+}
+
+// AMQPQueueBuildCreatedDelayed holds build created messages that must wait before they are consumed again,
+// for example when the user running builds limit is reached.
+// Messages aren't consumed from it, they expire after AMQPQueueBuildCreatedDelay
+// and are dead-lettered back to the build created queue with their priorities.
+const AMQPQueueBuildCreatedDelayed = "build.created.delayed"
+
+const AMQPQueueBuildCreatedDelay = 5 * time.Second
+
+// NewAMQPQueueBuildCreatedDelayedDeclareParams returns the declaration of the delayed build created queue.
+func NewAMQPQueueBuildCreatedDelayedDeclareParams() *AMQPQueueDeclareParams {
+	return &AMQPQueueDeclareParams{
+		Name: AMQPQueueBuildCreatedDelayed,
+		Args: amqp091.Table{
+			"x-message-ttl":             int32(AMQPQueueBuildCreatedDelay.Milliseconds()),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": AMQPQueueBuildCreated,
+		},
+	}
+}
+
+// AMQPExchangeBuildEvents is the topic exchange of build lifecycle events.
+// Routing keys are event types like build.finished.
+const AMQPExchangeBuildEvents = "brick.build_events"
 
 type AMQPQueueDeclareParams struct {
 	Name       string
@@ -17,9 +61,20 @@ type AMQPQueueDeclareParams struct {
 	Args       amqp091.Table
 }
 
+type AMQPExchangeDeclareParams struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	NoWait     bool
+	Args       amqp091.Table
+}
+
 type AMQPClient struct {
-	connectionString   string
-	queueDeclareParams *AMQPQueueDeclareParams
+	connectionString      string
+	queueDeclareParams    *AMQPQueueDeclareParams    // nil for exchange clients
+	exchangeDeclareParams *AMQPExchangeDeclareParams // nil for queue clients
 }
 
 func NewAMQPClient(connectionString string, queueDeclareParams *AMQPQueueDeclareParams) *AMQPClient {
@@ -29,6 +84,15 @@ func NewAMQPClient(connectionString string, queueDeclareParams *AMQPQueueDeclare
 	}
 }
 
+// NewAMQPExchangeClient returns a client that declares an exchange instead of a queue.
+// Consumers declare and bind their own queues.
+func NewAMQPExchangeClient(connectionString string, exchangeDeclareParams *AMQPExchangeDeclareParams) *AMQPClient {
+	return &AMQPClient{
+		connectionString:      connectionString,
+		exchangeDeclareParams: exchangeDeclareParams,
+	}
+}
+
 // Publish proxies [amqp091.Channel.PublishWithContext].
 func (cli *AMQPClient) Publish(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp091.Publishing) error {
 	conn, err := amqp091.Dial(cli.connectionString)
@@ -45,7 +109,138 @@ func (cli *AMQPClient) Publish(ctx context.Context, exchange, key string, mandat
 	}
 	defer ch.Close()
 
-	_, err = ch.QueueDeclare(
+	if err = cli.declare(ch); err != nil {
+		return err
+	}
+
+	return ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// declare declares the queue or the exchange of the client.
+func (cli *AMQPClient) declare(ch *amqp091.Channel) error {
+	if cli.queueDeclareParams != nil {
+		_, err := ch.QueueDeclare(
+			cli.queueDeclareParams.Name,
+			cli.queueDeclareParams.Durable,
+			cli.queueDeclareParams.AutoDelete,
+			cli.queueDeclareParams.Exclusive,
+			cli.queueDeclareParams.NoWait,
+			cli.queueDeclareParams.Args,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if cli.exchangeDeclareParams != nil {
+		err := ch.ExchangeDeclare(
+			cli.exchangeDeclareParams.Name,
+			cli.exchangeDeclareParams.Kind,
+			cli.exchangeDeclareParams.Durable,
+			cli.exchangeDeclareParams.AutoDelete,
+			cli.exchangeDeclareParams.Internal,
+			cli.exchangeDeclareParams.NoWait,
+			cli.exchangeDeclareParams.Args,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AMQPConfirmPublisher publishes messages on one channel in confirm mode,
+// so a batch of messages shares a connection and each message is confirmed by the broker.
+// It isn't safe for concurrent use.
+type AMQPConfirmPublisher struct {
+	conn    *amqp091.Connection
+	ch      *amqp091.Channel
+	returns chan amqp091.Return
+}
+
+// amqpMaxReturns is the buffer of returned messages of AMQPConfirmPublisher.
+// Returns are received before confirmations, so they must be taken with Returned
+// before more messages than this are confirmed.
+const amqpMaxReturns = 1000
+
+// NewConfirmPublisher opens a connection, declares the queue or the exchange of the client
+// and puts a channel in confirm mode. The caller must close the publisher.
+func (cli *AMQPClient) NewConfirmPublisher() (*AMQPConfirmPublisher, error) {
+	conn, err := amqp091.Dial(cli.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	p := &AMQPConfirmPublisher{conn: conn}
+
+	p.ch, err = conn.Channel()
+	if err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	if err = cli.declare(p.ch); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	if err = p.ch.Confirm(false); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+	p.returns = p.ch.NotifyReturn(make(chan amqp091.Return, amqpMaxReturns))
+	return p, nil
+}
+
+// DeclareQueue declares a queue besides the queue or the exchange of the client.
+func (p *AMQPConfirmPublisher) DeclareQueue(params *AMQPQueueDeclareParams) error {
+	_, err := p.ch.QueueDeclare(params.Name, params.Durable, params.AutoDelete, params.Exclusive, params.NoWait, params.Args)
+	return err
+}
+
+// Publish publishes the message without waiting for its confirmation.
+// Mandatory messages that can't be routed to a queue are returned, see Returned.
+func (p *AMQPConfirmPublisher) Publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp091.Publishing) (*amqp091.DeferredConfirmation, error) {
+	return p.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, false, msg)
+}
+
+// Returned takes message IDs of messages returned since the last call.
+// Messages are returned before they are confirmed, so it should be called
+// after the confirmations of the messages are waited for.
+func (p *AMQPConfirmPublisher) Returned() map[string]struct{} {
+	returned := make(map[string]struct{})
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				return returned
+			}
+			returned[r.MessageId] = struct{}{}
+		default:
+			return returned
+		}
+	}
+}
+
+func (p *AMQPConfirmPublisher) Close() error {
+	return p.conn.Close()
+}
+
+// Consume declares the queue of the client and calls handle for each delivery.
+// Deliveries are prefetched one at a time, so handle can take long.
+// It returns an error when the delivery channel is closed or ctx is done.
+func (cli *AMQPClient) Consume(ctx context.Context, handle func(amqp091.Delivery)) error {
+	conn, err := amqp091.Dial(cli.connectionString)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclare(
 		cli.queueDeclareParams.Name,
 		cli.queueDeclareParams.Durable,
 		cli.queueDeclareParams.AutoDelete,
@@ -57,5 +252,20 @@ func (cli *AMQPClient) Publish(ctx context.Context, exchange, key string, mandat
 		return err
 	}
 
-	return ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err = ch.Qos(1, 0, false); err != nil {
+		return err
+	}
+
+	deliveries, err := ch.ConsumeWithContext(ctx, q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for d := range deliveries {
+		handle(d)
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return errors.New("delivery channel is closed")
 }
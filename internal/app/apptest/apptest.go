@@ -0,0 +1,68 @@
+// Package apptest starts services of the application in containers for integration tests.
+package apptest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/k11v/brick/internal/app"
+)
+
+// NewPostgresPool starts Postgres with SetupPostgres and returns a pool connected to it.
+// The test is skipped in short mode or if Docker isn't running.
+// Postgres is stopped when the test finishes.
+func NewPostgresPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	skipIntegration(t)
+	ctx := context.Background()
+
+	connectionString, teardown, err := SetupPostgres(ctx)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	t.Cleanup(func() {
+		_ = teardown()
+	})
+
+	db, err := app.NewPostgresPool(ctx, connectionString)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// NewRabbitMQ starts RabbitMQ with SetupRabbitMQ and returns its connection string.
+// It is skipped and stopped like NewPostgresPool.
+func NewRabbitMQ(t *testing.T) (connectionString string) {
+	t.Helper()
+	skipIntegration(t)
+	ctx := context.Background()
+
+	connectionString, teardown, err := SetupRabbitMQ(ctx)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	t.Cleanup(func() {
+		_ = teardown()
+	})
+	return connectionString
+}
+
+func skipIntegration(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Skipf("skipping without Docker: %v", err)
+	}
+	defer cli.Close()
+	if _, err = cli.Ping(context.Background()); err != nil {
+		t.Skipf("skipping without Docker: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package apptest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func SetupRabbitMQ(ctx context.Context) (connectionString string, teardown func() error, err error) {
+	password := "guest"
+	user := "guest"
+
+	req := testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image: "rabbitmq:4.0-alpine",
+			Env: map[string]string{
+				"RABBITMQ_DEFAULT_PASS": password,
+				"RABBITMQ_DEFAULT_USER": user,
+			},
+			ExposedPorts: []string{"5672/tcp"},
+			WaitingFor: wait.ForAll(
+				wait.ForLog("Server startup complete"),
+				wait.ForListeningPort("5672/tcp"),
+			).WithDeadline(60 * time.Second),
+		},
+		Started: true,
+	}
+	rabbitMQContainer, err := testcontainers.GenericContainer(ctx, req)
+	maybeTeardown := func() error {
+		return testcontainers.TerminateContainer(rabbitMQContainer)
+	}
+	defer func() {
+		if maybeTeardown != nil {
+			maybeTeardown()
+		}
+	}()
+	if err != nil {
+		return "", nil, err
+	}
+
+	host, err := rabbitMQContainer.Host(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	port, err := rabbitMQContainer.MappedPort(ctx, "5672/tcp")
+	if err != nil {
+		return "", nil, err
+	}
+	connectionString = fmt.Sprintf(
+		"amqp://%s:%s@%s/",
+		user,
+		password,
+		net.JoinHostPort(host, port.Port()),
+	)
+
+	teardown = maybeTeardown
+	maybeTeardown = nil
+	return connectionString, teardown, nil
+}
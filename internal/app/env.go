@@ -0,0 +1,20 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DurationEnv parses the env as a duration like "1s" or "720h" or returns def if the env is empty.
+func DurationEnv(env string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(env)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s env: %w", env, err)
+	}
+	return d, nil
+}
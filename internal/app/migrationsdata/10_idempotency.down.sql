@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS builds_user_id_idempotency_key_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS builds_idempotency_key_idx ON builds (idempotency_key);
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS request_fingerprint;
+
+COMMIT;
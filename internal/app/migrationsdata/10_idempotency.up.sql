@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS request_fingerprint text;
+
+DROP INDEX IF EXISTS builds_idempotency_key_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS builds_user_id_idempotency_key_idx ON builds (user_id, idempotency_key);
+
+COMMIT;
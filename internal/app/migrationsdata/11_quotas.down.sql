@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS cpu_seconds;
+
+DROP TABLE IF EXISTS user_quotas;
+DROP TABLE IF EXISTS quota_plans;
+
+COMMIT;
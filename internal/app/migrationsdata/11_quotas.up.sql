@@ -0,0 +1,34 @@
+BEGIN;
+
+-- NULL limits are unlimited.
+CREATE TABLE IF NOT EXISTS quota_plans (
+    name text NOT NULL,
+    window_duration interval NOT NULL,
+    builds int,
+    concurrent_builds int,
+    cpu_seconds bigint,
+    stored_bytes bigint,
+
+    PRIMARY KEY (name)
+);
+
+INSERT INTO quota_plans (name, window_duration, builds, concurrent_builds, cpu_seconds, stored_bytes)
+VALUES ('default', interval '24 hours', 10, 2, 3600, 1073741824)
+ON CONFLICT (name) DO NOTHING;
+
+-- NULL limits are taken from the plan.
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id uuid NOT NULL,
+    plan_name text NOT NULL DEFAULT 'default' REFERENCES quota_plans (name),
+    builds int,
+    concurrent_builds int,
+    cpu_seconds bigint,
+    stored_bytes bigint,
+
+    PRIMARY KEY (user_id)
+);
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS cpu_seconds double precision;
+
+COMMIT;
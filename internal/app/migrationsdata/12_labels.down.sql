@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS builds_labels_idx;
+DROP INDEX IF EXISTS builds_user_id_created_at_id_idx;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS labels;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS labels text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS builds_user_id_created_at_id_idx ON builds (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS builds_labels_idx ON builds USING gin (labels);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS parent_build_id;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS parent_build_id uuid REFERENCES builds (id);
+
+COMMIT;
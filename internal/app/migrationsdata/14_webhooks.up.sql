@@ -0,0 +1,42 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    user_id uuid NOT NULL,
+
+    build_id uuid, -- NULL if the webhook is for all builds of the user
+    url text NOT NULL,
+    secret text NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (build_id) REFERENCES builds (id)
+);
+CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    webhook_id uuid NOT NULL,
+
+    event text NOT NULL,
+    build_id uuid NOT NULL,
+    build_status text NOT NULL,
+    build_error text,
+    build_exit_code int,
+
+    state text NOT NULL,
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone,
+    last_attempt_at timestamp with time zone,
+    last_status_code int,
+    last_error text,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE,
+    FOREIGN KEY (build_id) REFERENCES builds (id)
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_created_at_idx ON webhook_deliveries (webhook_id, created_at);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at) WHERE state = 'pending';
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS outbox_messages (
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+
+    exchange text NOT NULL,
+    routing_key text NOT NULL,
+    body jsonb NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS outbox_messages_created_at_idx ON outbox_messages (created_at);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS stage,
+    DROP COLUMN IF EXISTS finished_at,
+    DROP COLUMN IF EXISTS started_at;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS started_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS finished_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS stage text;
+
+COMMIT;
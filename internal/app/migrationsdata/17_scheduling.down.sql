@@ -0,0 +1,12 @@
+BEGIN;
+
+ALTER TABLE user_quotas
+    DROP COLUMN IF EXISTS running_builds;
+
+ALTER TABLE quota_plans
+    DROP COLUMN IF EXISTS running_builds;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS priority;
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS priority text NOT NULL DEFAULT 'interactive';
+
+-- NULL limits are unlimited in plans and taken from the plan in user quotas.
+ALTER TABLE quota_plans
+    ADD COLUMN IF NOT EXISTS running_builds int;
+
+ALTER TABLE user_quotas
+    ADD COLUMN IF NOT EXISTS running_builds int;
+
+COMMIT;
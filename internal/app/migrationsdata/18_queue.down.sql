@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS builds_todo_created_at_idx;
+
+COMMIT;
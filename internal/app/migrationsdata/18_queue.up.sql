@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Builds to do are taken oldest first by the postgres queue.
+CREATE INDEX IF NOT EXISTS builds_todo_created_at_idx ON builds (created_at) WHERE status = 'todo';
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Blobs are linked only if a file of the same user references them.
+CREATE INDEX IF NOT EXISTS build_files_sha256_idx ON build_files (sha256) WHERE sha256 IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS header_includes_file,
+    DROP COLUMN IF EXISTS template_file,
+    DROP COLUMN IF EXISTS preset;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS preset text NOT NULL DEFAULT 'article',
+    ADD COLUMN IF NOT EXISTS template_file text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS header_includes_file text NOT NULL DEFAULT '';
+
+COMMIT;
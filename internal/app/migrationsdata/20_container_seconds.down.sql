@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE builds RENAME COLUMN container_seconds TO cpu_seconds;
+ALTER TABLE quota_plans RENAME COLUMN container_seconds TO cpu_seconds;
+ALTER TABLE user_quotas RENAME COLUMN container_seconds TO cpu_seconds;
+
+COMMIT;
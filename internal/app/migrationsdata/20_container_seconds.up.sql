@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Docker doesn't report CPU time of exited containers, builds record how long their container ran.
+ALTER TABLE builds RENAME COLUMN cpu_seconds TO container_seconds;
+ALTER TABLE quota_plans RENAME COLUMN cpu_seconds TO container_seconds;
+ALTER TABLE user_quotas RENAME COLUMN cpu_seconds TO container_seconds;
+
+COMMIT;
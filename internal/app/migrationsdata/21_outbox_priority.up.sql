@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Build created messages are sent through the outbox, they have priorities.
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS priority smallint NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE builds RENAME COLUMN wall_clock_seconds TO container_seconds;
+ALTER TABLE quota_plans RENAME COLUMN wall_clock_seconds TO container_seconds;
+ALTER TABLE user_quotas RENAME COLUMN wall_clock_seconds TO container_seconds;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Builds record the wall-clock time their container ran, not CPU time, the names say so.
+ALTER TABLE builds RENAME COLUMN container_seconds TO wall_clock_seconds;
+ALTER TABLE quota_plans RENAME COLUMN container_seconds TO wall_clock_seconds;
+ALTER TABLE user_quotas RENAME COLUMN container_seconds TO wall_clock_seconds;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS csl,
+    DROP COLUMN IF EXISTS bibliography_file;
+
+COMMIT;
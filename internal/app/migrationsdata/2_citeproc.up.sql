@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS bibliography_file text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS csl text NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS build_diagnostics (
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    build_id uuid NOT NULL,
+    position int NOT NULL,
+
+    severity text NOT NULL,
+    file text NOT NULL,
+    line int,
+    message text NOT NULL,
+    stage text NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (build_id) REFERENCES builds (id)
+);
+CREATE INDEX IF NOT EXISTS build_diagnostics_build_id_position_idx ON build_diagnostics (build_id, position);
+
+COMMIT;
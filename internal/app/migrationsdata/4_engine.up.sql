@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS engine text NOT NULL DEFAULT 'lualatex';
+
+COMMIT;
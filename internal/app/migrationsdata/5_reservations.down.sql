@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE build_files
+    DROP COLUMN IF EXISTS size;
+
+COMMIT;
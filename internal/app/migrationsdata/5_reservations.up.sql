@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE build_files
+    ADD COLUMN IF NOT EXISTS size bigint;
+
+COMMIT;
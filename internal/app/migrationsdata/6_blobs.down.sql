@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE build_files
+    DROP COLUMN IF EXISTS sha256;
+
+DROP TABLE IF EXISTS blobs;
+
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS blobs (
+    sha256 text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+
+    size bigint NOT NULL,
+    data_key text NOT NULL,
+    ref_count int NOT NULL,
+
+    PRIMARY KEY (sha256)
+);
+
+ALTER TABLE build_files
+    ADD COLUMN IF NOT EXISTS sha256 text;
+
+COMMIT;
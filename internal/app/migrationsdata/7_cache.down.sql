@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS builds_user_id_input_hash_idx;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS cached_from_id,
+    DROP COLUMN IF EXISTS input_hash;
+
+COMMIT;
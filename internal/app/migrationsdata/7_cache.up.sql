@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS input_hash text,
+    ADD COLUMN IF NOT EXISTS cached_from_id uuid REFERENCES builds (id);
+
+CREATE INDEX IF NOT EXISTS builds_user_id_input_hash_idx ON builds (user_id, input_hash) WHERE input_hash IS NOT NULL;
+
+COMMIT;
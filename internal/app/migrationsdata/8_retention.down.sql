@@ -0,0 +1,12 @@
+BEGIN;
+
+DROP TABLE IF EXISTS user_retention_policies;
+
+DROP INDEX IF EXISTS builds_created_at_idx;
+
+ALTER TABLE builds
+    DROP COLUMN IF EXISTS logs_expired_at,
+    DROP COLUMN IF EXISTS outputs_expired_at,
+    DROP COLUMN IF EXISTS inputs_expired_at;
+
+COMMIT;
@@ -0,0 +1,20 @@
+BEGIN;
+
+ALTER TABLE builds
+    ADD COLUMN IF NOT EXISTS inputs_expired_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS outputs_expired_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS logs_expired_at timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS builds_created_at_idx ON builds (created_at);
+
+CREATE TABLE IF NOT EXISTS user_retention_policies (
+    user_id uuid NOT NULL,
+
+    inputs_ttl interval,
+    outputs_ttl interval,
+    logs_ttl interval,
+
+    PRIMARY KEY (user_id)
+);
+
+COMMIT;
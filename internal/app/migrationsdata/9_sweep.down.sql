@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS build_files_build_id_idx;
+
+COMMIT;
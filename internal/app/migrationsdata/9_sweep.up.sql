@@ -0,0 +1,5 @@
+BEGIN;
+
+CREATE INDEX IF NOT EXISTS build_files_build_id_idx ON build_files (build_id);
+
+COMMIT;
@@ -27,7 +27,7 @@ func SetupPostgres(connectionString string) error {
 var postgresMigrations embed.FS
 
 func postgresMigrationsFS() fs.FS {
-	sub, err := fs.Sub(postgresMigrations, "migrations")
+	sub, err := fs.Sub(postgresMigrations, "migrationsdata")
 	if err != nil {
 		panic(err)
 	}
@@ -9,9 +9,16 @@ import (
 	transport "github.com/aws/smithy-go/endpoints"
 )
 
+// DefaultS3BucketName is the bucket used when the connection string doesn't set one.
+//
+// MinIO used by the application isn't expected to be shared,
+// so the bucket doesn't have to be set in development.
+const DefaultS3BucketName = "brick"
+
 // NewS3Client creates a new Client using the provided connection string.
-// The connection string must be a valid URL in the format: http://key:secret@s3:9000.
+// The connection string must be a valid URL in the format: http://key:secret@s3:9000?bucket=brick.
 // For MinIO, the key and secret are the username and password respectively.
+// The bucket query parameter is optional, see S3BucketName.
 // It panics if the connection string is not a valid URL.
 func NewS3Client(connectionString string) *s3.Client {
 	u, err := url.Parse(connectionString)
@@ -22,6 +29,7 @@ func NewS3Client(connectionString string) *s3.Client {
 	username := u.User.Username()
 	password, _ := u.User.Password()
 	u.User = nil
+	u.RawQuery = ""
 
 	client := s3.New(
 		s3.Options{
@@ -32,6 +40,21 @@ func NewS3Client(connectionString string) *s3.Client {
 	return client
 }
 
+// S3BucketName returns the bucket set by the bucket query parameter of the connection string,
+// or DefaultS3BucketName if it isn't set.
+// It panics if the connection string is not a valid URL.
+func S3BucketName(connectionString string) string {
+	u, err := url.Parse(connectionString)
+	if err != nil {
+		panic(err)
+	}
+
+	if bucket := u.Query().Get("bucket"); bucket != "" {
+		return bucket
+	}
+	return DefaultS3BucketName
+}
+
 // s3EndpointResolver implements s3.EndpointResolverV2.
 // It resolves endpoints for S3-compatible object storage like MinIO.
 type s3EndpointResolver struct {
@@ -10,22 +10,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-// S3BucketName is the name of the S3 bucket used by the application.
-//
-// It is a hard-coded string because the application uses MinIO
-// instead of Amazon S3, and MinIO isn't expected to be shared.
-//
-// It is a also variable instead of a constant because aws-sdk-go-v2 often
-// requires a pointer to a string which is easier to acqurie with a variable.
-var S3BucketName = "brick"
-
 // SetupS3 shouldn't be used with AWS as is because it doesn't specify the region.
-// See NewClient for connection string format and panic conditions.
+// It creates the bucket of the connection string, see S3BucketName.
+// See NewS3Client for connection string format and panic conditions.
 func SetupS3(ctx context.Context, connectionString string) error {
 	client := NewS3Client(connectionString)
+	bucket := S3BucketName(connectionString)
 
 	_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{
-		Bucket: &S3BucketName,
+		Bucket: &bucket,
 	})
 	if ownedErr := (*types.BucketAlreadyOwnedByYou)(nil); errors.As(err, &ownedErr) {
 		// continue
@@ -35,7 +28,7 @@ func SetupS3(ctx context.Context, connectionString string) error {
 
 	err = s3.NewBucketExistsWaiter(client).Wait(
 		ctx,
-		&s3.HeadBucketInput{Bucket: &S3BucketName},
+		&s3.HeadBucketInput{Bucket: &bucket},
 		time.Minute,
 	)
 	if err != nil {
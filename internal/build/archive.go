@@ -0,0 +1,388 @@
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/k11v/brick/internal/storage"
+)
+
+var (
+	ErrInvalidArchive  = errors.New("invalid archive")
+	ErrArchiveTooLarge = errors.New("archive too large")
+)
+
+// ArchiveLimits protect the server from archives that expand into too much data.
+type ArchiveLimits struct {
+	MaxEntries int   // max number of files and dirs
+	MaxSize    int64 // max total size of file data, also max size of the archive itself
+}
+
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxEntries: 1000,
+	MaxSize:    256 * 1024 * 1024, // 256MB
+}
+
+type ArchiveFormat string
+
+const (
+	ArchiveFormatTar   ArchiveFormat = "tar"
+	ArchiveFormatTarGz ArchiveFormat = "tar.gz"
+	ArchiveFormatZip   ArchiveFormat = "zip"
+)
+
+// ContentType returns the media type of archives in the format.
+func (f ArchiveFormat) ContentType() string {
+	switch f {
+	case ArchiveFormatTarGz:
+		return "application/gzip"
+	case ArchiveFormatZip:
+		return "application/zip"
+	default:
+		return "application/x-tar"
+	}
+}
+
+// archiveModTime is the modification time of archive entries.
+// It is fixed, so the same files always make the same archive.
+// It is the earliest time zip archives can store.
+var archiveModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveWriter adds entries to an archive.
+type archiveWriter interface {
+	WriteDir(name string) error
+	// WriteFile writes the file with data written by download.
+	// Size is the data size or -1 if it is unknown.
+	WriteFile(name string, size int64, download func(w io.Writer) error) error
+	Close() error
+}
+
+// writeArchive writes files as an archive in the format to w.
+// Data of regular files is streamed from stg.
+// Parent dirs are added before files even if files don't include them.
+func writeArchive(ctx context.Context, w io.Writer, stg storage.Storage, files []*File, format ArchiveFormat) error {
+	var aw archiveWriter
+	switch format {
+	case ArchiveFormatTar:
+		aw = newTarArchiveWriter(w, nil)
+	case ArchiveFormatTarGz:
+		gw := gzip.NewWriter(w)
+		aw = newTarArchiveWriter(gw, gw)
+	case ArchiveFormatZip:
+		aw = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+
+	dirExist := make(map[string]struct{})
+	writeDir := func(dir string) error {
+		if _, exist := dirExist[dir]; exist {
+			return nil
+		}
+		dirExist[dir] = struct{}{}
+		return aw.WriteDir(dir)
+	}
+
+	for _, f := range files {
+		var parentDirs []string
+		for dir := path.Dir(f.Name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			parentDirs = append(parentDirs, dir)
+		}
+		for i := len(parentDirs) - 1; i >= 0; i-- {
+			if err := writeDir(parentDirs[i]); err != nil {
+				return err
+			}
+		}
+
+		switch f.Type {
+		case FileTypeDirectory:
+			if err := writeDir(f.Name); err != nil {
+				return err
+			}
+		case FileTypeRegular:
+			if f.DataKey == "" {
+				return fmt.Errorf("%s: file data missing: %w", f.Name, storage.ErrNotExist)
+			}
+			err := aw.WriteFile(f.Name, f.Size, func(w io.Writer) error {
+				return stg.Download(ctx, w, f.DataKey)
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+	}
+
+	return aw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	c  io.Closer // optional, closed after tw
+}
+
+func newTarArchiveWriter(w io.Writer, c io.Closer) *tarArchiveWriter {
+	return &tarArchiveWriter{tw: tar.NewWriter(w), c: c}
+}
+
+func (a *tarArchiveWriter) WriteDir(name string) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0o777, // TODO: Check mode.
+		ModTime:  archiveModTime,
+	})
+}
+
+// WriteFile buffers data of files with unknown sizes because tar headers include sizes.
+func (a *tarArchiveWriter) WriteFile(name string, size int64, download func(w io.Writer) error) error {
+	var buf *bytes.Buffer
+	if size < 0 {
+		buf = new(bytes.Buffer)
+		if err := download(buf); err != nil {
+			return err
+		}
+		size = int64(buf.Len())
+	}
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o666, // TODO: Check mode.
+		Size:     size,
+		ModTime:  archiveModTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	if buf != nil {
+		_, err = a.tw.Write(buf.Bytes())
+		return err
+	}
+	return download(a.tw)
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.c != nil {
+		return a.c.Close()
+	}
+	return nil
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) WriteDir(name string) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name + "/",
+		Modified: archiveModTime,
+	})
+	return err
+}
+
+func (a *zipArchiveWriter) WriteFile(name string, _ int64, download func(w io.Writer) error) error {
+	w, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: archiveModTime,
+	})
+	if err != nil {
+		return err
+	}
+	return download(w)
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// ExtractArchive returns files from the archive in r for CreatorCreateParams.Files.
+// A data reader of a file is valid until the next file is requested.
+//
+// Entries with absolute paths or paths outside the archive root, links and special files
+// are reported as ErrInvalidArchive. Archives over the limits are reported as ErrArchiveTooLarge,
+// sizes are counted while data is read, so sizes in headers aren't trusted.
+// Zip archives are copied to a temporary file first because their index is at the end.
+func ExtractArchive(r io.Reader, format ArchiveFormat, limits *ArchiveLimits) iter.Seq2[*CreatorCreateFileParams, error] {
+	return func(yield func(*CreatorCreateFileParams, error) bool) {
+		var err error
+		switch format {
+		case ArchiveFormatTar:
+			err = extractTar(r, limits, yield)
+		case ArchiveFormatTarGz:
+			var gr *gzip.Reader
+			gr, err = gzip.NewReader(r)
+			if err != nil {
+				err = errors.Join(ErrInvalidArchive, err)
+				break
+			}
+			err = extractTar(gr, limits, yield)
+		case ArchiveFormatZip:
+			err = extractZip(r, limits, yield)
+		default:
+			err = fmt.Errorf("unknown archive format %q", format)
+		}
+		if err != nil && !errors.Is(err, errStopped) {
+			yield(nil, err)
+		}
+	}
+}
+
+// errStopped is returned by extract functions when yield returns false.
+var errStopped = errors.New("stopped")
+
+func extractTar(r io.Reader, limits *ArchiveLimits, yield func(*CreatorCreateFileParams, error) bool) error {
+	remaining := &sizeBudget{n: limits.MaxSize}
+	tr := tar.NewReader(r)
+	for entries := 0; ; entries++ {
+		h, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errors.Join(ErrInvalidArchive, err)
+		}
+		if entries >= limits.MaxEntries {
+			return fmt.Errorf("%w: more than %d entries", ErrArchiveTooLarge, limits.MaxEntries)
+		}
+
+		var typ FileType
+		switch h.Typeflag {
+		case tar.TypeDir:
+			typ = FileTypeDirectory
+		case tar.TypeReg:
+			typ = FileTypeRegular
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return fmt.Errorf("%w: %s: unsupported entry type", ErrInvalidArchive, h.Name)
+		}
+		name, err := archiveEntryName(h.Name)
+		if err != nil {
+			return err
+		}
+
+		file := &CreatorCreateFileParams{Name: name, Type: typ}
+		if typ == FileTypeRegular {
+			file.DataReader = &budgetReader{r: tr, budget: remaining}
+		}
+		if !yield(file, nil) {
+			return errStopped
+		}
+	}
+}
+
+func extractZip(r io.Reader, limits *ArchiveLimits, yield func(*CreatorCreateFileParams, error) bool) error {
+	tmp, err := os.CreateTemp("", "brick-archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	size, err := io.Copy(tmp, io.LimitReader(r, limits.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if size > limits.MaxSize {
+		return fmt.Errorf("%w: more than %d bytes", ErrArchiveTooLarge, limits.MaxSize)
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return errors.Join(ErrInvalidArchive, err)
+	}
+	if len(zr.File) > limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrArchiveTooLarge, limits.MaxEntries)
+	}
+
+	remaining := &sizeBudget{n: limits.MaxSize}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		var typ FileType
+		switch {
+		case mode.IsDir():
+			typ = FileTypeDirectory
+		case mode.IsRegular():
+			typ = FileTypeRegular
+		default:
+			return fmt.Errorf("%w: %s: unsupported entry type", ErrInvalidArchive, f.Name)
+		}
+		name, err := archiveEntryName(f.Name)
+		if err != nil {
+			return err
+		}
+
+		file := &CreatorCreateFileParams{Name: name, Type: typ}
+		var rc io.ReadCloser
+		if typ == FileTypeRegular {
+			rc, err = f.Open()
+			if err != nil {
+				return errors.Join(ErrInvalidArchive, err)
+			}
+			file.DataReader = &budgetReader{r: rc, budget: remaining}
+		}
+		ok := yield(file, nil)
+		if rc != nil {
+			_ = rc.Close()
+		}
+		if !ok {
+			return errStopped
+		}
+	}
+	return nil
+}
+
+// archiveEntryName returns the cleaned entry name
+// or an error if the entry would be extracted outside the archive root.
+func archiveEntryName(name string) (string, error) {
+	cleanName := strings.TrimSuffix(name, "/")
+	if err := validateFileName(cleanName); err != nil {
+		return "", errors.Join(ErrInvalidArchive, err)
+	}
+	return cleanName, nil
+}
+
+// sizeBudget is the number of bytes left for data read through budgetReaders sharing it.
+type sizeBudget struct {
+	n int64
+}
+
+// budgetReader reads from r until the budget is spent, then it returns err.
+// Err defaults to ErrArchiveTooLarge.
+type budgetReader struct {
+	r      io.Reader
+	budget *sizeBudget
+	err    error
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > br.budget.n+1 {
+		p = p[:br.budget.n+1]
+	}
+	n, err := br.r.Read(p)
+	br.budget.n -= int64(n)
+	if br.budget.n < 0 {
+		if br.err == nil {
+			return n, ErrArchiveTooLarge
+		}
+		return n, br.err
+	}
+	return n, err
+}
@@ -0,0 +1,232 @@
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/k11v/brick/internal/storage"
+)
+
+func TestWriteArchive(t *testing.T) {
+	ctx := context.Background()
+
+	stg := storage.NewFS(t.TempDir())
+	for key, data := range map[string]string{
+		"input/1": "# Hello",
+		"input/2": "png",
+	} {
+		if err := stg.Upload(ctx, key, strings.NewReader(data)); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+	}
+	files := []*File{
+		{Name: "main.md", Type: FileTypeRegular, DataKey: "input/1", Size: 7},
+		{Name: "images", Type: FileTypeDirectory},
+		{Name: "images/deep/a.png", Type: FileTypeRegular, DataKey: "input/2", Size: -1},
+	}
+	wantNames := []string{"main.md", "images/", "images/deep/", "images/deep/a.png"}
+	wantData := map[string]string{"main.md": "# Hello", "images/deep/a.png": "png"}
+
+	t.Run("tar.gz", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeArchive(ctx, &buf, stg, files, ArchiveFormatTarGz); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		gr, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		tr := tar.NewReader(gr)
+		var names []string
+		for {
+			h, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			names = append(names, h.Name)
+			if h.Typeflag == tar.TypeReg {
+				data, _ := io.ReadAll(tr)
+				if string(data) != wantData[h.Name] {
+					t.Errorf("got %q data of %s, want %q", data, h.Name, wantData[h.Name])
+				}
+			}
+		}
+		if !slices.Equal(names, wantNames) {
+			t.Errorf("got %q names, want %q", names, wantNames)
+		}
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeArchive(ctx, &buf, stg, files, ArchiveFormatZip); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+			if !f.FileInfo().IsDir() {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatalf("got %q err", err)
+				}
+				data, _ := io.ReadAll(rc)
+				_ = rc.Close()
+				if string(data) != wantData[f.Name] {
+					t.Errorf("got %q data of %s, want %q", data, f.Name, wantData[f.Name])
+				}
+			}
+		}
+		if !slices.Equal(names, wantNames) {
+			t.Errorf("got %q names, want %q", names, wantNames)
+		}
+	})
+}
+
+func TestExtractArchive(t *testing.T) {
+	limits := &ArchiveLimits{MaxEntries: 3, MaxSize: 1024}
+
+	tarGz := func(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+		t.Helper()
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, h := range headers {
+			if err := tw.WriteHeader(h); err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			if h.Typeflag == tar.TypeReg {
+				if _, err := tw.Write(bytes.Repeat([]byte("a"), int(h.Size))); err != nil {
+					t.Fatalf("got %q err", err)
+				}
+			}
+		}
+		_ = tw.Close()
+		_ = gw.Close()
+		return &buf
+	}
+
+	// extract reads all files and returns their names and the first error.
+	extract := func(r io.Reader, format ArchiveFormat) ([]string, error) {
+		var names []string
+		for file, err := range ExtractArchive(r, format, limits) {
+			if err != nil {
+				return names, err
+			}
+			if file.DataReader != nil {
+				if _, err = io.Copy(io.Discard, file.DataReader); err != nil {
+					return names, err
+				}
+			}
+			names = append(names, file.Name)
+		}
+		return names, nil
+	}
+
+	t.Run("extracts tar.gz", func(t *testing.T) {
+		r := tarGz(t,
+			&tar.Header{Typeflag: tar.TypeDir, Name: "images/"},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "main.md", Size: 10},
+		)
+		names, err := extract(r, ArchiveFormatTarGz)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if want := []string{"images", "main.md"}; !slices.Equal(names, want) {
+			t.Errorf("got %q names, want %q", names, want)
+		}
+	})
+
+	t.Run("extracts zip", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create("main.md")
+		_, _ = w.Write([]byte("# Hello"))
+		_ = zw.Close()
+
+		names, err := extract(&buf, ArchiveFormatZip)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if want := []string{"main.md"}; !slices.Equal(names, want) {
+			t.Errorf("got %q names, want %q", names, want)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		want    error
+	}{
+		{"rejects parent paths", []*tar.Header{{Typeflag: tar.TypeReg, Name: "../main.md"}}, ErrInvalidArchive},
+		{"rejects absolute paths", []*tar.Header{{Typeflag: tar.TypeReg, Name: "/main.md"}}, ErrInvalidArchive},
+		{"rejects symlinks", []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "main.md", Linkname: "/etc/passwd"}}, ErrInvalidArchive},
+		{"rejects too many entries", []*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "a/"},
+			{Typeflag: tar.TypeDir, Name: "b/"},
+			{Typeflag: tar.TypeDir, Name: "c/"},
+			{Typeflag: tar.TypeDir, Name: "d/"},
+		}, ErrArchiveTooLarge},
+		{"rejects too much data", []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "a.png", Size: 1000},
+			{Typeflag: tar.TypeReg, Name: "b.png", Size: 1000},
+		}, ErrArchiveTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extract(tarGz(t, tt.headers...), ArchiveFormatTarGz)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v err, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteArchiveReproducible(t *testing.T) {
+	ctx := context.Background()
+
+	stg := storage.NewFS(t.TempDir())
+	if err := stg.Upload(ctx, "input/1", strings.NewReader("# Hello")); err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	files := []*File{
+		{Name: "dir/main.md", Type: FileTypeRegular, DataKey: "input/1", Size: 7},
+	}
+
+	for _, format := range []ArchiveFormat{ArchiveFormatTarGz, ArchiveFormatZip} {
+		var a, b bytes.Buffer
+		if err := writeArchive(ctx, &a, stg, files, format); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if err := writeArchive(ctx, &b, stg, files, format); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			t.Errorf("got different %s archives of the same files", format)
+		}
+	}
+}
+
+func TestWriteArchiveMissingData(t *testing.T) {
+	files := []*File{{Name: "main.md", Type: FileTypeRegular, Size: 7}}
+	err := writeArchive(context.Background(), io.Discard, storage.NewFS(t.TempDir()), files, ArchiveFormatZip)
+	if !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("got %v err, want %q", err, storage.ErrNotExist)
+	}
+}
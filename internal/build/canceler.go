@@ -18,15 +18,16 @@ var (
 type Status string
 
 const (
-	StatusTodo  Status = "todo"
-	StatusDoing Status = "doing"
-	StatusDone  Status = "done"
+	StatusReserved Status = "reserved" // waiting for files uploaded to presigned URLs
+	StatusTodo     Status = "todo"
+	StatusDoing    Status = "doing"
+	StatusDone     Status = "done"
 )
 
 func ParseStatus(s string) (status Status, known bool) {
 	status = Status(s)
 	switch status {
-	case StatusTodo, StatusDoing, StatusDone:
+	case StatusReserved, StatusTodo, StatusDoing, StatusDone:
 		return status, true
 	default:
 		return status, false
@@ -74,6 +75,10 @@ func (c *Canceler) Cancel(ctx context.Context, params *CancelerCancelParams) (*B
 	if err != nil {
 		return nil, fmt.Errorf("build.Canceler: %w", err)
 	}
+	err = createBuildEvent(ctx, tx, BuildEventCanceled, b)
+	if err != nil {
+		return nil, fmt.Errorf("build.Canceler: %w", err)
+	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
@@ -85,7 +90,9 @@ func (c *Canceler) Cancel(ctx context.Context, params *CancelerCancelParams) (*B
 
 func getForUpdate(ctx context.Context, db executor, id uuid.UUID) (*Build, error) {
 	query := `
-		SELECT id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key
+		SELECT id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		       preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		       inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
 		FROM builds
 		WHERE id = $1
 		FOR UPDATE
@@ -104,7 +111,17 @@ func getForUpdate(ctx context.Context, db executor, id uuid.UUID) (*Build, error
 	return b, nil
 }
 
+// updateStatus updates the build status and creates webhook deliveries of the change.
+// It also sets the start time when the status changes to doing and the finish time when it changes to done.
 func updateStatus(ctx context.Context, db executor, id uuid.UUID, status Status, errorValue Error) (*Build, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
 	var errorArg *string
 	if errorValue != "" {
 		errorArg = new(string)
@@ -113,17 +130,29 @@ func updateStatus(ctx context.Context, db executor, id uuid.UUID, status Status,
 
 	query := `
 		UPDATE builds
-		SET status = $2, error = $3
+		SET status = $2, error = $3,
+		    started_at = CASE WHEN $2 = $4 THEN now() ELSE started_at END,
+		    finished_at = CASE WHEN $2 = $5 THEN now() ELSE finished_at END
 		WHERE id = $1
-		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key
+		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		          preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		          inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
 	`
-	args := []any{id, string(status), errorArg}
+	args := []any{id, string(status), errorArg, string(StatusDoing), string(StatusDone)}
 
-	rows, _ := db.Query(ctx, query, args...)
+	rows, _ := tx.Query(ctx, query, args...)
 	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = createWebhookDeliveries(ctx, tx, b); err != nil {
+		return nil, fmt.Errorf("createWebhookDeliveries: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
 	return b, nil
 }
@@ -0,0 +1,550 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/k11v/brick/internal/storage"
+)
+
+// Default TTLs are counted from the build creation time.
+const (
+	DefaultInputsTTL  = 7 * 24 * time.Hour
+	DefaultOutputsTTL = 30 * 24 * time.Hour
+	DefaultLogsTTL    = 30 * 24 * time.Hour
+)
+
+// DefaultOrphanGrace is how long Collector.Sweep keeps unreferenced input data.
+// It must be longer than Creator.Create takes to commit a build after uploading its data.
+const DefaultOrphanGrace = 24 * time.Hour
+
+// collectBatchSize is the number of builds expired in one transaction.
+const collectBatchSize = 100
+
+// sweepBatchSize is the number of listed objects Collector.Sweep checks with one query.
+const sweepBatchSize = 1000
+
+// Collector deletes expired build data.
+// Inputs, outputs and logs expire separately, their TTLs can be overridden per user.
+type Collector struct {
+	DB  *pgxpool.Pool
+	STG storage.Storage
+
+	InputsTTL  time.Duration
+	OutputsTTL time.Duration
+	LogsTTL    time.Duration
+
+	OrphanGrace time.Duration
+}
+
+// CollectorParams are default TTLs and the orphan grace period.
+// Zero durations are replaced with the package defaults.
+type CollectorParams struct {
+	InputsTTL  time.Duration
+	OutputsTTL time.Duration
+	LogsTTL    time.Duration
+
+	OrphanGrace time.Duration
+}
+
+func NewCollector(db *pgxpool.Pool, stg storage.Storage, params *CollectorParams) *Collector {
+	c := &Collector{
+		DB:         db,
+		STG:        stg,
+		InputsTTL:  params.InputsTTL,
+		OutputsTTL: params.OutputsTTL,
+		LogsTTL:    params.LogsTTL,
+
+		OrphanGrace: params.OrphanGrace,
+	}
+	if c.InputsTTL == 0 {
+		c.InputsTTL = DefaultInputsTTL
+	}
+	if c.OutputsTTL == 0 {
+		c.OutputsTTL = DefaultOutputsTTL
+	}
+	if c.LogsTTL == 0 {
+		c.LogsTTL = DefaultLogsTTL
+	}
+	if c.OrphanGrace == 0 {
+		c.OrphanGrace = DefaultOrphanGrace
+	}
+	return c
+}
+
+type CollectorCollectResult struct {
+	Inputs  int // number of builds with expired inputs
+	Outputs int // number of builds with expired outputs
+	Logs    int // number of builds with expired logs
+}
+
+// Collect deletes data of builds older than their TTLs and marks it expired.
+// Objects are deleted before builds are marked, so failed calls are retried by the next call.
+//
+// Only done and reserved builds are collected, so builds handled by Doer aren't affected.
+// Builds are locked while they are collected and locked builds are skipped,
+// so Collect can run concurrently with itself, Creator and Canceler.
+// Output and log objects shared by builds are locked too, see lockDataKeys.
+// Getter reports data deleted after it read the build as expired.
+func (c *Collector) Collect(ctx context.Context) (*CollectorCollectResult, error) {
+	now := time.Now()
+	result := &CollectorCollectResult{}
+
+	for {
+		n, err := c.collectInputs(ctx, now)
+		if err != nil {
+			return nil, fmt.Errorf("build.Collector: inputs: %w", err)
+		}
+		result.Inputs += n
+		if n < collectBatchSize {
+			break
+		}
+	}
+
+	for _, k := range []*dataKind{outputsKind, logsKind} {
+		for {
+			n, err := c.collectData(ctx, k, now)
+			if err != nil {
+				return nil, fmt.Errorf("build.Collector: %s: %w", k.name, err)
+			}
+			if k == outputsKind {
+				result.Outputs += n
+			} else {
+				result.Logs += n
+			}
+			if n < collectBatchSize {
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// collectInputs expires inputs of one batch of builds and returns the batch size.
+// Files linked to blobs release them, blobs without references are deleted.
+func (c *Collector) collectInputs(ctx context.Context, now time.Time) (int, error) {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	builds, err := getInputsExpiredForUpdate(ctx, tx, now, c.InputsTTL)
+	if err != nil {
+		return 0, fmt.Errorf("getInputsExpiredForUpdate: %w", err)
+	}
+
+	var blobDataKeys []string // deleted after commit because other builds can still link them until then
+	for _, b := range builds {
+		files, err := getFiles(ctx, tx, b.ID)
+		if err != nil {
+			return 0, fmt.Errorf("getFiles: %w", err)
+		}
+		for _, f := range files {
+			if f.Type != FileTypeRegular || f.DataKey == "" {
+				continue
+			}
+			blobDataKey := ""
+			if f.SHA256 != "" {
+				blobDataKey, err = getBlobDataKey(ctx, tx, f.SHA256)
+				if err != nil {
+					return 0, fmt.Errorf("getBlobDataKey: %w", err)
+				}
+			}
+			if blobDataKey != f.DataKey {
+				// The file data was never stored as a blob, e.g. an upload of an unfinalized build.
+				if err = c.STG.Delete(ctx, f.DataKey); err != nil {
+					return 0, fmt.Errorf("Delete: %w", err)
+				}
+				continue
+			}
+			deleted, err := releaseBlob(ctx, tx, f.SHA256)
+			if err != nil {
+				return 0, fmt.Errorf("releaseBlob: %w", err)
+			}
+			if deleted {
+				blobDataKeys = append(blobDataKeys, blobDataKey)
+			}
+		}
+
+		if b.Status == StatusReserved {
+			// The reservation is canceled like by Canceler, so consumers of events see it end.
+			canceled, err := updateStatus(ctx, tx, b.ID, StatusDone, ErrorExpired)
+			if err != nil {
+				return 0, fmt.Errorf("updateStatus: %w", err)
+			}
+			if err = createBuildEvent(ctx, tx, BuildEventCanceled, canceled); err != nil {
+				return 0, fmt.Errorf("createBuildEvent: %w", err)
+			}
+		}
+		if err = markExpired(ctx, tx, inputsKind, b.ID, now); err != nil {
+			return 0, fmt.Errorf("markExpired: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range blobDataKeys {
+		if err = c.STG.Delete(ctx, key); err != nil {
+			slog.Warn("didn't delete blob", "key", key, "err", err)
+		}
+	}
+
+	return len(builds), nil
+}
+
+// collectData expires outputs or logs of one batch of builds and returns the batch size.
+// Objects shared by cached builds are deleted when the last build referencing them expires.
+func (c *Collector) collectData(ctx context.Context, k *dataKind, now time.Time) (int, error) {
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	ttl := c.OutputsTTL
+	if k == logsKind {
+		ttl = c.LogsTTL
+	}
+	builds, err := getDataExpiredForUpdate(ctx, tx, k, now, ttl)
+	if err != nil {
+		return 0, fmt.Errorf("getDataExpiredForUpdate: %w", err)
+	}
+
+	keys := make([]string, len(builds))
+	for i, b := range builds {
+		keys[i] = b.OutputDataKey
+		if k == logsKind {
+			keys[i] = b.LogDataKey
+		}
+	}
+	if err = lockDataKeys(ctx, tx, keys); err != nil {
+		return 0, fmt.Errorf("lockDataKeys: %w", err)
+	}
+
+	for i, b := range builds {
+		key := keys[i]
+		if key != "" {
+			referenced, err := isDataReferenced(ctx, tx, k, key, b.ID)
+			if err != nil {
+				return 0, fmt.Errorf("isDataReferenced: %w", err)
+			}
+			if !referenced {
+				if err = c.STG.Delete(ctx, key); err != nil {
+					return 0, fmt.Errorf("Delete: %w", err)
+				}
+			}
+		}
+		if err = markExpired(ctx, tx, k, b.ID, now); err != nil {
+			return 0, fmt.Errorf("markExpired: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(builds), nil
+}
+
+type CollectorSetPolicyParams struct {
+	UserID uuid.UUID
+
+	// Zero TTLs mean that the Collector TTLs are used.
+	InputsTTL  time.Duration
+	OutputsTTL time.Duration
+	LogsTTL    time.Duration
+}
+
+// SetPolicy overrides TTLs for the user.
+func (c *Collector) SetPolicy(ctx context.Context, params *CollectorSetPolicyParams) error {
+	ttlArg := func(ttl time.Duration) *float64 {
+		if ttl == 0 {
+			return nil
+		}
+		seconds := ttl.Seconds()
+		return &seconds
+	}
+
+	query := `
+		INSERT INTO user_retention_policies (user_id, inputs_ttl, outputs_ttl, logs_ttl)
+		VALUES ($1, $2 * interval '1 second', $3 * interval '1 second', $4 * interval '1 second')
+		ON CONFLICT (user_id) DO UPDATE
+		SET inputs_ttl = excluded.inputs_ttl, outputs_ttl = excluded.outputs_ttl, logs_ttl = excluded.logs_ttl
+	`
+	args := []any{params.UserID, ttlArg(params.InputsTTL), ttlArg(params.OutputsTTL), ttlArg(params.LogsTTL)}
+
+	_, err := c.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("build.Collector: %w", err)
+	}
+	return nil
+}
+
+// dataKind names columns of one kind of build data.
+// Names are constants, so they are safe to format into queries.
+type dataKind struct {
+	name            string
+	keyColumn       string // empty for inputs, their keys are in build_files
+	expiredAtColumn string
+	ttlColumn       string
+}
+
+var (
+	inputsKind  = &dataKind{name: "inputs", expiredAtColumn: "inputs_expired_at", ttlColumn: "inputs_ttl"}
+	outputsKind = &dataKind{name: "outputs", keyColumn: "output_data_key", expiredAtColumn: "outputs_expired_at", ttlColumn: "outputs_ttl"}
+	logsKind    = &dataKind{name: "logs", keyColumn: "log_data_key", expiredAtColumn: "logs_expired_at", ttlColumn: "logs_ttl"}
+)
+
+func getInputsExpiredForUpdate(ctx context.Context, db executor, now time.Time, defaultTTL time.Duration) ([]*Build, error) {
+	query := `
+		SELECT b.id, b.created_at, b.idempotency_key, b.user_id, b.status, b.error, b.exit_code, b.log_data_key, b.output_data_key,
+		       b.preset, b.template_file, b.header_includes_file, b.bibliography_file, b.csl, b.engine, b.input_hash, b.cached_from_id,
+		       b.inputs_expired_at, b.outputs_expired_at, b.logs_expired_at, b.labels, b.wall_clock_seconds, b.parent_build_id, b.started_at, b.finished_at, b.stage, b.priority
+		FROM builds b
+		LEFT JOIN user_retention_policies p ON p.user_id = b.user_id
+		WHERE b.status IN ($1, $2) AND b.inputs_expired_at IS NULL
+		  AND b.created_at < $3 - coalesce(p.inputs_ttl, $4 * interval '1 second')
+		ORDER BY b.created_at
+		LIMIT $5
+		FOR UPDATE OF b SKIP LOCKED
+	`
+	args := []any{string(StatusDone), string(StatusReserved), now, defaultTTL.Seconds(), collectBatchSize}
+
+	rows, _ := db.Query(ctx, query, args...)
+	builds, err := pgx.CollectRows(rows, rowToBuild)
+	if err != nil {
+		return nil, err
+	}
+
+	return builds, nil
+}
+
+func getDataExpiredForUpdate(ctx context.Context, db executor, k *dataKind, now time.Time, defaultTTL time.Duration) ([]*Build, error) {
+	query := fmt.Sprintf(`
+		SELECT b.id, b.created_at, b.idempotency_key, b.user_id, b.status, b.error, b.exit_code, b.log_data_key, b.output_data_key,
+		       b.preset, b.template_file, b.header_includes_file, b.bibliography_file, b.csl, b.engine, b.input_hash, b.cached_from_id,
+		       b.inputs_expired_at, b.outputs_expired_at, b.logs_expired_at, b.labels, b.wall_clock_seconds, b.parent_build_id, b.started_at, b.finished_at, b.stage, b.priority
+		FROM builds b
+		LEFT JOIN user_retention_policies p ON p.user_id = b.user_id
+		WHERE b.status = $1 AND b.%[1]s IS NULL
+		  AND b.created_at < $2 - coalesce(p.%[2]s, $3 * interval '1 second')
+		ORDER BY b.created_at
+		LIMIT $4
+		FOR UPDATE OF b SKIP LOCKED
+	`, k.expiredAtColumn, k.ttlColumn)
+	args := []any{string(StatusDone), now, defaultTTL.Seconds(), collectBatchSize}
+
+	rows, _ := db.Query(ctx, query, args...)
+	builds, err := pgx.CollectRows(rows, rowToBuild)
+	if err != nil {
+		return nil, err
+	}
+
+	return builds, nil
+}
+
+// Sweep deletes input data that no build file references and returns the number of deleted objects.
+// Such data is left when Creator fails to commit a build or to delete duplicate uploads.
+// Data modified within OrphanGrace is kept because its build may not be committed yet.
+// Listed keys are checked in batches of sweepBatchSize.
+func (c *Collector) Sweep(ctx context.Context) (int, error) {
+	modifiedBefore := time.Now().Add(-c.OrphanGrace)
+	deleted := 0
+	var buildIDs []uuid.UUID
+	var keys []string
+	deleteBatch := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		unreferenced, err := getUnreferencedInputDataKeys(ctx, c.DB, buildIDs, keys)
+		if err != nil {
+			return fmt.Errorf("getUnreferencedInputDataKeys: %w", err)
+		}
+		buildIDs, keys = buildIDs[:0], keys[:0]
+		for _, key := range unreferenced {
+			if err = c.STG.Delete(ctx, key); err != nil {
+				return fmt.Errorf("Delete: %w", err)
+			}
+			slog.Info("deleted orphaned input data", "key", key)
+			deleted++
+		}
+		return nil
+	}
+
+	for info, err := range c.STG.List(ctx, "builds/") {
+		if err != nil {
+			return deleted, fmt.Errorf("build.Collector: List: %w", err)
+		}
+		buildID, ok := parseInputDataKey(info.Key)
+		if !ok || !info.ModifiedAt.Before(modifiedBefore) {
+			continue
+		}
+		buildIDs = append(buildIDs, buildID)
+		keys = append(keys, info.Key)
+		if len(keys) < sweepBatchSize {
+			continue
+		}
+		if err = deleteBatch(); err != nil {
+			return deleted, fmt.Errorf("build.Collector: %w", err)
+		}
+	}
+	if err := deleteBatch(); err != nil {
+		return deleted, fmt.Errorf("build.Collector: %w", err)
+	}
+	return deleted, nil
+}
+
+// parseInputDataKey returns the build ID of a key like "builds/{id}/input/{file id}".
+func parseInputDataKey(key string) (buildID uuid.UUID, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 || parts[0] != "builds" || parts[2] != "input" {
+		return uuid.Nil, false
+	}
+	buildID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return buildID, true
+}
+
+// getUnreferencedInputDataKeys returns the keys that no file of the build with the same index references.
+// Files linked to blobs stored from other builds reference objects of those builds,
+// but the files the blobs were stored from still reference them too.
+func getUnreferencedInputDataKeys(ctx context.Context, db executor, buildIDs []uuid.UUID, keys []string) ([]string, error) {
+	query := `
+		SELECT k.data_key
+		FROM unnest($1::uuid[], $2::text[]) AS k (build_id, data_key)
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM build_files f
+			WHERE f.build_id = k.build_id AND f.data_key = k.data_key
+		)
+	`
+	args := []any{buildIDs, keys}
+
+	rows, _ := db.Query(ctx, query, args...)
+	unreferenced, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	return unreferenced, nil
+}
+
+// isDataReferenced reports whether other builds with unexpired data reference the object.
+// Builds completed from cache share objects with the cached build.
+func isDataReferenced(ctx context.Context, db executor, k *dataKind, key string, excludeID uuid.UUID) (bool, error) {
+	query := fmt.Sprintf(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM builds
+			WHERE %[1]s = $1 AND id != $2 AND %[2]s IS NULL
+		)
+	`, k.keyColumn, k.expiredAtColumn)
+	args := []any{key, excludeID}
+
+	rows, _ := db.Query(ctx, query, args...)
+	referenced, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[bool])
+	if err != nil {
+		return false, err
+	}
+
+	return referenced, nil
+}
+
+// lockDataKeys locks the objects until the transaction ends.
+// Collectors expiring different builds that share an object wait for each other,
+// so the last one sees the other builds expired and deletes the object.
+// Keys are locked in the order of their lock IDs, so collectors don't deadlock.
+func lockDataKeys(ctx context.Context, db executor, keys []string) error {
+	query := `SELECT pg_advisory_xact_lock($1)`
+	for _, id := range dataKeyLockIDs(keys) {
+		if _, err := db.Exec(ctx, query, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataKeyLockIDs returns sorted unique advisory lock IDs of the keys.
+// Empty keys aren't locked.
+func dataKeyLockIDs(keys []string) []int64 {
+	ids := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		ids = append(ids, int64(h.Sum64()))
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+func markExpired(ctx context.Context, db executor, k *dataKind, id uuid.UUID, now time.Time) error {
+	query := fmt.Sprintf(`
+		UPDATE builds
+		SET %s = $2
+		WHERE id = $1
+	`, k.expiredAtColumn)
+	args := []any{id, now}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
+
+// releaseBlob decrements the reference count of the blob
+// and deletes the blob if it isn't referenced anymore.
+func releaseBlob(ctx context.Context, db executor, sha256Hex string) (deleted bool, err error) {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count - 1
+		WHERE sha256 = $1
+		RETURNING ref_count
+	`
+	args := []any{sha256Hex}
+
+	rows, _ := db.Query(ctx, query, args...)
+	refCount, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[int])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if refCount > 0 {
+		return false, nil
+	}
+
+	query = `
+		DELETE FROM blobs
+		WHERE sha256 = $1
+	`
+	_, err = db.Exec(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,61 @@
+package build
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNewCollector(t *testing.T) {
+	c := NewCollector(nil, nil, &CollectorParams{OutputsTTL: time.Hour})
+	if got, want := c.InputsTTL, DefaultInputsTTL; got != want {
+		t.Errorf("got %s InputsTTL, want %s", got, want)
+	}
+	if got, want := c.OutputsTTL, time.Hour; got != want {
+		t.Errorf("got %s OutputsTTL, want %s", got, want)
+	}
+	if got, want := c.OrphanGrace, DefaultOrphanGrace; got != want {
+		t.Errorf("got %s OrphanGrace, want %s", got, want)
+	}
+}
+
+func TestParseInputDataKey(t *testing.T) {
+	id := uuid.New()
+	got, ok := parseInputDataKey("builds/" + id.String() + "/input/" + uuid.NewString())
+	if !ok || got != id {
+		t.Errorf("got %s, %t, want %s, true", got, ok, id)
+	}
+
+	for _, key := range []string{
+		"builds/" + id.String() + "/output.pdf",
+		"builds/" + id.String() + "/log",
+		"builds/not-a-uuid/input/x",
+		"blobs/" + id.String() + "/input/x",
+	} {
+		if _, ok = parseInputDataKey(key); ok {
+			t.Errorf("got ok for %q", key)
+		}
+	}
+}
+
+func TestDataKeyLockIDs(t *testing.T) {
+	t.Run("sorts and deduplicates", func(t *testing.T) {
+		got := dataKeyLockIDs([]string{"builds/b/output.pdf", "builds/a/output.pdf", "", "builds/b/output.pdf"})
+		if len(got) != 2 {
+			t.Fatalf("got %d IDs, want 2", len(got))
+		}
+		if !slices.IsSorted(got) {
+			t.Errorf("got unsorted %v", got)
+		}
+	})
+
+	t.Run("doesn't depend on order", func(t *testing.T) {
+		a := dataKeyLockIDs([]string{"builds/a/log", "builds/b/log"})
+		b := dataKeyLockIDs([]string{"builds/b/log", "builds/a/log"})
+		if !slices.Equal(a, b) {
+			t.Errorf("got %v and %v", a, b)
+		}
+	})
+}
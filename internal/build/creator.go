@@ -1,34 +1,46 @@
 package build
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"iter"
 	"log/slog"
 	"path"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/smithy-go"
 	"github.com/google/uuid"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/rabbitmq/amqp091-go"
 
-	"github.com/k11v/brick/internal/app"
+	"github.com/k11v/brick/internal/storage"
 )
 
 var (
 	ErrLimitExceeded             = errors.New("limit exceeded")
-	ErrIdempotencyKeyAlreadyUsed = errors.New("idempotency key already used")
+	ErrIdempotencyKeyAlreadyUsed = errors.New("idempotency key already used") // by a different request
 	ErrFileTooLarge              = errors.New("file too large")
+	ErrUnknownPreset             = errors.New("unknown preset")
+	ErrOptionFileNotFound        = errors.New("option file not found")
+	ErrUnknownCSLStyle           = errors.New("unknown CSL style")
+	ErrUnknownEngine             = errors.New("unknown engine")
+	ErrUnknownPriority           = errors.New("unknown priority")
+	ErrReserved                  = errors.New("reserved")
+	ErrNotReserved               = errors.New("not reserved")
+	ErrFileNotUploaded           = errors.New("file not uploaded")
+	ErrFileSizeMismatch          = errors.New("file size mismatch")
+	ErrFileChecksumMismatch      = errors.New("file checksum mismatch")
+	ErrInvalidSHA256             = errors.New("invalid SHA-256")
+	ErrExpired                   = errors.New("expired")
 )
 
 type Build struct {
@@ -42,6 +54,63 @@ type Build struct {
 	ExitCode      int
 	LogDataKey    string
 	OutputDataKey string
+
+	Preset             Preset
+	TemplateFile       string
+	HeaderIncludesFile string
+	BibliographyFile   string
+	CSL                string
+	Engine             Engine
+
+	InputHash    string    // empty if unknown
+	CachedFromID uuid.UUID // build with reused outputs, uuid.Nil if the build wasn't cached
+
+	// InputsExpiredAt, OutputsExpiredAt and LogsExpiredAt are set by Collector
+	// when the data is deleted. They are zero if the data isn't expired.
+	InputsExpiredAt  time.Time
+	OutputsExpiredAt time.Time
+	LogsExpiredAt    time.Time
+
+	Labels []string // user-defined tags for finding builds, never nil
+
+	WallClockSeconds float64 // wall-clock time the build container ran, recorded by Doer for quotas, 0 if the build wasn't done
+
+	ParentBuildID uuid.UUID // build rerun by Creator.Rerun, uuid.Nil if the build isn't a rerun
+
+	// StartedAt and FinishedAt are set when the status changes to doing and to done.
+	// StartedAt is zero if the build wasn't started, for example when it was cached or canceled.
+	// FinishedAt is zero if the build isn't done.
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	Priority Priority
+
+	// Stage is the stage of the build log Doer is at, for example "untar", "pandoc" or "latexmk".
+	// It is kept after the build is done, so it tells where a failed build stopped.
+	// It is empty if Doer didn't start the build.
+	Stage string
+
+	// Replayed is set by Creator when the build was created by an earlier request
+	// with the same idempotency key. It isn't stored.
+	Replayed bool
+}
+
+// QueueDuration returns how long the build waited for Doer.
+// It returns 0 if the build wasn't started.
+func (b *Build) QueueDuration() time.Duration {
+	if b.StartedAt.IsZero() {
+		return 0
+	}
+	return b.StartedAt.Sub(b.CreatedAt)
+}
+
+// RunDuration returns how long Doer ran the build.
+// It returns 0 if the build wasn't started or isn't done.
+func (b *Build) RunDuration() time.Duration {
+	if b.StartedAt.IsZero() || b.FinishedAt.IsZero() {
+		return 0
+	}
+	return b.FinishedAt.Sub(b.StartedAt)
 }
 
 type Error string
@@ -49,18 +118,96 @@ type Error string
 const (
 	ErrorCanceled          Error = "canceled"
 	ErrorExitedWithNonZero Error = "exited with non-zero"
+	ErrorExpired           Error = "expired" // inputs of a reserved build expired before it was finalized
 )
 
 func ParseError(s string) (errorValue Error, known bool) {
 	errorValue = Error(s)
 	switch errorValue {
-	case ErrorCanceled, ErrorExitedWithNonZero:
+	case ErrorCanceled, ErrorExitedWithNonZero, ErrorExpired:
 		return errorValue, true
 	default:
 		return errorValue, false
 	}
 }
 
+// Preset is a named template and metadata set shipped in the build image.
+// See cmd/build for their definitions.
+type Preset string
+
+const (
+	PresetArticle Preset = "article"
+	PresetReport  Preset = "report"
+	PresetLetter  Preset = "letter"
+	PresetSlides  Preset = "slides"
+)
+
+func ParsePreset(s string) (preset Preset, known bool) {
+	preset = Preset(s)
+	switch preset {
+	case PresetArticle, PresetReport, PresetLetter, PresetSlides:
+		return preset, true
+	default:
+		return preset, false
+	}
+}
+
+// Engine is a program that produces the PDF file.
+// LaTeX engines are run with latexmk except for tectonic.
+// Engines are available only if the build image provides them.
+type Engine string
+
+const (
+	EngineLuaLaTeX   Engine = "lualatex"
+	EngineXeLaTeX    Engine = "xelatex"
+	EnginePDFLaTeX   Engine = "pdflatex"
+	EngineTectonic   Engine = "tectonic"
+	EngineTypst      Engine = "typst"
+	EngineWeasyPrint Engine = "weasyprint"
+)
+
+func ParseEngine(s string) (engine Engine, known bool) {
+	engine = Engine(s)
+	switch engine {
+	case EngineLuaLaTeX, EngineXeLaTeX, EnginePDFLaTeX, EngineTectonic, EngineTypst, EngineWeasyPrint:
+		return engine, true
+	default:
+		return engine, false
+	}
+}
+
+// Priority is a scheduling class of builds.
+// Interactive builds are done before batch builds, see messagePriority.
+type Priority string
+
+const (
+	PriorityInteractive Priority = "interactive" // a user waits for the build
+	PriorityBatch       Priority = "batch"       // the build is part of bulk work like CI
+)
+
+func ParsePriority(s string) (priority Priority, known bool) {
+	priority = Priority(s)
+	switch priority {
+	case PriorityInteractive, PriorityBatch:
+		return priority, true
+	default:
+		return priority, false
+	}
+}
+
+// CSLStyles are names of CSL styles bundled in the build image.
+// See Dockerfile.
+var CSLStyles = []string{
+	"apa",
+	"american-medical-association",
+	"chicago-author-date",
+	"harvard-cite-them-right",
+	"ieee",
+	"modern-language-association",
+	"nature",
+	"vancouver",
+}
+
 type File struct {
 	ID      uuid.UUID
 	BuildID uuid.UUID
@@ -68,6 +215,8 @@ type File struct {
 	Name    string
 	Type    FileType
 	DataKey string
+	Size    int64  // -1 if unknown
+	SHA256  string // hex-encoded, empty if unknown
 }
 
 type FileType string
@@ -87,24 +236,37 @@ func ParseFileType(s string) (fileType FileType, known bool) {
 	}
 }
 
+// DefaultUploadExpires is how long presigned upload URLs returned by Creator.Reserve are valid.
+const DefaultUploadExpires = time.Hour
+
 type Creator struct {
-	DB  *pgxpool.Pool
-	MQ  *app.AMQPClient
-	STG *s3.Client
+	DB    *pgxpool.Pool
+	Queue Queue
+	STG   storage.Storage
+
+	UploadExpires time.Duration
 
-	BuildsAllowed int
+	// ImageVersion identifies the build image, builds are cached only if it is set.
+	// It must change whenever the image can produce different outputs.
+	ImageVersion string
+
+	ArchiveLimits ArchiveLimits
+	FileLimits    FileLimits
 }
 
 type CreatorParams struct {
-	BuildsAllowed int
+	ImageVersion string
 }
 
-func NewCreator(db *pgxpool.Pool, mq *app.AMQPClient, stg *s3.Client, params *CreatorParams) *Creator {
+func NewCreator(db *pgxpool.Pool, queue Queue, stg storage.Storage, params *CreatorParams) *Creator {
 	return &Creator{
 		DB:            db,
-		MQ:            mq,
+		Queue:         queue,
 		STG:           stg,
-		BuildsAllowed: params.BuildsAllowed,
+		UploadExpires: DefaultUploadExpires,
+		ImageVersion:  params.ImageVersion,
+		ArchiveLimits: DefaultArchiveLimits,
+		FileLimits:    DefaultFileLimits,
 	}
 }
 
@@ -112,7 +274,38 @@ type CreatorCreateParams struct {
 	IdempotencyKey uuid.UUID
 	UserID         uuid.UUID
 
-	Files iter.Seq2[*CreatorCreateFileParams, error]
+	// Files are either listed one by one or extracted from Archive.
+	// Archive is used if it isn't nil, it is limited by Creator.ArchiveLimits.
+	// Files are limited by Creator.FileLimits, their names must be valid fs.ValidPath paths.
+	Files         iter.Seq2[*CreatorCreateFileParams, error]
+	Archive       io.Reader
+	ArchiveFormat ArchiveFormat
+
+	// Preset defaults to PresetArticle.
+	// TemplateFile and HeaderIncludesFile are optional names of regular files from Files.
+	Preset             Preset
+	TemplateFile       string
+	HeaderIncludesFile string
+
+	// BibliographyFile is an optional name of a regular file from Files.
+	// Citations are also processed without it when the build finds a bibliography.
+	// CSL is an optional name from CSLStyles or a name of a .csl file from Files.
+	BibliographyFile string
+	CSL              string
+
+	// Engine defaults to EngineLuaLaTeX.
+	Engine Engine
+
+	// NoCache makes the build run even if a successful build
+	// of the user with the same input hash exists.
+	NoCache bool
+
+	// Labels are optional tags for finding the build with Getter.List.
+	// They don't affect the build and are limited by MaxLabels and MaxLabelLen.
+	Labels []string
+
+	// Priority defaults to PriorityInteractive.
+	Priority Priority
 }
 
 type CreatorCreateFileParams struct {
@@ -121,95 +314,1142 @@ type CreatorCreateFileParams struct {
 	DataReader io.Reader
 }
 
-func (c *Creator) Create(ctx context.Context, params *CreatorCreateParams) (*Build, error) {
-	tx, err := c.DB.Begin(ctx)
+func (c *Creator) Create(ctx context.Context, params *CreatorCreateParams) (*Build, error) {
+	opts, err := newOptions(params.Preset, params.TemplateFile, params.HeaderIncludesFile, params.BibliographyFile, params.CSL, params.Engine)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	opts.Labels, err = normalizeLabels(params.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	opts.Priority, err = normalizePriority(params.Priority)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	files := params.Files
+	if params.Archive != nil {
+		files = ExtractArchive(params.Archive, params.ArchiveFormat, &c.ArchiveLimits)
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// Lock builds to get their count.
+	err = lockBuilds(ctx, tx, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: lockBuilds: %w", err)
+	}
+
+	// Replay the request if the idempotency key was used.
+	// It is done before the quota check, so retries don't fail when the quota is spent.
+	replayedID, replayedFingerprint, err := getIdempotentBuild(ctx, tx, params.UserID, params.IdempotencyKey)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: getIdempotentBuild: %w", err)
+	}
+	if replayedID != uuid.Nil {
+		// The request body is read to compare the request, so the user lock is released first.
+		_ = tx.Rollback(ctx)
+		hashFiles, err := c.hashFiles(files)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		b, err := replay(ctx, c.DB, replayedID, replayedFingerprint, opts, hashFiles, params.NoCache)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		return b, nil
+	}
+
+	// Check quota.
+	// Cache hits don't count towards it, so exceeding it is reported after a cache miss.
+	quotaErr := c.checkQuota(ctx, tx, params.UserID)
+	if quotaErr != nil && !(errors.Is(quotaErr, ErrLimitExceeded) && c.useCache(params.NoCache)) {
+		return nil, fmt.Errorf("build.Creator: %w", quotaErr)
+	}
+
+	// Create build.
+	b, err := createBuild(ctx, tx, opts.createBuildParams(params.IdempotencyKey, params.UserID, StatusTodo))
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: createBuild: %w", err)
+	}
+
+	// Create object storage keys for output and log files.
+	buildDirKey := fmt.Sprintf("builds/%s", b.ID)
+	logDataKey := path.Join(buildDirKey, "log")
+	outputDataKey := path.Join(buildDirKey, "output.pdf")
+	b, err = updateDataKeys(ctx, tx, b.ID, logDataKey, outputDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateDataKeys: %w", err)
+	}
+
+	// Create input files and upload their content to object storage.
+	uploads := &inputUploads{STG: c.STG}
+	defer uploads.deleteUncommitted(ctx)
+	validator := newFileValidator(&c.FileLimits)
+	hashFiles, err := c.uploadFiles(ctx, tx, b, files, validator, uploads)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if len(hashFiles) == 0 {
+		return nil, fmt.Errorf("build.Creator: %w", ErrNoFiles)
+	}
+
+	// Check that option files were uploaded.
+	err = opts.checkFiles(validator.RegularFileExist())
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	// Check stored bytes with the uploaded files, inputs are stored even for cache hits.
+	err = c.checkStoredBytes(ctx, tx, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	err = updateRequestFingerprint(ctx, tx, b.ID, opts, hashFiles, params.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateRequestFingerprint: %w", err)
+	}
+
+	// Complete build with outputs of a cached build if there is one.
+	b, cached, err := c.completeFromCache(ctx, tx, b, opts, hashFiles, params.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if !cached {
+		if quotaErr != nil {
+			return nil, fmt.Errorf("build.Creator: %w", quotaErr)
+		}
+
+		// Send build created event to workers.
+		err = c.Queue.Send(ctx, tx, b)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: Send: %w", err)
+		}
+	}
+
+	err = uploads.commit(ctx, tx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Commit: %w", err)
+	}
+
+	return b, nil
+}
+
+type CreatorReserveParams struct {
+	IdempotencyKey uuid.UUID
+	UserID         uuid.UUID
+
+	Files []*CreatorReserveFileParams
+
+	// Options are the same as in CreatorCreateParams.
+	Preset             Preset
+	TemplateFile       string
+	HeaderIncludesFile string
+	BibliographyFile   string
+	CSL                string
+	Engine             Engine
+	NoCache            bool
+	Labels             []string
+	Priority           Priority
+}
+
+type CreatorReserveFileParams struct {
+	Name   string
+	Type   FileType
+	Size   int64  // ignored for directories
+	SHA256 string // hex-encoded, required for regular files
+}
+
+type Reservation struct {
+	Build   *Build
+	Uploads []*Upload
+}
+
+// Upload is a presigned HTTP PUT request that uploads the file data.
+type Upload struct {
+	File    *File
+	Request *storage.PresignedRequest
+}
+
+// Reserve creates a reserved build and returns presigned upload URLs for its regular files.
+// Files with content the user already stored as blobs don't need uploads and aren't returned.
+// The build is enqueued by Finalize after the files are uploaded.
+// It is completed from cache instead only if no uploads are needed.
+// Unlike Create, it doesn't hold the user lock while file data is transferred.
+// It returns an error wrapping storage.ErrPresignUnsupported
+// if the storage can't presign URLs, Create can be used then.
+func (c *Creator) Reserve(ctx context.Context, params *CreatorReserveParams) (*Reservation, error) {
+	opts, err := newOptions(params.Preset, params.TemplateFile, params.HeaderIncludesFile, params.BibliographyFile, params.CSL, params.Engine)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	opts.Labels, err = normalizeLabels(params.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	opts.Priority, err = normalizePriority(params.Priority)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if len(params.Files) == 0 {
+		return nil, fmt.Errorf("build.Creator: %w", ErrNoFiles)
+	}
+	validator := newFileValidator(&c.FileLimits)
+	for _, file := range params.Files {
+		if file.Type == FileTypeRegular {
+			if file.Size < 0 {
+				err = fmt.Errorf("%s: negative size: %w", file.Name, ErrFileSizeMismatch)
+				return nil, fmt.Errorf("build.Creator: %w", err)
+			}
+			if _, err = decodeSHA256(file.SHA256); err != nil {
+				return nil, fmt.Errorf("build.Creator: %s: %w", file.Name, err)
+			}
+		}
+		if err = validator.Add(file.Name, file.Type, file.Size); err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+	}
+	regularFileExist := validator.RegularFileExist()
+	err = opts.checkFiles(regularFileExist)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// Lock builds to get their count.
+	err = lockBuilds(ctx, tx, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: lockBuilds: %w", err)
+	}
+
+	// Replay the request if the idempotency key was used.
+	hashFiles := make([]*inputHashFile, 0, len(params.Files))
+	for _, file := range params.Files {
+		hashFile := &inputHashFile{Name: file.Name, Type: file.Type}
+		if file.Type == FileTypeRegular {
+			hashFile.SHA256 = file.SHA256
+		}
+		hashFiles = append(hashFiles, hashFile)
+	}
+	replayedID, replayedFingerprint, err := getIdempotentBuild(ctx, tx, params.UserID, params.IdempotencyKey)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: getIdempotentBuild: %w", err)
+	}
+	if replayedID != uuid.Nil {
+		b, err := replay(ctx, tx, replayedID, replayedFingerprint, opts, hashFiles, params.NoCache)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		uploads, err := c.presignRemainingUploads(ctx, tx, b)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		return &Reservation{Build: b, Uploads: uploads}, nil
+	}
+
+	// Check quota. Reserved builds count towards it, cache hits don't.
+	quotaErr := c.checkQuota(ctx, tx, params.UserID)
+	if quotaErr != nil && !(errors.Is(quotaErr, ErrLimitExceeded) && c.useCache(params.NoCache)) {
+		return nil, fmt.Errorf("build.Creator: %w", quotaErr)
+	}
+
+	// Create build.
+	b, err := createBuild(ctx, tx, opts.createBuildParams(params.IdempotencyKey, params.UserID, StatusReserved))
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: createBuild: %w", err)
+	}
+
+	// Create object storage keys for output and log files.
+	buildDirKey := fmt.Sprintf("builds/%s", b.ID)
+	logDataKey := path.Join(buildDirKey, "log")
+	outputDataKey := path.Join(buildDirKey, "output.pdf")
+	b, err = updateDataKeys(ctx, tx, b.ID, logDataKey, outputDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateDataKeys: %w", err)
+	}
+
+	err = updateRequestFingerprint(ctx, tx, b.ID, opts, hashFiles, params.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateRequestFingerprint: %w", err)
+	}
+
+	// Create input files and link them to stored blobs.
+	inputDirKey := path.Join(buildDirKey, "input")
+	var unlinkedFiles []*File
+	for _, file := range params.Files {
+		size := int64(-1)
+		if file.Type == FileTypeRegular {
+			size = file.Size
+		}
+		buildInputFile, err := createFile(ctx, tx, b.ID, file.Name, file.Type, "", size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: createFile: %w", err)
+		}
+		if file.Type != FileTypeRegular {
+			continue
+		}
+
+		blobDataKey, linked, err := linkBlob(ctx, tx, params.UserID, file.SHA256, file.Size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: linkBlob: %w", err)
+		}
+		if !linked {
+			// The file is stored as a blob by Finalize.
+			blobDataKey = path.Join(inputDirKey, buildInputFile.ID.String())
+		}
+		buildInputFile, err = updateFileBlob(ctx, tx, buildInputFile.ID, blobDataKey, file.SHA256, file.Size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: updateFileBlob: %w", err)
+		}
+		if !linked {
+			unlinkedFiles = append(unlinkedFiles, buildInputFile)
+		}
+	}
+
+	// Check stored bytes with the reserved files, inputs are stored even for cache hits.
+	err = c.checkStoredBytes(ctx, tx, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	// Find a cached build because its outputs make the build unnecessary.
+	// It is used only if all files are linked, so files of every build have data
+	// for input downloads and reruns.
+	noCache := params.NoCache || len(unlinkedFiles) > 0
+	b, cached, err := c.completeFromCache(ctx, tx, b, opts, hashFiles, noCache)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if !cached && quotaErr != nil {
+		return nil, fmt.Errorf("build.Creator: %w", quotaErr)
+	}
+
+	// Presign uploads for files that aren't linked.
+	// Presigning doesn't make requests, so it is done before commit
+	// to avoid leaving builds that can't be finalized.
+	uploads := make([]*Upload, 0, len(unlinkedFiles))
+	for _, f := range unlinkedFiles {
+		sum, _ := decodeSHA256(f.SHA256)
+		req, err := c.STG.PresignPut(ctx, f.DataKey, &storage.PresignPutParams{
+			Expires: c.UploadExpires,
+			Size:    f.Size,
+			SHA256:  sum,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		uploads = append(uploads, &Upload{File: f, Request: req})
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Commit: %w", err)
+	}
+
+	return &Reservation{Build: b, Uploads: uploads}, nil
+}
+
+type CreatorFinalizeParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+// Finalize checks that files of the reserved build were uploaded with the reserved sizes
+// and SHA-256 checksums and enqueues the build.
+// Checksums are computed from the uploaded data because blobs are shared between users
+// and the storage may not verify the checksums of presigned uploads.
+func (c *Creator) Finalize(ctx context.Context, params *CreatorFinalizeParams) (*Build, error) {
+	b, err := getBuild(ctx, c.DB, params.ID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if b.UserID != params.UserID {
+		return nil, fmt.Errorf("build.Creator: %w", ErrAccessDenied)
+	}
+	if b.Status != StatusReserved {
+		return nil, fmt.Errorf("build.Creator: %w", ErrNotReserved)
+	}
+
+	// Check uploaded files outside of the transaction because it requires requests to object storage.
+	// Files linked to blobs by Reserve are skipped.
+	files, err := getFiles(ctx, c.DB, b.ID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: getFiles: %w", err)
+	}
+	uploadedFiles := make([]*File, 0, len(files))
+	for _, f := range files {
+		if f.Type != FileTypeRegular {
+			continue
+		}
+		blobDataKey, err := getBlobDataKey(ctx, c.DB, f.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: getBlobDataKey: %w", err)
+		}
+		if blobDataKey == f.DataKey {
+			continue
+		}
+		uploadedFiles = append(uploadedFiles, f)
+		info, err := c.STG.Stat(ctx, f.DataKey)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotExist) {
+				err = ErrFileNotUploaded
+			}
+			return nil, fmt.Errorf("build.Creator: %s: %w", f.Name, err)
+		}
+		if info.Size != f.Size {
+			return nil, fmt.Errorf("build.Creator: %s: %w", f.Name, ErrFileSizeMismatch)
+		}
+		sum, err := hashObject(ctx, c.STG, f.DataKey)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: hashObject: %w", err)
+		}
+		if sum != f.SHA256 {
+			return nil, fmt.Errorf("build.Creator: %s: %w", f.Name, ErrFileChecksumMismatch)
+		}
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// Get build again in case it was finalized, canceled or expired concurrently.
+	b, err = getForUpdate(ctx, tx, params.ID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if b.Status != StatusReserved {
+		return nil, fmt.Errorf("build.Creator: %w", ErrNotReserved)
+	}
+	if !b.InputsExpiredAt.IsZero() {
+		return nil, fmt.Errorf("build.Creator: %w", ErrExpired)
+	}
+
+	// Store uploaded files as blobs.
+	var duplicateDataKeys []string
+	for _, f := range uploadedFiles {
+		stored, err := c.storeBlob(ctx, tx, f, f.SHA256, f.Size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: storeBlob: %w", err)
+		}
+		if !stored {
+			duplicateDataKeys = append(duplicateDataKeys, f.DataKey)
+		}
+	}
+
+	b, err = updateStatus(ctx, tx, b.ID, StatusTodo, "")
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateStatus: %w", err)
+	}
+
+	// Send build created event to workers.
+	err = c.Queue.Send(ctx, tx, b)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Send: %w", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Commit: %w", err)
+	}
+
+	// Delete uploads that became duplicates of blobs stored concurrently.
+	for _, key := range duplicateDataKeys {
+		if err = c.STG.Delete(ctx, key); err != nil {
+			slog.Warn("didn't delete duplicate upload", "key", key, "err", err)
+		}
+	}
+
+	return b, nil
+}
+
+type CreatorRerunParams struct {
+	IdempotencyKey uuid.UUID
+	UserID         uuid.UUID
+	ParentID       uuid.UUID
+
+	// Files replace files of the parent build with the same names, other files are added.
+	// They are optional and are given like in CreatorCreateParams.
+	Files         iter.Seq2[*CreatorCreateFileParams, error]
+	Archive       io.Reader
+	ArchiveFormat ArchiveFormat
+
+	// Preset, TemplateFile, HeaderIncludesFile, BibliographyFile, CSL and Engine
+	// override options of the parent build if they aren't nil.
+	// Labels override labels of the parent build if they aren't nil.
+	// Priority overrides the priority of the parent build if it isn't nil.
+	Preset             *Preset
+	TemplateFile       *string
+	HeaderIncludesFile *string
+	BibliographyFile   *string
+	CSL                *string
+	Engine             *Engine
+	NoCache            bool
+	Labels             []string
+	Priority           *Priority
+}
+
+// Rerun creates a build with inputs of the parent build.
+// Files that aren't replaced are linked to blobs of the parent build without copying their data,
+// so it returns an error wrapping ErrExpired if the parent inputs were collected.
+// Like Create, it checks the quota and replays requests with a used idempotency key.
+func (c *Creator) Rerun(ctx context.Context, params *CreatorRerunParams) (*Build, error) {
+	files := params.Files
+	if params.Archive != nil {
+		files = ExtractArchive(params.Archive, params.ArchiveFormat, &c.ArchiveLimits)
+	}
+	if files == nil {
+		files = func(func(*CreatorCreateFileParams, error) bool) {}
+	}
+
+	tx, err := c.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// Lock builds to get their count.
+	err = lockBuilds(ctx, tx, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: lockBuilds: %w", err)
+	}
+
+	// Replay the request if the idempotency key was used.
+	// It is done before the parent checks, so retries don't fail when the parent inputs expire.
+	replayedID, replayedFingerprint, err := getIdempotentBuild(ctx, tx, params.UserID, params.IdempotencyKey)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: getIdempotentBuild: %w", err)
+	}
+	if replayedID != uuid.Nil {
+		// The request body is read to compare the request, so the user lock is released first.
+		_ = tx.Rollback(ctx)
+		b, err := c.replayRerun(ctx, replayedID, replayedFingerprint, files, params)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		return b, nil
+	}
+
+	// Get the parent build and its files.
+	// The files aren't locked because linking fails if Collector releases their blobs concurrently.
+	parent, err := getBuild(ctx, tx, params.ParentID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if parent.UserID != params.UserID {
+		return nil, fmt.Errorf("build.Creator: %w", ErrAccessDenied)
+	}
+	if parent.Status == StatusReserved {
+		return nil, fmt.Errorf("build.Creator: %w", ErrReserved)
+	}
+	if !parent.InputsExpiredAt.IsZero() {
+		return nil, fmt.Errorf("build.Creator: %w", ErrExpired)
+	}
+	parentFiles, err := getFiles(ctx, tx, parent.ID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: getFiles: %w", err)
+	}
+
+	opts, err := newRerunOptions(parent, params)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	// Check quota.
+	// Cache hits don't count towards it, so exceeding it is reported after a cache miss.
+	quotaErr := c.checkQuota(ctx, tx, params.UserID)
+	if quotaErr != nil && !(errors.Is(quotaErr, ErrLimitExceeded) && c.useCache(params.NoCache)) {
+		return nil, fmt.Errorf("build.Creator: %w", quotaErr)
+	}
+
+	// Create build.
+	createParams := opts.createBuildParams(params.IdempotencyKey, params.UserID, StatusTodo)
+	createParams.ParentBuildID = parent.ID
+	b, err := createBuild(ctx, tx, createParams)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: createBuild: %w", err)
+	}
+
+	// Create object storage keys for output and log files.
+	buildDirKey := fmt.Sprintf("builds/%s", b.ID)
+	logDataKey := path.Join(buildDirKey, "log")
+	outputDataKey := path.Join(buildDirKey, "output.pdf")
+	b, err = updateDataKeys(ctx, tx, b.ID, logDataKey, outputDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateDataKeys: %w", err)
+	}
+
+	// Create replacing files and upload their content to object storage like Create does.
+	uploads := &inputUploads{STG: c.STG}
+	defer uploads.deleteUncommitted(ctx)
+	validator := newFileValidator(&c.FileLimits)
+	hashFiles, err := c.uploadFiles(ctx, tx, b, files, validator, uploads)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	replacedFileExist := make(map[string]struct{}, len(hashFiles))
+	for _, f := range hashFiles {
+		replacedFileExist[f.Name] = struct{}{}
+	}
+
+	// Create files that aren't replaced and link them to blobs of the parent build.
+	for _, f := range keptFiles(parentFiles, replacedFileExist) {
+		err = validator.Add(f.Name, f.Type, f.Size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: %w", err)
+		}
+		hashFiles = append(hashFiles, &inputHashFile{Name: f.Name, Type: f.Type, SHA256: f.SHA256})
+		if f.Type != FileTypeRegular {
+			if _, err = createFile(ctx, tx, b.ID, f.Name, f.Type, "", -1); err != nil {
+				return nil, fmt.Errorf("build.Creator: createFile: %w", err)
+			}
+			continue
+		}
+
+		blobDataKey, linked, err := linkFileBlob(ctx, tx, f.ID)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: linkFileBlob: %w", err)
+		}
+		if !linked {
+			// The file data was never stored as a blob or the blob was collected.
+			return nil, fmt.Errorf("build.Creator: %s: %w", f.Name, ErrExpired)
+		}
+		buildInputFile, err := createFile(ctx, tx, b.ID, f.Name, f.Type, "", f.Size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: createFile: %w", err)
+		}
+		_, err = updateFileBlob(ctx, tx, buildInputFile.ID, blobDataKey, f.SHA256, f.Size)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: updateFileBlob: %w", err)
+		}
+	}
+	if len(hashFiles) == 0 {
+		return nil, fmt.Errorf("build.Creator: %w", ErrNoFiles)
+	}
+
+	// Check that option files exist after replacements.
+	err = opts.checkFiles(validator.RegularFileExist())
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	// Check stored bytes with the replacing files, kept files share blobs of the parent build.
+	err = c.checkStoredBytes(ctx, tx, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+
+	err = updateRequestFingerprint(ctx, tx, b.ID, opts, hashFiles, params.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: updateRequestFingerprint: %w", err)
+	}
+
+	// Complete build with outputs of a cached build if there is one.
+	// The parent build itself is found if the inputs and the image version didn't change.
+	b, cached, err := c.completeFromCache(ctx, tx, b, opts, hashFiles, params.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: %w", err)
+	}
+	if !cached {
+		if quotaErr != nil {
+			return nil, fmt.Errorf("build.Creator: %w", quotaErr)
+		}
+
+		// Send build created event to workers.
+		err = c.Queue.Send(ctx, tx, b)
+		if err != nil {
+			return nil, fmt.Errorf("build.Creator: Send: %w", err)
+		}
+	}
+
+	err = uploads.commit(ctx, tx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Creator: Commit: %w", err)
+	}
+
+	return b, nil
+}
+
+// newRerunOptions returns options of the parent build overridden by the rerun params.
+func newRerunOptions(parent *Build, params *CreatorRerunParams) (*options, error) {
+	preset, templateFile, headerIncludesFile := parent.Preset, parent.TemplateFile, parent.HeaderIncludesFile
+	bibliographyFile, csl, engine := parent.BibliographyFile, parent.CSL, parent.Engine
+	if params.Preset != nil {
+		preset = *params.Preset
+	}
+	if params.TemplateFile != nil {
+		templateFile = *params.TemplateFile
+	}
+	if params.HeaderIncludesFile != nil {
+		headerIncludesFile = *params.HeaderIncludesFile
+	}
+	if params.BibliographyFile != nil {
+		bibliographyFile = *params.BibliographyFile
+	}
+	if params.CSL != nil {
+		csl = *params.CSL
+	}
+	if params.Engine != nil {
+		engine = *params.Engine
+	}
+	opts, err := newOptions(preset, templateFile, headerIncludesFile, bibliographyFile, csl, engine)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := parent.Labels
+	if params.Labels != nil {
+		labels = params.Labels
+	}
+	opts.Labels, err = normalizeLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	priority := parent.Priority
+	if params.Priority != nil {
+		priority = *params.Priority
+	}
+	opts.Priority, err = normalizePriority(priority)
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// keptFiles returns files of the parent build that aren't replaced by a rerun.
+func keptFiles(parentFiles []*File, replacedFileExist map[string]struct{}) []*File {
+	kept := make([]*File, 0, len(parentFiles))
+	for _, f := range parentFiles {
+		if _, replaced := replacedFileExist[f.Name]; !replaced {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// replayRerun returns the build created by an earlier rerun request with the same idempotency key.
+// The request is compared with files of the parent build that the earlier request kept.
+func (c *Creator) replayRerun(ctx context.Context, id uuid.UUID, fingerprint string, files iter.Seq2[*CreatorCreateFileParams, error], params *CreatorRerunParams) (*Build, error) {
+	parent, err := getBuild(ctx, c.DB, params.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	if parent.UserID != params.UserID {
+		return nil, ErrAccessDenied
+	}
+	parentFiles, err := getFiles(ctx, c.DB, parent.ID)
+	if err != nil {
+		return nil, fmt.Errorf("getFiles: %w", err)
+	}
+	opts, err := newRerunOptions(parent, params)
+	if err != nil {
+		return nil, err
+	}
+
+	hashFiles, err := c.hashFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	replacedFileExist := make(map[string]struct{}, len(hashFiles))
+	for _, f := range hashFiles {
+		replacedFileExist[f.Name] = struct{}{}
+	}
+	for _, f := range keptFiles(parentFiles, replacedFileExist) {
+		hashFiles = append(hashFiles, &inputHashFile{Name: f.Name, Type: f.Type, SHA256: f.SHA256})
+	}
+	return replay(ctx, c.DB, id, fingerprint, opts, hashFiles, params.NoCache)
+}
+
+// inputUploads are data keys of input files uploaded while a build is created.
+// The data is deleted if the build isn't committed.
+// Data is kept if Commit fails because the build may have been committed anyway,
+// Collector.Sweep deletes it later if it wasn't.
+type inputUploads struct {
+	STG storage.Storage
+
+	uploadedDataKeys  []string
+	duplicateDataKeys []string // uploads that became duplicates of stored blobs
+	committing        bool
+}
+
+// deleteUncommitted deletes uploaded data unless commit was called.
+// It is deferred right after the transaction is begun.
+func (u *inputUploads) deleteUncommitted(ctx context.Context) {
+	if u.committing {
+		return
+	}
+	for _, key := range u.uploadedDataKeys {
+		if err := u.STG.Delete(context.WithoutCancel(ctx), key); err != nil {
+			slog.Warn("didn't delete upload of uncreated build", "key", key, "err", err)
+		}
+	}
+}
+
+// commit commits the transaction and deletes uploads that became duplicates of stored blobs.
+func (u *inputUploads) commit(ctx context.Context, tx pgx.Tx) error {
+	u.committing = true
+	err := tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range u.duplicateDataKeys {
+		if err = u.STG.Delete(ctx, key); err != nil {
+			slog.Warn("didn't delete duplicate upload", "key", key, "err", err)
+		}
+	}
+	return nil
+}
+
+// uploadFiles creates input files of the build, uploads their data to object storage
+// and stores it as blobs. Files are checked by the validator as they are read.
+// It returns the files for the input hash in the order they were read.
+func (c *Creator) uploadFiles(ctx context.Context, db executor, b *Build, files iter.Seq2[*CreatorCreateFileParams, error], validator *fileValidator, uploads *inputUploads) ([]*inputHashFile, error) {
+	inputDirKey := path.Join(fmt.Sprintf("builds/%s", b.ID), "input")
+	var hashFiles []*inputHashFile
+	for file, err := range files {
+		if err != nil {
+			return nil, err
+		}
+		err = validator.Add(file.Name, file.Type, -1)
+		if err != nil {
+			return nil, err
+		}
+		buildInputFile, err := createFile(ctx, db, b.ID, file.Name, file.Type, "", -1)
+		if err != nil {
+			return nil, fmt.Errorf("createFile: %w", err)
+		}
+		hashFile := &inputHashFile{Name: file.Name, Type: file.Type}
+		hashFiles = append(hashFiles, hashFile)
+		if file.Type == FileTypeRegular {
+			dataKey := path.Join(inputDirKey, buildInputFile.ID.String())
+			buildInputFile, err = updateFileDataKey(ctx, db, buildInputFile.ID, dataKey)
+			if err != nil {
+				return nil, fmt.Errorf("updateFileDataKey: %w", err)
+			}
+			hr := newHashReader(validator.LimitReader(file.DataReader))
+			uploads.uploadedDataKeys = append(uploads.uploadedDataKeys, dataKey)
+			err = uploadFileData(ctx, c.STG, dataKey, hr)
+			if err != nil {
+				if limitErr := validator.LimitErr(); limitErr != nil {
+					err = errors.Join(limitErr, err)
+				}
+				return nil, fmt.Errorf("%s: %w", file.Name, err)
+			}
+			stored, err := c.storeBlob(ctx, db, buildInputFile, hr.SHA256(), hr.Size())
+			if err != nil {
+				return nil, fmt.Errorf("storeBlob: %w", err)
+			}
+			if !stored {
+				uploads.duplicateDataKeys = append(uploads.duplicateDataKeys, dataKey)
+			}
+			hashFile.SHA256 = hr.SHA256()
+		}
+	}
+	return hashFiles, nil
+}
+
+// useCache reports whether builds can be completed from cache.
+func (c *Creator) useCache(noCache bool) bool {
+	return c.ImageVersion != "" && !noCache
+}
+
+// completeFromCache sets the input hash of the build and, if a successful build
+// of the same user with the same input hash exists, completes the build with its outputs.
+func (c *Creator) completeFromCache(ctx context.Context, db executor, b *Build, opts *options, files []*inputHashFile, noCache bool) (*Build, bool, error) {
+	if c.ImageVersion == "" {
+		return b, false, nil
+	}
+
+	inputHash, err := computeInputHash(c.ImageVersion, opts, files)
+	if err != nil {
+		return nil, false, fmt.Errorf("computeInputHash: %w", err)
+	}
+	b, err = updateInputHash(ctx, db, b.ID, inputHash)
+	if err != nil {
+		return nil, false, fmt.Errorf("updateInputHash: %w", err)
+	}
+	if noCache {
+		return b, false, nil
+	}
+
+	cachedBuild, err := findCachedBuild(ctx, db, b.UserID, inputHash, b.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("findCachedBuild: %w", err)
+	}
+	if cachedBuild == nil {
+		return b, false, nil
+	}
+
+	b, err = updateFromCachedBuild(ctx, db, b.ID, cachedBuild)
+	if err != nil {
+		return nil, false, fmt.Errorf("updateFromCachedBuild: %w", err)
+	}
+	err = copyDiagnostics(ctx, db, cachedBuild.ID, b.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("copyDiagnostics: %w", err)
+	}
+	return b, true, nil
+}
+
+type inputHashFile struct {
+	Name   string   `json:"name"`
+	Type   FileType `json:"type"`
+	SHA256 string   `json:"sha256,omitempty"`
+}
+
+// computeInputHash returns a hex-encoded SHA-256 checksum of everything that affects build outputs.
+// Files are sorted by name, so their order doesn't matter.
+func computeInputHash(imageVersion string, opts *options, files []*inputHashFile) (string, error) {
+	type input struct {
+		ImageVersion       string           `json:"image_version"`
+		Preset             Preset           `json:"preset"`
+		TemplateFile       string           `json:"template_file"`
+		HeaderIncludesFile string           `json:"header_includes_file"`
+		BibliographyFile   string           `json:"bibliography_file"`
+		CSL                string           `json:"csl"`
+		Engine             Engine           `json:"engine"`
+		Files              []*inputHashFile `json:"files"`
+	}
+
+	sortedFiles := slices.Clone(files)
+	slices.SortFunc(sortedFiles, func(a, b *inputHashFile) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	data, err := json.Marshal(&input{
+		ImageVersion:       imageVersion,
+		Preset:             opts.Preset,
+		TemplateFile:       opts.TemplateFile,
+		HeaderIncludesFile: opts.HeaderIncludesFile,
+		BibliographyFile:   opts.BibliographyFile,
+		CSL:                opts.CSL,
+		Engine:             opts.Engine,
+		Files:              sortedFiles,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// computeRequestFingerprint returns a hex-encoded SHA-256 checksum of a Create or Reserve request.
+// Requests with the same idempotency key replay the build only if their fingerprints match.
+// Unlike the input hash, it doesn't depend on the image version, so requests can be retried across deploys.
+// The priority is included only if it isn't the default, so fingerprints stored before priorities still match.
+func computeRequestFingerprint(opts *options, files []*inputHashFile, noCache bool) (string, error) {
+	inputHash, err := computeInputHash("", opts, files)
+	if err != nil {
+		return "", err
+	}
+	request := map[string]any{"input_hash": inputHash, "no_cache": noCache, "labels": opts.Labels}
+	if opts.Priority != PriorityInteractive {
+		request["priority"] = opts.Priority
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashFiles reads files like Create does without storing them
+// and returns them for computeRequestFingerprint.
+func (c *Creator) hashFiles(files iter.Seq2[*CreatorCreateFileParams, error]) ([]*inputHashFile, error) {
+	validator := newFileValidator(&c.FileLimits)
+	var hashFiles []*inputHashFile
+	for file, err := range files {
+		if err != nil {
+			return nil, err
+		}
+		if err = validator.Add(file.Name, file.Type, -1); err != nil {
+			return nil, err
+		}
+		hashFile := &inputHashFile{Name: file.Name, Type: file.Type}
+		if file.Type == FileTypeRegular {
+			hr := newHashReader(validator.LimitReader(file.DataReader))
+			if _, err = io.Copy(io.Discard, hr); err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name, err)
+			}
+			hashFile.SHA256 = hr.SHA256()
+		}
+		hashFiles = append(hashFiles, hashFile)
+	}
+	return hashFiles, nil
+}
+
+// replay returns the build created by an earlier request with the same idempotency key.
+// It returns ErrIdempotencyKeyAlreadyUsed if the request differs from the earlier one.
+// Builds created before fingerprints were stored have an empty fingerprint and match any request.
+func replay(ctx context.Context, db executor, id uuid.UUID, fingerprint string, opts *options, files []*inputHashFile, noCache bool) (*Build, error) {
+	requestFingerprint, err := computeRequestFingerprint(opts, files, noCache)
 	if err != nil {
-		return nil, fmt.Errorf("build.Creator: Begin: %w", err)
+		return nil, fmt.Errorf("computeRequestFingerprint: %w", err)
 	}
-	defer func() {
-		_ = tx.Rollback(ctx)
-	}()
-
-	// Lock builds to get their count.
-	err = lockBuilds(ctx, tx, params.UserID)
-	if err != nil {
-		return nil, fmt.Errorf("build.Creator: lockBuilds: %w", err)
+	if fingerprint != "" && requestFingerprint != fingerprint {
+		return nil, ErrIdempotencyKeyAlreadyUsed
 	}
 
-	// Check daily quota.
-	todayStartTime := time.Now().UTC().Truncate(24 * time.Hour)
-	todayEndTime := todayStartTime.Add(24 * time.Hour)
-	buildsUsed, err := count(ctx, tx, params.UserID, todayStartTime, todayEndTime)
+	b, err := getBuild(ctx, db, id)
 	if err != nil {
-		return nil, fmt.Errorf("build.Creator: count: %w", err)
-	}
-	if buildsUsed >= c.BuildsAllowed {
-		err = ErrLimitExceeded
-		return nil, fmt.Errorf("build.Creator: %w", err)
+		return nil, fmt.Errorf("getBuild: %w", err)
 	}
+	b.Replayed = true
+	return b, nil
+}
 
-	// Create build.
-	b, err := createBuild(ctx, tx, params.IdempotencyKey, params.UserID, "", "")
-	if err != nil {
-		return nil, fmt.Errorf("build.Creator: createBuild: %w", err)
+// presignRemainingUploads presigns uploads of files of the reserved build
+// that aren't linked to blobs, like Reserve does. Uploads aren't needed for builds
+// that aren't reserved anymore. Files that were already uploaded can be uploaded again.
+func (c *Creator) presignRemainingUploads(ctx context.Context, db executor, b *Build) ([]*Upload, error) {
+	if b.Status != StatusReserved {
+		return nil, nil
 	}
 
-	// Create object storage keys for output and log files.
-	buildDirKey := fmt.Sprintf("builds/%s", b.ID)
-	logDataKey := path.Join(buildDirKey, "log")
-	outputDataKey := path.Join(buildDirKey, "output.pdf")
-	b, err = updateDataKeys(ctx, tx, b.ID, logDataKey, outputDataKey)
+	files, err := getFiles(ctx, db, b.ID)
 	if err != nil {
-		return nil, fmt.Errorf("build.Creator: updateDataKeys: %w", err)
+		return nil, fmt.Errorf("getFiles: %w", err)
 	}
-
-	// Create input files and upload their content to object storage.
-	inputDirKey := path.Join(buildDirKey, "input")
-	filesLen := 0
-	for file, err := range params.Files {
-		filesLen++
+	var uploads []*Upload
+	for _, f := range files {
+		if f.Type != FileTypeRegular || f.DataKey == "" {
+			continue
+		}
+		blobDataKey, err := getBlobDataKey(ctx, db, f.SHA256)
 		if err != nil {
-			slog.Error("range params.Files", "err", err)
-			panic("unimplemented")
+			return nil, fmt.Errorf("getBlobDataKey: %w", err)
+		}
+		if blobDataKey == f.DataKey {
+			continue
 		}
-		buildInputFile, err := createFile(ctx, tx, b.ID, file.Name, file.Type, "")
+		sum, _ := decodeSHA256(f.SHA256)
+		req, err := c.STG.PresignPut(ctx, f.DataKey, &storage.PresignPutParams{
+			Expires: c.UploadExpires,
+			Size:    f.Size,
+			SHA256:  sum,
+		})
 		if err != nil {
-			slog.Error("createBuildInputFile", "err", err)
-			panic("unimplemented")
+			return nil, err
 		}
-		if file.Type == FileTypeRegular {
-			dataKey := path.Join(inputDirKey, buildInputFile.ID.String())
-			buildInputFile, err = updateFileDataKey(ctx, tx, buildInputFile.ID, dataKey)
-			if err != nil {
-				slog.Error("updateBuildInputFileKey", "err", err)
-				panic("unimplemented")
-			}
-			err = uploadFileData(ctx, c.STG, dataKey, file.DataReader)
-			if err != nil {
-				slog.Error("uploadFileContent", "err", err)
-				panic("unimplemented")
-			}
+		uploads = append(uploads, &Upload{File: f, Request: req})
+	}
+	return uploads, nil
+}
+
+// options are validated build options shared by Create and Reserve.
+type options struct {
+	Preset             Preset
+	TemplateFile       string
+	HeaderIncludesFile string
+	BibliographyFile   string
+	CSL                string
+	CSLFile            string // CSL if it names a file
+	Engine             Engine
+
+	Labels []string // sorted, they aren't part of the input hash
+
+	Priority Priority // not part of the input hash
+}
+
+func newOptions(preset Preset, templateFile, headerIncludesFile, bibliographyFile, csl string, engine Engine) (*options, error) {
+	if preset == "" {
+		preset = PresetArticle
+	}
+	if _, known := ParsePreset(string(preset)); !known {
+		return nil, ErrUnknownPreset
+	}
+	if engine == "" {
+		engine = EngineLuaLaTeX
+	}
+	if _, known := ParseEngine(string(engine)); !known {
+		return nil, ErrUnknownEngine
+	}
+	cslFile := ""
+	if strings.HasSuffix(csl, ".csl") {
+		cslFile = csl
+	} else if csl != "" && !slices.Contains(CSLStyles, csl) {
+		return nil, ErrUnknownCSLStyle
+	}
+	return &options{
+		Preset:             preset,
+		TemplateFile:       templateFile,
+		HeaderIncludesFile: headerIncludesFile,
+		BibliographyFile:   bibliographyFile,
+		CSL:                csl,
+		CSLFile:            cslFile,
+		Engine:             engine,
+	}, nil
+}
+
+// checkFiles checks that option files are regular files of the build.
+func (o *options) checkFiles(regularFileExist map[string]struct{}) error {
+	for _, name := range []string{o.TemplateFile, o.HeaderIncludesFile, o.BibliographyFile, o.CSLFile} {
+		if _, exist := regularFileExist[name]; name != "" && !exist {
+			return fmt.Errorf("%s: %w", name, ErrOptionFileNotFound)
 		}
 	}
-	if filesLen == 0 {
-		err = errors.New("files missing")
-		return nil, fmt.Errorf("build.Creator: %w", err)
+	return nil
+}
+
+func (o *options) createBuildParams(idempotencyKey uuid.UUID, userID uuid.UUID, status Status) *createBuildParams {
+	return &createBuildParams{
+		IdempotencyKey:     idempotencyKey,
+		UserID:             userID,
+		Status:             status,
+		Preset:             o.Preset,
+		TemplateFile:       o.TemplateFile,
+		HeaderIncludesFile: o.HeaderIncludesFile,
+		BibliographyFile:   o.BibliographyFile,
+		CSL:                o.CSL,
+		Engine:             o.Engine,
+		Labels:             o.Labels,
+		Priority:           o.Priority,
 	}
+}
 
-	// Send build created event to workers.
-	err = sendCreated(ctx, c.MQ, b)
+// checkQuota checks the quota of the user.
+// It returns a LimitError if a limit is exceeded.
+// The user builds must be locked with lockBuilds.
+func (c *Creator) checkQuota(ctx context.Context, db executor, userID uuid.UUID) error {
+	q, err := getQuota(ctx, db, userID, time.Now())
 	if err != nil {
-		slog.Error("sendBuildCreated", "err", err)
-		panic("unimplemented")
+		return fmt.Errorf("getQuota: %w", err)
 	}
+	return q.Err()
+}
 
-	err = tx.Commit(ctx)
+// checkStoredBytes checks the stored bytes limit of the user
+// including files created in the transaction, so one large build can't go far past it.
+// It returns a LimitError if the limit is exceeded.
+func (c *Creator) checkStoredBytes(ctx context.Context, db executor, userID uuid.UUID) error {
+	q, err := getQuota(ctx, db, userID, time.Now())
 	if err != nil {
-		slog.Error("Commit", "err", err)
-		panic("unimplemented")
+		return fmt.Errorf("getQuota: %w", err)
 	}
-
-	return b, nil
+	return q.storedBytesErr()
 }
 
 type executor interface {
@@ -239,37 +1479,164 @@ func lockBuilds(ctx context.Context, db executor, userID uuid.UUID) error {
 	return nil
 }
 
-func count(ctx context.Context, db executor, userID uuid.UUID, startTime, endTime time.Time) (int, error) {
+type createBuildParams struct {
+	IdempotencyKey uuid.UUID
+	UserID         uuid.UUID
+	Status         Status
+	LogDataKey     string
+	OutputDataKey  string
+
+	Preset             Preset
+	TemplateFile       string
+	HeaderIncludesFile string
+	BibliographyFile   string
+	CSL                string
+	Engine             Engine
+	Labels             []string
+	Priority           Priority
+
+	ParentBuildID uuid.UUID // uuid.Nil if the build isn't a rerun
+}
+
+func createBuild(ctx context.Context, db executor, params *createBuildParams) (*Build, error) {
+	query := `
+		INSERT INTO builds (idempotency_key, user_id, status, log_data_key, output_data_key,
+		                    preset, template_file, header_includes_file, bibliography_file, csl, engine, labels,
+		                    parent_build_id, priority)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		          preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		          inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
+	`
+	var parentBuildIDArg *uuid.UUID
+	if params.ParentBuildID != uuid.Nil {
+		parentBuildIDArg = &params.ParentBuildID
+	}
+	args := []any{
+		params.IdempotencyKey, params.UserID, string(params.Status), params.LogDataKey, params.OutputDataKey,
+		string(params.Preset), params.TemplateFile, params.HeaderIncludesFile, params.BibliographyFile, params.CSL,
+		string(params.Engine), params.Labels, parentBuildIDArg, string(params.Priority),
+	}
+
+	// TODO: Study pgconn.PgError.ColumnName.
+	rows, _ := db.Query(ctx, query, args...)
+	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
+	if err != nil {
+		if pgErr := (*pgconn.PgError)(nil); errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == "builds_user_id_idempotency_key_idx" {
+			err = ErrIdempotencyKeyAlreadyUsed
+		}
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func updateDataKeys(ctx context.Context, db executor, id uuid.UUID, logDataKey string, outputDataKey string) (*Build, error) {
+	query := `
+		UPDATE builds
+		SET log_data_key = $2, output_data_key = $3
+		WHERE id = $1
+		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		          preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		          inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
+	`
+	args := []any{id, outputDataKey, logDataKey}
+
+	rows, _ := db.Query(ctx, query, args...)
+	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func updateInputHash(ctx context.Context, db executor, id uuid.UUID, inputHash string) (*Build, error) {
+	query := `
+		UPDATE builds
+		SET input_hash = $2
+		WHERE id = $1
+		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		          preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		          inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
+	`
+	args := []any{id, inputHash}
+
+	rows, _ := db.Query(ctx, query, args...)
+	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// getIdempotentBuild returns the ID and the request fingerprint of the user build
+// with the idempotency key or uuid.Nil if there is none.
+// The fingerprint is empty if the build was created before fingerprints were stored.
+func getIdempotentBuild(ctx context.Context, db executor, userID uuid.UUID, idempotencyKey uuid.UUID) (uuid.UUID, string, error) {
 	query := `
-		SELECT count(*)
+		SELECT id, coalesce(request_fingerprint, '')
 		FROM builds
-		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+		WHERE user_id = $1 AND idempotency_key = $2
 	`
-	args := []any{userID, startTime, endTime}
+	args := []any{userID, idempotencyKey}
 
+	type idempotentBuild struct {
+		ID                 uuid.UUID
+		RequestFingerprint string
+	}
 	rows, _ := db.Query(ctx, query, args...)
-	c, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[int])
+	ib, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[idempotentBuild])
 	if err != nil {
-		return 0, err
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, "", nil
+		}
+		return uuid.Nil, "", err
 	}
 
-	return c, nil
+	return ib.ID, ib.RequestFingerprint, nil
 }
 
-func createBuild(ctx context.Context, db executor, idempotencyKey uuid.UUID, userID uuid.UUID, logDataKey string, outputDataKey string) (*Build, error) {
+func updateRequestFingerprint(ctx context.Context, db executor, id uuid.UUID, opts *options, files []*inputHashFile, noCache bool) error {
+	fingerprint, err := computeRequestFingerprint(opts, files, noCache)
+	if err != nil {
+		return err
+	}
+
 	query := `
-		INSERT INTO builds (idempotency_key, user_id, status, log_data_key, output_data_key)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key
+		UPDATE builds
+		SET request_fingerprint = $2
+		WHERE id = $1
 	`
-	args := []any{idempotencyKey, userID, string(StatusTodo), logDataKey, outputDataKey}
+	args := []any{id, fingerprint}
+
+	_, err = db.Exec(ctx, query, args...)
+	return err
+}
+
+// findCachedBuild returns the latest successful build of the user with the input hash
+// or nil if there is none. Builds with expired outputs or logs aren't returned.
+// The build is locked for share, so Collector doesn't expire it before the transaction ends.
+func findCachedBuild(ctx context.Context, db executor, userID uuid.UUID, inputHash string, excludeID uuid.UUID) (*Build, error) {
+	query := `
+		SELECT id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		       preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		       inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
+		FROM builds
+		WHERE user_id = $1 AND input_hash = $2 AND id != $3 AND status = $4 AND error IS NULL AND exit_code = 0
+		  AND outputs_expired_at IS NULL AND logs_expired_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1
+		FOR SHARE
+	`
+	args := []any{userID, inputHash, excludeID, string(StatusDone)}
 
-	// TODO: Study pgconn.PgError.ColumnName.
 	rows, _ := db.Query(ctx, query, args...)
 	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
 	if err != nil {
-		if pgErr := (*pgconn.PgError)(nil); errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) && pgErr.ColumnName == "idempotency_key" {
-			err = ErrIdempotencyKeyAlreadyUsed
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
 		}
 		return nil, err
 	}
@@ -277,14 +1644,19 @@ func createBuild(ctx context.Context, db executor, idempotencyKey uuid.UUID, use
 	return b, nil
 }
 
-func updateDataKeys(ctx context.Context, db executor, id uuid.UUID, logDataKey string, outputDataKey string) (*Build, error) {
+// updateFromCachedBuild completes the build sharing the outputs of the cached build
+// and creates webhook deliveries of the change.
+func updateFromCachedBuild(ctx context.Context, db executor, id uuid.UUID, cachedBuild *Build) (*Build, error) {
 	query := `
 		UPDATE builds
-		SET log_data_key = $2, output_data_key = $3
+		SET status = $2, error = NULL, exit_code = $3, log_data_key = $4, output_data_key = $5, cached_from_id = $6,
+		    finished_at = now()
 		WHERE id = $1
-		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key
+		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		          preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		          inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
 	`
-	args := []any{id, outputDataKey, logDataKey}
+	args := []any{id, string(StatusDone), cachedBuild.ExitCode, cachedBuild.LogDataKey, cachedBuild.OutputDataKey, cachedBuild.ID}
 
 	rows, _ := db.Query(ctx, query, args...)
 	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
@@ -292,16 +1664,39 @@ func updateDataKeys(ctx context.Context, db executor, id uuid.UUID, logDataKey s
 		return nil, err
 	}
 
+	if err = createWebhookDeliveries(ctx, db, b); err != nil {
+		return nil, fmt.Errorf("createWebhookDeliveries: %w", err)
+	}
+
 	return b, nil
 }
 
-func createFile(ctx context.Context, db executor, buildID uuid.UUID, name string, typ FileType, dataKey string) (*File, error) {
+func copyDiagnostics(ctx context.Context, db executor, fromBuildID uuid.UUID, toBuildID uuid.UUID) error {
+	query := `
+		INSERT INTO build_diagnostics (build_id, position, severity, file, line, message, stage)
+		SELECT $2, position, severity, file, line, message, stage
+		FROM build_diagnostics
+		WHERE build_id = $1
+	`
+	args := []any{fromBuildID, toBuildID}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
+
+// createFile creates a file. Size is stored as unknown if it is negative.
+func createFile(ctx context.Context, db executor, buildID uuid.UUID, name string, typ FileType, dataKey string, size int64) (*File, error) {
+	var sizeArg *int64
+	if size >= 0 {
+		sizeArg = &size
+	}
+
 	query := `
-		INSERT INTO build_files (build_id, name, type, data_key)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, build_id, name, type, data_key
+		INSERT INTO build_files (build_id, name, type, data_key, size)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, build_id, name, type, data_key, size, sha256
 	`
-	args := []any{buildID, name, string(typ), dataKey}
+	args := []any{buildID, name, string(typ), dataKey, sizeArg}
 
 	rows, _ := db.Query(ctx, query, args...)
 	f, err := pgx.CollectExactlyOneRow(rows, rowToFile)
@@ -317,7 +1712,7 @@ func updateFileDataKey(ctx context.Context, db executor, id uuid.UUID, dataKey s
 		UPDATE build_files
 		SET data_key = $2
 		WHERE id = $1
-		RETURNING id, build_id, name, type, data_key
+		RETURNING id, build_id, name, type, data_key, size, sha256
 	`
 	args := []any{id, dataKey}
 
@@ -330,79 +1725,189 @@ func updateFileDataKey(ctx context.Context, db executor, id uuid.UUID, dataKey s
 	return f, nil
 }
 
-// uploadPartSize should be greater than or equal 5MB.
-// See github.com/aws/aws-sdk-go-v2/feature/s3/manager.
-const uploadPartSize = 10 * 1024 * 1024 // 10MB
-
-func uploadFileData(ctx context.Context, s3Client *s3.Client, key string, r io.Reader) error {
-	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
-		u.PartSize = uploadPartSize
-	})
-
-	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: &app.S3BucketName,
-		Key:    &key,
-		Body:   r,
-	})
+func uploadFileData(ctx context.Context, stg storage.Storage, key string, r io.Reader) error {
+	err := stg.Upload(ctx, key, r)
 	if err != nil {
-		if apiErr := smithy.APIError(nil); errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooLarge" {
+		if errors.Is(err, storage.ErrTooLarge) {
 			err = errors.Join(ErrFileTooLarge, err)
 		}
 		return err
 	}
+	return nil
+}
 
-	err = s3.NewObjectExistsWaiter(s3Client).Wait(ctx, &s3.HeadObjectInput{
-		Bucket: &app.S3BucketName,
-		Key:    &key,
-	}, time.Minute)
+// storeBlob makes the uploaded file data a blob.
+// If a blob with the same content is already stored, the file is linked to it instead,
+// and the caller should delete the file data once the transaction is committed.
+func (c *Creator) storeBlob(ctx context.Context, db executor, f *File, sha256Hex string, size int64) (stored bool, err error) {
+	blobDataKey, err := createOrLinkBlob(ctx, db, sha256Hex, size, f.DataKey)
 	if err != nil {
-		return err
+		return false, err
 	}
-
-	return nil
+	if _, err = updateFileBlob(ctx, db, f.ID, blobDataKey, sha256Hex, size); err != nil {
+		return false, err
+	}
+	return blobDataKey == f.DataKey, nil
 }
 
-func sendCreated(ctx context.Context, mq *app.AMQPClient, b *Build) error {
-	type message struct {
-		ID             uuid.UUID `json:"id"`
-		CreatedAt      time.Time `json:"created_at"`
-		IdempotencyKey uuid.UUID `json:"idempotency_key"`
-		UserID         uuid.UUID `json:"user_id"`
+// linkBlob increments the reference count of the blob if it is stored
+// and a file of the user already references it.
+// Checksums are declared by clients, so blobs of other users aren't linked:
+// their content could be obtained by knowing the checksum, and linked would tell that it is stored.
+func linkBlob(ctx context.Context, db executor, userID uuid.UUID, sha256Hex string, size int64) (dataKey string, linked bool, err error) {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count + 1
+		WHERE sha256 = $2 AND size = $3 AND EXISTS (
+			SELECT 1
+			FROM build_files f
+			JOIN builds b ON b.id = f.build_id
+			WHERE f.sha256 = blobs.sha256 AND f.data_key = blobs.data_key AND b.user_id = $1
+		)
+		RETURNING data_key
+	`
+	args := []any{userID, sha256Hex, size}
 
-		Status        string `json:"status"`
-		Error         string `json:"error"`
-		ExitCode      int    `json:"exit_code"`
-		LogDataKey    string `json:"log_data_key"`
-		OutputDataKey string `json:"output_data_key"`
+	rows, _ := db.Query(ctx, query, args...)
+	dataKey, err = pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, err
 	}
 
-	msg := message{
-		ID:             b.ID,
-		CreatedAt:      b.CreatedAt,
-		IdempotencyKey: b.IdempotencyKey,
-		UserID:         b.UserID,
+	return dataKey, true, nil
+}
+
+// linkFileBlob increments the reference count of the blob with the content of the file
+// if it is stored. The file data key isn't compared, so files of builds
+// completed from cache by Reserve before they got data keys are linked too.
+// The caller checks that the file belongs to the user.
+func linkFileBlob(ctx context.Context, db executor, fileID uuid.UUID) (dataKey string, linked bool, err error) {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count + 1
+		FROM build_files f
+		WHERE f.id = $1 AND blobs.sha256 = f.sha256 AND blobs.size = f.size
+		RETURNING blobs.data_key
+	`
+	args := []any{fileID}
 
-		Status:        string(b.Status),
-		Error:         string(b.Error),
-		ExitCode:      b.ExitCode,
-		LogDataKey:    b.LogDataKey,
-		OutputDataKey: b.OutputDataKey,
+	rows, _ := db.Query(ctx, query, args...)
+	dataKey, err = pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, err
 	}
-	msgBuf := new(bytes.Buffer)
-	if err := json.NewEncoder(msgBuf).Encode(msg); err != nil {
-		return err
+
+	return dataKey, true, nil
+}
+
+// createOrLinkBlob stores a blob with dataKey or increments the reference count
+// of the already stored blob. It returns the data key of the blob.
+func createOrLinkBlob(ctx context.Context, db executor, sha256Hex string, size int64, dataKey string) (string, error) {
+	query := `
+		INSERT INTO blobs (sha256, size, data_key, ref_count)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (sha256) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING data_key
+	`
+	args := []any{sha256Hex, size, dataKey}
+
+	rows, _ := db.Query(ctx, query, args...)
+	blobDataKey, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		return "", err
 	}
 
-	m := amqp091.Publishing{
-		ContentType: "application/json",
-		Body:        msgBuf.Bytes(),
+	return blobDataKey, nil
+}
+
+// getBlobDataKey returns the data key of the blob or an empty string if it isn't stored.
+func getBlobDataKey(ctx context.Context, db executor, sha256Hex string) (string, error) {
+	query := `
+		SELECT data_key
+		FROM blobs
+		WHERE sha256 = $1
+	`
+	args := []any{sha256Hex}
+
+	rows, _ := db.Query(ctx, query, args...)
+	dataKey, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
 	}
-	err := mq.Publish(ctx, "", "build.created", false, false, m)
+
+	return dataKey, nil
+}
+
+func updateFileBlob(ctx context.Context, db executor, id uuid.UUID, dataKey string, sha256Hex string, size int64) (*File, error) {
+	query := `
+		UPDATE build_files
+		SET data_key = $2, sha256 = $3, size = $4
+		WHERE id = $1
+		RETURNING id, build_id, name, type, data_key, size, sha256
+	`
+	args := []any{id, dataKey, sha256Hex, size}
+
+	rows, _ := db.Query(ctx, query, args...)
+	f, err := pgx.CollectExactlyOneRow(rows, rowToFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return f, nil
+}
+
+// decodeSHA256 decodes a hex-encoded SHA-256 checksum.
+func decodeSHA256(s string) ([]byte, error) {
+	sum, err := hex.DecodeString(s)
+	if err != nil || len(sum) != sha256.Size || s != strings.ToLower(s) {
+		return nil, ErrInvalidSHA256
+	}
+	return sum, nil
+}
+
+// hashObject returns the hex-encoded SHA-256 checksum of the object.
+func hashObject(ctx context.Context, stg storage.Storage, key string) (string, error) {
+	h := sha256.New()
+	if err := stg.Download(ctx, h, key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashReader computes the SHA-256 checksum and the size of the data read through it.
+type hashReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newHashReader(r io.Reader) *hashReader {
+	return &hashReader{r: r, hash: sha256.New()}
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.hash.Write(p[:n])
+	hr.size += int64(n)
+	return n, err
+}
+
+// SHA256 returns the hex-encoded checksum.
+func (hr *hashReader) SHA256() string {
+	return hex.EncodeToString(hr.hash.Sum(nil))
+}
+
+func (hr *hashReader) Size() int64 {
+	return hr.size
 }
 
 func rowToBuild(collectableRow pgx.CollectableRow) (*Build, error) {
@@ -417,6 +1922,30 @@ func rowToBuild(collectableRow pgx.CollectableRow) (*Build, error) {
 		ExitCode      *int    `db:"exit_code"`
 		LogDataKey    string  `db:"log_data_key"`
 		OutputDataKey string  `db:"output_data_key"`
+
+		Preset             string `db:"preset"`
+		TemplateFile       string `db:"template_file"`
+		HeaderIncludesFile string `db:"header_includes_file"`
+		BibliographyFile   string `db:"bibliography_file"`
+		CSL                string `db:"csl"`
+		Engine             string `db:"engine"`
+
+		InputHash    *string    `db:"input_hash"`
+		CachedFromID *uuid.UUID `db:"cached_from_id"`
+
+		InputsExpiredAt  *time.Time `db:"inputs_expired_at"`
+		OutputsExpiredAt *time.Time `db:"outputs_expired_at"`
+		LogsExpiredAt    *time.Time `db:"logs_expired_at"`
+
+		Labels           []string   `db:"labels"`
+		WallClockSeconds *float64   `db:"wall_clock_seconds"`
+		ParentBuildID    *uuid.UUID `db:"parent_build_id"`
+
+		StartedAt  *time.Time `db:"started_at"`
+		FinishedAt *time.Time `db:"finished_at"`
+		Stage      *string    `db:"stage"`
+
+		Priority string `db:"priority"`
 	}
 	collectedRow, err := pgx.RowToStructByName[row](collectableRow)
 	if err != nil {
@@ -441,6 +1970,70 @@ func rowToBuild(collectableRow pgx.CollectableRow) (*Build, error) {
 		exitCode = *collectedRow.ExitCode
 	}
 
+	preset, known := ParsePreset(collectedRow.Preset)
+	if !known {
+		slog.Warn("unknown preset", "preset", preset)
+	}
+
+	engine, known := ParseEngine(collectedRow.Engine)
+	if !known {
+		slog.Warn("unknown engine", "engine", engine)
+	}
+
+	var inputHash string
+	if collectedRow.InputHash != nil {
+		inputHash = *collectedRow.InputHash
+	}
+
+	var cachedFromID uuid.UUID
+	if collectedRow.CachedFromID != nil {
+		cachedFromID = *collectedRow.CachedFromID
+	}
+
+	var inputsExpiredAt, outputsExpiredAt, logsExpiredAt time.Time
+	if collectedRow.InputsExpiredAt != nil {
+		inputsExpiredAt = *collectedRow.InputsExpiredAt
+	}
+	if collectedRow.OutputsExpiredAt != nil {
+		outputsExpiredAt = *collectedRow.OutputsExpiredAt
+	}
+	if collectedRow.LogsExpiredAt != nil {
+		logsExpiredAt = *collectedRow.LogsExpiredAt
+	}
+
+	labels := collectedRow.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	var wallClockSeconds float64
+	if collectedRow.WallClockSeconds != nil {
+		wallClockSeconds = *collectedRow.WallClockSeconds
+	}
+
+	var parentBuildID uuid.UUID
+	if collectedRow.ParentBuildID != nil {
+		parentBuildID = *collectedRow.ParentBuildID
+	}
+
+	var startedAt, finishedAt time.Time
+	if collectedRow.StartedAt != nil {
+		startedAt = *collectedRow.StartedAt
+	}
+	if collectedRow.FinishedAt != nil {
+		finishedAt = *collectedRow.FinishedAt
+	}
+
+	var stage string
+	if collectedRow.Stage != nil {
+		stage = *collectedRow.Stage
+	}
+
+	priority, known := ParsePriority(collectedRow.Priority)
+	if !known {
+		slog.Warn("unknown priority", "priority", priority)
+	}
+
 	return &Build{
 		ID:             collectedRow.ID,
 		CreatedAt:      collectedRow.CreatedAt,
@@ -452,6 +2045,31 @@ func rowToBuild(collectableRow pgx.CollectableRow) (*Build, error) {
 		ExitCode:      exitCode,
 		LogDataKey:    collectedRow.LogDataKey,
 		OutputDataKey: collectedRow.OutputDataKey,
+
+		Preset:             preset,
+		TemplateFile:       collectedRow.TemplateFile,
+		HeaderIncludesFile: collectedRow.HeaderIncludesFile,
+		BibliographyFile:   collectedRow.BibliographyFile,
+		CSL:                collectedRow.CSL,
+		Engine:             engine,
+
+		InputHash:    inputHash,
+		CachedFromID: cachedFromID,
+
+		InputsExpiredAt:  inputsExpiredAt,
+		OutputsExpiredAt: outputsExpiredAt,
+		LogsExpiredAt:    logsExpiredAt,
+
+		Labels:           labels,
+		WallClockSeconds: wallClockSeconds,
+
+		ParentBuildID: parentBuildID,
+
+		StartedAt:  startedAt,
+		FinishedAt: finishedAt,
+		Stage:      stage,
+
+		Priority: priority,
 	}, nil
 }
 
@@ -460,9 +2078,11 @@ func rowToFile(collectableRow pgx.CollectableRow) (*File, error) {
 		ID      uuid.UUID `db:"id"`
 		BuildID uuid.UUID `db:"build_id"`
 
-		Name    string `db:"name"`
-		Type    string `db:"type"`
-		DataKey string `db:"data_key"`
+		Name    string  `db:"name"`
+		Type    string  `db:"type"`
+		DataKey string  `db:"data_key"`
+		Size    *int64  `db:"size"`
+		SHA256  *string `db:"sha256"`
 	}
 	collectedRow, err := pgx.RowToStructByName[row](collectableRow)
 	if err != nil {
@@ -474,6 +2094,15 @@ func rowToFile(collectableRow pgx.CollectableRow) (*File, error) {
 		slog.Warn("unknown file type", "file_type", typ)
 	}
 
+	size := int64(-1)
+	if collectedRow.Size != nil {
+		size = *collectedRow.Size
+	}
+	var sha256Hex string
+	if collectedRow.SHA256 != nil {
+		sha256Hex = *collectedRow.SHA256
+	}
+
 	f := &File{
 		ID:      collectedRow.ID,
 		BuildID: collectedRow.BuildID,
@@ -481,6 +2110,8 @@ func rowToFile(collectableRow pgx.CollectableRow) (*File, error) {
 		Name:    collectedRow.Name,
 		Type:    typ,
 		DataKey: collectedRow.DataKey,
+		Size:    size,
+		SHA256:  sha256Hex,
 	}
 	return f, nil
 }
@@ -0,0 +1,572 @@
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/k11v/brick/internal/app/apptest"
+	"github.com/k11v/brick/internal/storage"
+)
+
+func TestCreatorFinalize(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+
+	reserve := func(t *testing.T, userID uuid.UUID, data string) *Reservation {
+		t.Helper()
+		reservation, err := c.Reserve(ctx, &CreatorReserveParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			Files:          []*CreatorReserveFileParams{{Name: "main.md", Type: FileTypeRegular, Size: int64(len(data)), SHA256: testSHA256(data)}},
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := reservation.Build.Status, StatusReserved; got != want {
+			t.Fatalf("got %q status, want %q", got, want)
+		}
+		if got, want := len(reservation.Uploads), 1; got != want {
+			t.Fatalf("got %d uploads, want %d", got, want)
+		}
+		return reservation
+	}
+
+	t.Run("enqueues the build and stores uploads as blobs", func(t *testing.T) {
+		userID := uuid.New()
+		reservation := reserve(t, userID, "# Finalize")
+		if err := c.STG.Upload(ctx, reservation.Uploads[0].File.DataKey, strings.NewReader("# Finalize")); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		b, err := c.Finalize(ctx, &CreatorFinalizeParams{ID: reservation.Build.ID, UserID: userID})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := b.Status, StatusTodo; got != want {
+			t.Errorf("got %q status, want %q", got, want)
+		}
+		if got, want := testBlobRefCount(t, c.DB, testSHA256("# Finalize")), int64(1); got != want {
+			t.Errorf("got %d blob ref count, want %d", got, want)
+		}
+	})
+
+	t.Run("refuses uploads with other content", func(t *testing.T) {
+		userID := uuid.New()
+		reservation := reserve(t, userID, "# Declared")
+		if err := c.STG.Upload(ctx, reservation.Uploads[0].File.DataKey, strings.NewReader("# Uploaded")); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		_, err := c.Finalize(ctx, &CreatorFinalizeParams{ID: reservation.Build.ID, UserID: userID})
+		if !errors.Is(err, ErrFileChecksumMismatch) {
+			t.Fatalf("got %v err, want %q", err, ErrFileChecksumMismatch)
+		}
+		b, err := getBuild(ctx, c.DB, reservation.Build.ID)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := b.Status, StatusReserved; got != want {
+			t.Errorf("got %q status, want %q", got, want)
+		}
+		if got, want := testBlobRefCount(t, c.DB, testSHA256("# Declared")), int64(0); got != want {
+			t.Errorf("got %d blob ref count, want %d", got, want)
+		}
+	})
+
+	t.Run("refuses missing uploads", func(t *testing.T) {
+		userID := uuid.New()
+		reservation := reserve(t, userID, "# Missing")
+
+		_, err := c.Finalize(ctx, &CreatorFinalizeParams{ID: reservation.Build.ID, UserID: userID})
+		if !errors.Is(err, ErrFileNotUploaded) {
+			t.Fatalf("got %v err, want %q", err, ErrFileNotUploaded)
+		}
+	})
+
+	t.Run("refuses other users", func(t *testing.T) {
+		reservation := reserve(t, uuid.New(), "# Other")
+
+		_, err := c.Finalize(ctx, &CreatorFinalizeParams{ID: reservation.Build.ID, UserID: uuid.New()})
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("got %v err, want %q", err, ErrAccessDenied)
+		}
+	})
+}
+
+func TestCreatorBlobs(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+
+	create := func(t *testing.T, userID uuid.UUID, data string) *Build {
+		t.Helper()
+		b, err := c.Create(ctx, &CreatorCreateParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			Files:          testFiles("main.md", data),
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		return b
+	}
+
+	t.Run("stores files with the same content once", func(t *testing.T) {
+		userID := uuid.New()
+		first := create(t, userID, "# Same")
+		second := create(t, userID, "# Same")
+
+		if got, want := testBlobRefCount(t, c.DB, testSHA256("# Same")), int64(2); got != want {
+			t.Errorf("got %d blob ref count, want %d", got, want)
+		}
+		firstFile := testRegularFile(t, c.DB, first.ID)
+		secondFile := testRegularFile(t, c.DB, second.ID)
+		if firstFile.DataKey != secondFile.DataKey {
+			t.Errorf("got %q and %q data keys, want the same", firstFile.DataKey, secondFile.DataKey)
+		}
+		for info, err := range c.STG.List(ctx, fmt.Sprintf("builds/%s/input/", second.ID)) {
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			t.Errorf("got %s duplicate upload, want it deleted", info.Key)
+		}
+	})
+
+	t.Run("links blobs of the user in reservations", func(t *testing.T) {
+		userID := uuid.New()
+		create(t, userID, "# Linked")
+
+		reservation, err := c.Reserve(ctx, &CreatorReserveParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			Files:          []*CreatorReserveFileParams{{Name: "main.md", Type: FileTypeRegular, Size: int64(len("# Linked")), SHA256: testSHA256("# Linked")}},
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got := len(reservation.Uploads); got != 0 {
+			t.Errorf("got %d uploads, want 0", got)
+		}
+		if got, want := testBlobRefCount(t, c.DB, testSHA256("# Linked")), int64(2); got != want {
+			t.Errorf("got %d blob ref count, want %d", got, want)
+		}
+	})
+
+	t.Run("doesn't link blobs of other users in reservations", func(t *testing.T) {
+		create(t, uuid.New(), "# Private")
+
+		reservation, err := c.Reserve(ctx, &CreatorReserveParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         uuid.New(),
+			Files:          []*CreatorReserveFileParams{{Name: "main.md", Type: FileTypeRegular, Size: int64(len("# Private")), SHA256: testSHA256("# Private")}},
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := len(reservation.Uploads), 1; got != want {
+			t.Errorf("got %d uploads, want %d", got, want)
+		}
+		if got, want := testBlobRefCount(t, c.DB, testSHA256("# Private")), int64(1); got != want {
+			t.Errorf("got %d blob ref count, want %d", got, want)
+		}
+	})
+}
+
+func TestCreatorCache(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+
+	create := func(t *testing.T, userID uuid.UUID, data string, noCache bool) *Build {
+		t.Helper()
+		b, err := c.Create(ctx, &CreatorCreateParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			Files:          testFiles("main.md", data),
+			NoCache:        noCache,
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		return b
+	}
+
+	t.Run("completes builds with outputs of a successful build with the same inputs", func(t *testing.T) {
+		userID := uuid.New()
+		cached := create(t, userID, "# Cached", false)
+		testFinishBuild(t, c.DB, cached.ID, 0)
+
+		b := create(t, userID, "# Cached", false)
+		if got, want := b.Status, StatusDone; got != want {
+			t.Fatalf("got %q status, want %q", got, want)
+		}
+		if got, want := b.CachedFromID, cached.ID; got != want {
+			t.Errorf("got %s cached from ID, want %s", got, want)
+		}
+		if got, want := b.OutputDataKey, cached.OutputDataKey; got != want {
+			t.Errorf("got %q output data key, want %q", got, want)
+		}
+		if got, want := b.InputHash, cached.InputHash; got != want || got == "" {
+			t.Errorf("got %q input hash, want %q", got, want)
+		}
+	})
+
+	t.Run("doesn't complete builds with other inputs, failed builds or builds of other users", func(t *testing.T) {
+		userID := uuid.New()
+		failed := create(t, userID, "# Failed", false)
+		testFinishBuild(t, c.DB, failed.ID, 1)
+		other := create(t, uuid.New(), "# Other", false)
+		testFinishBuild(t, c.DB, other.ID, 0)
+		done := create(t, userID, "# Done", false)
+		testFinishBuild(t, c.DB, done.ID, 0)
+
+		for _, data := range []string{"# Failed", "# Other", "# Done, edited"} {
+			b := create(t, userID, data, false)
+			if got, want := b.Status, StatusTodo; got != want {
+				t.Errorf("got %q status for %q, want %q", got, data, want)
+			}
+		}
+	})
+
+	t.Run("doesn't complete builds without cache", func(t *testing.T) {
+		userID := uuid.New()
+		cached := create(t, userID, "# No cache", false)
+		testFinishBuild(t, c.DB, cached.ID, 0)
+
+		b := create(t, userID, "# No cache", true)
+		if got, want := b.Status, StatusTodo; got != want {
+			t.Errorf("got %q status, want %q", got, want)
+		}
+	})
+}
+
+func TestCreatorIdempotency(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+
+	t.Run("replays requests with a used key", func(t *testing.T) {
+		userID := uuid.New()
+		key := uuid.New()
+		params := func() *CreatorCreateParams {
+			return &CreatorCreateParams{
+				IdempotencyKey: key,
+				UserID:         userID,
+				Files:          testFiles("main.md", "# Replayed"),
+			}
+		}
+		first, err := c.Create(ctx, params())
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if first.Replayed {
+			t.Errorf("got replayed first build")
+		}
+
+		second, err := c.Create(ctx, params())
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := second.ID, first.ID; got != want {
+			t.Errorf("got %s ID, want %s", got, want)
+		}
+		if !second.Replayed {
+			t.Errorf("got unreplayed second build")
+		}
+		if got, want := testCountBuilds(t, c.DB, userID), int64(1); got != want {
+			t.Errorf("got %d builds, want %d", got, want)
+		}
+	})
+
+	t.Run("refuses other requests with a used key", func(t *testing.T) {
+		userID := uuid.New()
+		key := uuid.New()
+		_, err := c.Create(ctx, &CreatorCreateParams{IdempotencyKey: key, UserID: userID, Files: testFiles("main.md", "# First")})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		_, err = c.Create(ctx, &CreatorCreateParams{IdempotencyKey: key, UserID: userID, Files: testFiles("main.md", "# Second")})
+		if !errors.Is(err, ErrIdempotencyKeyAlreadyUsed) {
+			t.Fatalf("got %v err, want %q", err, ErrIdempotencyKeyAlreadyUsed)
+		}
+		if got, want := testCountBuilds(t, c.DB, userID), int64(1); got != want {
+			t.Errorf("got %d builds, want %d", got, want)
+		}
+	})
+
+	t.Run("doesn't share keys between users", func(t *testing.T) {
+		key := uuid.New()
+		first, err := c.Create(ctx, &CreatorCreateParams{IdempotencyKey: key, UserID: uuid.New(), Files: testFiles("main.md", "# Shared")})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		second, err := c.Create(ctx, &CreatorCreateParams{IdempotencyKey: key, UserID: uuid.New(), Files: testFiles("main.md", "# Shared")})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if second.ID == first.ID || second.Replayed {
+			t.Errorf("got replayed build of another user")
+		}
+	})
+
+	t.Run("replays reservations with their remaining uploads", func(t *testing.T) {
+		params := &CreatorReserveParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         uuid.New(),
+			Files:          []*CreatorReserveFileParams{{Name: "main.md", Type: FileTypeRegular, Size: int64(len("# Reserved")), SHA256: testSHA256("# Reserved")}},
+		}
+		first, err := c.Reserve(ctx, params)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		second, err := c.Reserve(ctx, params)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := second.Build.ID, first.Build.ID; got != want {
+			t.Errorf("got %s ID, want %s", got, want)
+		}
+		if got, want := len(second.Uploads), 1; got != want {
+			t.Fatalf("got %d uploads, want %d", got, want)
+		}
+		if got, want := second.Uploads[0].File.DataKey, first.Uploads[0].File.DataKey; got != want {
+			t.Errorf("got %q upload data key, want %q", got, want)
+		}
+	})
+}
+
+func TestCreatorRerun(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+
+	createParent := func(t *testing.T, userID uuid.UUID, mainData string) *Build {
+		t.Helper()
+		b, err := c.Create(ctx, &CreatorCreateParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			Files:          testFiles("main.md", mainData, "chapter.md", "# Chapter of "+mainData),
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		return b
+	}
+
+	t.Run("links kept files to blobs of the parent build", func(t *testing.T) {
+		userID := uuid.New()
+		parent := createParent(t, userID, "# Parent")
+
+		b, err := c.Rerun(ctx, &CreatorRerunParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			ParentID:       parent.ID,
+			Files:          testFiles("main.md", "# Replaced"),
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := b.ParentBuildID, parent.ID; got != want {
+			t.Errorf("got %s parent build ID, want %s", got, want)
+		}
+		if got, want := b.Status, StatusTodo; got != want {
+			t.Errorf("got %q status, want %q", got, want)
+		}
+
+		parentFiles, err := getFiles(ctx, c.DB, parent.ID)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		files, err := getFiles(ctx, c.DB, b.ID)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := len(files), 2; got != want {
+			t.Fatalf("got %d files, want %d", got, want)
+		}
+		// Files are ordered by name, so chapter.md is first.
+		if got, want := files[0].DataKey, parentFiles[0].DataKey; got != want {
+			t.Errorf("got %q chapter.md data key, want %q of the parent", got, want)
+		}
+		if got, want := files[1].SHA256, testSHA256("# Replaced"); got != want {
+			t.Errorf("got %q main.md checksum, want %q", got, want)
+		}
+		if got, want := testBlobRefCount(t, c.DB, testSHA256("# Chapter of # Parent")), int64(2); got != want {
+			t.Errorf("got %d chapter.md blob ref count, want %d", got, want)
+		}
+	})
+
+	t.Run("completes unchanged reruns of successful builds from cache", func(t *testing.T) {
+		userID := uuid.New()
+		parent := createParent(t, userID, "# Unchanged")
+		testFinishBuild(t, c.DB, parent.ID, 0)
+
+		b, err := c.Rerun(ctx, &CreatorRerunParams{IdempotencyKey: uuid.New(), UserID: userID, ParentID: parent.ID})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := b.CachedFromID, parent.ID; got != want {
+			t.Errorf("got %s cached from ID, want %s", got, want)
+		}
+	})
+
+	t.Run("replays reruns with a used key", func(t *testing.T) {
+		userID := uuid.New()
+		parent := createParent(t, userID, "# Replayed rerun")
+		key := uuid.New()
+
+		first, err := c.Rerun(ctx, &CreatorRerunParams{IdempotencyKey: key, UserID: userID, ParentID: parent.ID})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		second, err := c.Rerun(ctx, &CreatorRerunParams{IdempotencyKey: key, UserID: userID, ParentID: parent.ID})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := second.ID, first.ID; got != want || !second.Replayed {
+			t.Errorf("got %s ID replayed %t, want %s replayed", got, second.Replayed, want)
+		}
+	})
+
+	t.Run("refuses parents with expired inputs", func(t *testing.T) {
+		userID := uuid.New()
+		parent := createParent(t, userID, "# Expired")
+		_, err := c.DB.Exec(ctx, "UPDATE builds SET inputs_expired_at = now() WHERE id = $1", parent.ID)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		_, err = c.Rerun(ctx, &CreatorRerunParams{IdempotencyKey: uuid.New(), UserID: userID, ParentID: parent.ID})
+		if !errors.Is(err, ErrExpired) {
+			t.Errorf("got %v err, want %q", err, ErrExpired)
+		}
+	})
+
+	t.Run("refuses parents of other users", func(t *testing.T) {
+		parent := createParent(t, uuid.New(), "# Other user")
+
+		_, err := c.Rerun(ctx, &CreatorRerunParams{IdempotencyKey: uuid.New(), UserID: uuid.New(), ParentID: parent.ID})
+		if !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("got %v err, want %q", err, ErrAccessDenied)
+		}
+	})
+}
+
+// presignFS is storage.FS that presigns uploads, so Reserve can be tested without S3.
+// Presigned requests aren't sent, tests upload data with Upload instead.
+type presignFS struct {
+	*storage.FS
+}
+
+func (s *presignFS) PresignPut(_ context.Context, key string, _ *storage.PresignPutParams) (*storage.PresignedRequest, error) {
+	return &storage.PresignedRequest{URL: "file:///" + key}, nil
+}
+
+// newTestCreator returns a Creator with Postgres started by apptest, storage in a temporary directory
+// and PostgresQueue, so sent builds stay in the database. Quotas of the default plan are unlimited.
+func newTestCreator(t *testing.T) *Creator {
+	t.Helper()
+	db := apptest.NewPostgresPool(t)
+
+	err := NewQuotaSetter(db).SetPlan(context.Background(), &QuotaSetterSetPlanParams{
+		Name:             "default",
+		Window:           24 * time.Hour,
+		Builds:           -1,
+		ConcurrentBuilds: -1,
+		RunningBuilds:    -1,
+		WallClockSeconds: -1,
+		StoredBytes:      -1,
+	})
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+
+	stg := &presignFS{FS: storage.NewFS(t.TempDir())}
+	return NewCreator(db, NewPostgresQueue(db), stg, &CreatorParams{ImageVersion: "test"})
+}
+
+// testFiles returns regular files from name and data pairs.
+func testFiles(nameDataPairs ...string) iter.Seq2[*CreatorCreateFileParams, error] {
+	return func(yield func(*CreatorCreateFileParams, error) bool) {
+		for i := 0; i+1 < len(nameDataPairs); i += 2 {
+			f := &CreatorCreateFileParams{
+				Name:       nameDataPairs[i],
+				Type:       FileTypeRegular,
+				DataReader: strings.NewReader(nameDataPairs[i+1]),
+			}
+			if !yield(f, nil) {
+				return
+			}
+		}
+	}
+}
+
+// testFinishBuild marks the build done with the exit code like Doer does.
+func testFinishBuild(t *testing.T, db *pgxpool.Pool, id uuid.UUID, exitCode int) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := updateExitCode(ctx, db, id, exitCode); err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	var errorValue Error
+	if exitCode != 0 {
+		errorValue = ErrorExitedWithNonZero
+	}
+	if _, err := updateStatus(ctx, db, id, StatusDone, errorValue); err != nil {
+		t.Fatalf("got %q err", err)
+	}
+}
+
+// testRegularFile returns the only regular file of the build.
+func testRegularFile(t *testing.T, db *pgxpool.Pool, buildID uuid.UUID) *File {
+	t.Helper()
+	files, err := getFiles(context.Background(), db, buildID)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	var regularFiles []*File
+	for _, f := range files {
+		if f.Type == FileTypeRegular {
+			regularFiles = append(regularFiles, f)
+		}
+	}
+	if len(regularFiles) != 1 {
+		t.Fatalf("got %d regular files, want 1", len(regularFiles))
+	}
+	return regularFiles[0]
+}
+
+func testSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func testCountBuilds(t *testing.T, db *pgxpool.Pool, userID uuid.UUID) int64 {
+	t.Helper()
+	var n int64
+	err := db.QueryRow(context.Background(), "SELECT count(*) FROM builds WHERE user_id = $1", userID).Scan(&n)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	return n
+}
+
+// testBlobRefCount returns the reference count of the blob or 0 if it isn't stored.
+func testBlobRefCount(t *testing.T, db *pgxpool.Pool, sha256Hex string) int64 {
+	t.Helper()
+	var refCount int64
+	err := db.QueryRow(context.Background(), "SELECT coalesce(sum(ref_count), 0)::bigint FROM blobs WHERE sha256 = $1", sha256Hex).Scan(&refCount)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	return refCount
+}
@@ -1,17 +1,14 @@
 package build
 
 import (
-	"archive/tar"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"path"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/strslice"
@@ -22,11 +19,29 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
-	"github.com/k11v/brick/internal/app"
+	"github.com/k11v/brick/internal/buildlog"
+	"github.com/k11v/brick/internal/storage"
 )
 
 var ErrNotFound = errors.New("not found")
 
+// Diagnostic is a message parsed from the build log.
+// See [buildlog.Diagnostic].
+type Diagnostic struct {
+	ID      uuid.UUID
+	BuildID uuid.UUID
+
+	Severity buildlog.Severity
+	File     string
+	Line     int // 0 if unknown
+	Message  string
+	Stage    string
+}
+
+// StageUpload is the build stage in which Doer uploads the output.
+// Other stages are named after their "$ <stage>" lines in the build log.
+const StageUpload = "upload"
+
 type ExitError struct {
 	ExitCode int
 }
@@ -37,10 +52,10 @@ func (e *ExitError) Error() string {
 
 type Doer struct {
 	DB  *pgxpool.Pool
-	STG *s3.Client
+	STG storage.Storage
 }
 
-func NewDoer(db *pgxpool.Pool, stg *s3.Client) *Doer {
+func NewDoer(db *pgxpool.Pool, stg storage.Storage) *Doer {
 	return &Doer{
 		DB:  db,
 		STG: stg,
@@ -51,6 +66,9 @@ type DoerDoParams struct {
 	ID uuid.UUID
 }
 
+// Do runs the build to do.
+// It returns an error wrapping ErrLimitExceeded if the user already runs as many builds
+// as their running builds limit allows, the build stays to do then and can be done later.
 func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 	tx, err := r.DB.Begin(ctx)
 	if err != nil {
@@ -61,11 +79,16 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 	}()
 
 	// Get build for status update to doing.
-	b, err := getForUpdate(ctx, r.DB, params.ID)
+	b, err := getForUpdate(ctx, tx, params.ID)
 	if err != nil {
 		return nil, fmt.Errorf("build.Doer: %w", err)
 	}
 
+	// If build files aren't uploaded yet, return.
+	if b.Status == StatusReserved {
+		return nil, fmt.Errorf("build.Doer: %w", ErrReserved)
+	}
+
 	// If build is being done, return.
 	if b.Status == StatusDoing {
 		return nil, fmt.Errorf("build.Doer: %w", ErrAlreadyDoing)
@@ -76,8 +99,51 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 		return nil, fmt.Errorf("build.Doer: %w", ErrAlreadyDone)
 	}
 
+	return r.do(ctx, tx, b)
+}
+
+// DoNext runs the next build to do like Do.
+// Builds are taken by their priority, then builds of users running fewer builds are preferred,
+// then older builds are preferred. Builds of users at their running builds limit are skipped.
+// Builds locked by other transactions are skipped, so DoNext can run concurrently with itself.
+// It returns an error wrapping ErrNotFound if there is no build to do.
+func (r *Doer) DoNext(ctx context.Context) (*Build, error) {
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// Get next build for status update to doing.
+	b, err := getNextForUpdate(ctx, tx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+
+	return r.do(ctx, tx, b)
+}
+
+// do updates the status of the build locked by tx to doing, commits tx and runs the build.
+func (r *Doer) do(ctx context.Context, tx pgx.Tx, b *Build) (*Build, error) {
+	// Check that the user can start another build.
+	// Builds of the user are locked, so concurrent Doers don't exceed the limit.
+	err := lockBuilds(ctx, tx, b.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+	err = checkRunningBuilds(ctx, tx, b.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+
 	// Update build status to doing.
-	b, err = updateStatus(ctx, tx, params.ID, StatusDoing, "")
+	b, err = updateStatus(ctx, tx, b.ID, StatusDoing, "")
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+	err = createBuildEvent(ctx, tx, BuildEventStarted, b)
 	if err != nil {
 		return nil, fmt.Errorf("build.Doer: %w", err)
 	}
@@ -106,63 +172,30 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 			}
 		}()
 
-		tw := tar.NewWriter(inputTarWriter)
-		defer func() {
-			err := tw.Close()
-			if err != nil {
-				slog.Error("didn't close tar.Writer", "error", err)
-			}
-		}()
-		dirExist := make(map[string]struct{})
-
-		for _, buildInputFile := range files {
-			dir := buildInputFile.Name
-			for {
-				nextDir := path.Dir(dir)
-				if nextDir == dir {
-					break
-				}
-				dir = nextDir
-
-				if _, exist := dirExist[dir]; !exist {
-					err = tw.WriteHeader(&tar.Header{
-						Typeflag: tar.TypeDir,
-						Name:     dir,
-						Mode:     0o777, // TODO: Check mode.
-					})
-					if err != nil {
-						inputTarErrCh <- err
-						return
-					}
-					dirExist[dir] = struct{}{}
-				}
-			}
-
-			var buf bytes.Buffer
-			err = downloadData(ctx, r.STG, &buf, buildInputFile.DataKey)
-			if err != nil {
-				inputTarErrCh <- err
-				return
-			}
-			err = tw.WriteHeader(&tar.Header{
-				Typeflag: tar.TypeReg,
-				Name:     buildInputFile.Name,
-				Mode:     0o666, // TODO: Check mode.
-				Size:     int64(buf.Len()),
-			})
-			if err != nil {
-				inputTarErrCh <- err
-				return
-			}
-			_, err = tw.Write(buf.Bytes())
-			if err != nil {
-				inputTarErrCh <- err
-				return
-			}
+		err := writeArchive(ctx, inputTarWriter, r.STG, files, ArchiveFormatTar)
+		if err != nil {
+			inputTarErrCh <- err
+			return
 		}
 	}()
 
 	// Do.
+	stages := newStageRecorder(func(stage string) {
+		err := updateStage(ctx, r.DB, b.ID, stage)
+		if err != nil {
+			slog.Error("didn't update stage", "id", b.ID, "stage", stage, "error", err)
+		}
+	})
+	logParser := buildlog.NewParser()
+	logParser.OnStage = func(logStage string) {
+		// The cat output container uploads the output.
+		stage := logStage
+		if stage == "cat" {
+			stage = StageUpload
+		}
+		stages.Set(stage)
+	}
+	buildWallClockSeconds := 0.0
 	err = func() error {
 		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 		if err != nil {
@@ -174,13 +207,15 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 		defer func() {
 			<-uploadLogDone
 		}()
-		logReader, logWriter := io.Pipe()
+		// It also parses the log into diagnostics.
+		logReader, logPipeWriter := io.Pipe()
 		defer func() {
-			err := logWriter.Close()
+			err := logPipeWriter.Close()
 			if err != nil {
-				slog.Error("didn't close logWriter", "error", err)
+				slog.Error("didn't close logPipeWriter", "error", err)
 			}
 		}()
+		logWriter := io.MultiWriter(logPipeWriter, logParser)
 		go func() {
 			defer close(uploadLogDone)
 			err := uploadFileData(ctx, r.STG, b.LogDataKey, logReader)
@@ -328,16 +363,20 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 				&container.Config{
 					Image:      "brick-build",
 					Entrypoint: strslice.StrSlice{},
-					Cmd: strslice.StrSlice{
-						"sh",
-						"-c",
-						`
-							set -e
-							cd /user/input
-							mkdir /user/output
-							exec build -i main.md -o /user/output/main.pdf -c /user/cache
-						`,
-					},
+					Cmd: append(
+						strslice.StrSlice{
+							"sh",
+							"-c",
+							`
+								set -e
+								cd /user/input
+								mkdir /user/output
+								exec build -i main.md -o /user/output/main.pdf -c /user/cache "$@"
+							`,
+							"sh",
+						},
+						buildArgs(b)...,
+					),
 					AttachStdout: true,
 					AttachStderr: true,
 				},
@@ -401,6 +440,7 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 			if buildContInspect.State.Status != "exited" {
 				return errors.New("didn't exit")
 			}
+			buildWallClockSeconds = containerWallClockSeconds(buildContInspect.State)
 			if buildContInspect.State.ExitCode != 0 {
 				return &ExitError{ExitCode: buildContInspect.State.ExitCode}
 			}
@@ -525,6 +565,8 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 
 		return nil
 	}()
+	// The log isn't written anymore, so the latest stage is written before the build is done.
+	stages.Close()
 	exitCode := 0
 	if exitErr := (*ExitError)(nil); errors.As(err, &exitErr) {
 		exitCode = exitErr.ExitCode
@@ -539,6 +581,18 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 		return nil, fmt.Errorf("build.Doer: %w", err)
 	}
 
+	// Create build diagnostics.
+	err = createDiagnostics(ctx, r.DB, b.ID, logParser.Diagnostics())
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+
+	// Record the build container wall-clock time for quotas.
+	err = updateWallClockSeconds(ctx, r.DB, b.ID, buildWallClockSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+
 	// Update build exit code.
 	b, err = updateExitCode(ctx, r.DB, b.ID, exitCode)
 	if err != nil {
@@ -550,7 +604,22 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 	if exitCode != 0 {
 		errorValue = ErrorExitedWithNonZero
 	}
-	b, err = updateStatus(ctx, r.DB, b.ID, StatusDone, errorValue)
+	tx, err = r.DB.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+	b, err = updateStatus(ctx, tx, b.ID, StatusDone, errorValue)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+	err = createBuildEvent(ctx, tx, BuildEventFinished, b)
+	if err != nil {
+		return nil, fmt.Errorf("build.Doer: %w", err)
+	}
+	err = tx.Commit(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("build.Doer: %w", err)
 	}
@@ -558,9 +627,103 @@ func (r *Doer) Do(ctx context.Context, params *DoerDoParams) (*Build, error) {
 	return b, nil
 }
 
+// stageRecorder writes the latest stage of the build log in a goroutine,
+// so the log isn't blocked by the database. Stages that are passed
+// before the previous write completes are skipped.
+type stageRecorder struct {
+	write func(stage string)
+
+	mu      sync.Mutex
+	stage   string
+	changed chan struct{} // buffered, a pending value means stage wasn't written
+	done    chan struct{}
+}
+
+func newStageRecorder(write func(stage string)) *stageRecorder {
+	s := &stageRecorder{
+		write:   write,
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Set records the stage without waiting for it to be written.
+// It must not be called after Close.
+func (s *stageRecorder) Set(stage string) {
+	s.mu.Lock()
+	s.stage = stage
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Close writes the latest stage if it wasn't written and waits for the goroutine to stop.
+func (s *stageRecorder) Close() {
+	close(s.changed)
+	<-s.done
+}
+
+func (s *stageRecorder) run() {
+	defer close(s.done)
+	written := ""
+	for range s.changed {
+		s.mu.Lock()
+		stage := s.stage
+		s.mu.Unlock()
+
+		if stage == written {
+			continue
+		}
+		s.write(stage)
+		written = stage
+	}
+}
+
+// containerWallClockSeconds returns how long the exited container ran in wall-clock time.
+// Docker doesn't report CPU time of exited containers, so quotas limit the wall-clock time instead:
+// a build that idles counts the same as a build that uses every core.
+// It returns 0 if the times can't be parsed.
+func containerWallClockSeconds(state *container.State) float64 {
+	startedAt, err := time.Parse(time.RFC3339Nano, state.StartedAt)
+	if err != nil {
+		return 0
+	}
+	finishedAt, err := time.Parse(time.RFC3339Nano, state.FinishedAt)
+	if err != nil || finishedAt.Before(startedAt) {
+		return 0
+	}
+	return finishedAt.Sub(startedAt).Seconds()
+}
+
+// buildArgs returns build command flags for the build options.
+// They are passed to the shell as positional parameters to avoid quoting.
+func buildArgs(b *Build) []string {
+	args := []string{"-preset", string(b.Preset), "-engine", string(b.Engine)}
+	if b.TemplateFile != "" {
+		args = append(args, "-template", b.TemplateFile)
+	}
+	if b.HeaderIncludesFile != "" {
+		args = append(args, "-header-includes", b.HeaderIncludesFile)
+	}
+	if b.BibliographyFile != "" {
+		args = append(args, "-bibliography", b.BibliographyFile)
+	}
+	if b.CSL != "" {
+		args = append(args, "-csl", b.CSL)
+	}
+	return args
+}
+
 func getBuild(ctx context.Context, db executor, id uuid.UUID) (*Build, error) {
 	query := `
-		SELECT id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key
+		SELECT id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		       preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		       inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
 		FROM builds
 		WHERE id = $1
 	`
@@ -578,9 +741,46 @@ func getBuild(ctx context.Context, db executor, id uuid.UUID) (*Build, error) {
 	return b, nil
 }
 
+// getNextForUpdate returns the next build to do for DoNext.
+// It returns ErrNotFound if there is none.
+func getNextForUpdate(ctx context.Context, db executor) (*Build, error) {
+	query := `
+		SELECT b.id, b.created_at, b.idempotency_key, b.user_id, b.status, b.error, b.exit_code, b.log_data_key, b.output_data_key,
+		       b.preset, b.template_file, b.header_includes_file, b.bibliography_file, b.csl, b.engine, b.input_hash, b.cached_from_id,
+		       b.inputs_expired_at, b.outputs_expired_at, b.logs_expired_at, b.labels, b.wall_clock_seconds, b.parent_build_id, b.started_at, b.finished_at, b.stage, b.priority
+		FROM builds b
+		LEFT JOIN user_quotas q ON q.user_id = b.user_id
+		LEFT JOIN quota_plans p ON p.name = coalesce(q.plan_name, 'default')
+		LEFT JOIN (
+			SELECT user_id, count(*) AS running
+			FROM builds
+			WHERE status = $2
+			GROUP BY user_id
+		) r ON r.user_id = b.user_id
+		WHERE b.status = $1
+		  AND (coalesce(q.running_builds, p.running_builds) IS NULL
+		       OR coalesce(r.running, 0) < coalesce(q.running_builds, p.running_builds))
+		ORDER BY b.priority = $3, coalesce(r.running, 0), b.created_at
+		LIMIT 1
+		FOR UPDATE OF b SKIP LOCKED
+	`
+	args := []any{string(StatusTodo), string(StatusDoing), string(PriorityBatch)}
+
+	rows, _ := db.Query(ctx, query, args...)
+	b, err := pgx.CollectExactlyOneRow(rows, rowToBuild)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return b, nil
+}
+
 func getFiles(ctx context.Context, db executor, buildID uuid.UUID) ([]*File, error) {
 	query := `
-		SELECT id, build_id, name, type, data_key
+		SELECT id, build_id, name, type, data_key, size, sha256
 		FROM build_files
 		WHERE build_id = $1
 		ORDER BY name, build_id
@@ -596,38 +796,80 @@ func getFiles(ctx context.Context, db executor, buildID uuid.UUID) ([]*File, err
 	return files, nil
 }
 
-// downloadPartSize should be greater than or equal 5MB.
-// See github.com/aws/aws-sdk-go-v2/feature/s3/manager.
-const downloadPartSize = 10 * 1024 * 1024 // 10MB
-
-func downloadData(ctx context.Context, s3Client *s3.Client, w io.Writer, key string) error {
-	downloader := manager.NewDownloader(s3Client, func(d *manager.Downloader) {
-		d.PartSize = int64(downloadPartSize)
-		d.Concurrency = 1
-	})
+func getDiagnostics(ctx context.Context, db executor, buildID uuid.UUID) ([]*Diagnostic, error) {
+	query := `
+		SELECT id, build_id, severity, file, line, message, stage
+		FROM build_diagnostics
+		WHERE build_id = $1
+		ORDER BY position
+	`
+	args := []any{buildID}
 
-	// fakeWriterAt needs manager.Downloader.Concurrency set to 1.
-	_, err := downloader.Download(ctx, fakeWriterAt{w}, &s3.GetObjectInput{
-		Bucket: &app.S3BucketName,
-		Key:    &key,
-	})
+	rows, _ := db.Query(ctx, query, args...)
+	diagnostics, err := pgx.CollectRows(rows, rowToDiagnostic)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return diagnostics, nil
 }
 
-// fakeWriterAt wraps an io.Writer to provide a fake WriteAt method.
-// This method simply calls w.Write ignoring the offset parameter.
-// It can be used with github.com/aws/aws-sdk-go-v2/feature/s3/manager.Downloader.Download
-// if its concurrency is set to 1 because this guarantees the sequential writes.
-type fakeWriterAt struct {
-	w io.Writer // required
+func createDiagnostics(ctx context.Context, db executor, buildID uuid.UUID, diagnostics []*buildlog.Diagnostic) error {
+	query := `
+		INSERT INTO build_diagnostics (build_id, position, severity, file, line, message, stage)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	batch := &pgx.Batch{}
+	for i, d := range diagnostics {
+		var lineArg *int
+		if d.Line > 0 {
+			lineArg = new(int)
+			*lineArg = d.Line
+		}
+		args := []any{buildID, i, string(d.Severity), d.File, lineArg, d.Message, d.Stage}
+		batch.Queue(query, args...)
+	}
+
+	return db.SendBatch(ctx, batch).Close()
 }
 
-func (writerAt fakeWriterAt) WriteAt(p []byte, _ int64) (n int, err error) {
-	return writerAt.w.Write(p)
+func rowToDiagnostic(collectableRow pgx.CollectableRow) (*Diagnostic, error) {
+	type row struct {
+		ID      uuid.UUID `db:"id"`
+		BuildID uuid.UUID `db:"build_id"`
+
+		Severity string `db:"severity"`
+		File     string `db:"file"`
+		Line     *int   `db:"line"`
+		Message  string `db:"message"`
+		Stage    string `db:"stage"`
+	}
+	collectedRow, err := pgx.RowToStructByName[row](collectableRow)
+	if err != nil {
+		return nil, err
+	}
+
+	severity, known := buildlog.ParseSeverity(collectedRow.Severity)
+	if !known {
+		slog.Warn("unknown severity", "severity", severity)
+	}
+
+	line := 0
+	if collectedRow.Line != nil {
+		line = *collectedRow.Line
+	}
+
+	return &Diagnostic{
+		ID:      collectedRow.ID,
+		BuildID: collectedRow.BuildID,
+
+		Severity: severity,
+		File:     collectedRow.File,
+		Line:     line,
+		Message:  collectedRow.Message,
+		Stage:    collectedRow.Stage,
+	}, nil
 }
 
 // If exitCode is negative, updateExitCode sets it to NULL.
@@ -642,7 +884,9 @@ func updateExitCode(ctx context.Context, db executor, id uuid.UUID, exitCode int
 		UPDATE builds
 		SET exit_code = $2
 		WHERE id = $1
-		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key
+		RETURNING id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		          preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		          inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
 	`
 	args := []any{id, exitCodeArg}
 
@@ -654,3 +898,16 @@ func updateExitCode(ctx context.Context, db executor, id uuid.UUID, exitCode int
 
 	return b, nil
 }
+
+// updateStage sets the build stage.
+func updateStage(ctx context.Context, db executor, id uuid.UUID, stage string) error {
+	query := `
+		UPDATE builds
+		SET stage = $2
+		WHERE id = $1
+	`
+	args := []any{id, stage}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
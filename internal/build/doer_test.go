@@ -0,0 +1,32 @@
+package build
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStageRecorder(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var written []string
+	stages := newStageRecorder(func(stage string) {
+		written = append(written, stage)
+		if len(written) == 1 {
+			close(started)
+			<-release
+		}
+	})
+
+	// Stages set while a write is blocked are skipped except for the latest one.
+	stages.Set("untar")
+	<-started
+	stages.Set("pandoc")
+	stages.Set("latexmk")
+	stages.Set("latexmk")
+	close(release)
+	stages.Close()
+
+	if want := []string{"untar", "latexmk"}; !slices.Equal(written, want) {
+		t.Errorf("got %q written, want %q", written, want)
+	}
+}
@@ -2,30 +2,49 @@ package build
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/k11v/brick/internal/storage"
 )
 
 var (
 	ErrAccessDenied  = errors.New("access denied")
 	ErrNotDone       = errors.New("not done")
 	ErrDoneWithError = errors.New("done with error")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Page sizes of Getter.List.
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
 )
 
+// DefaultPresignExpires is how long presigned URLs returned by Getter are valid.
+const DefaultPresignExpires = 15 * time.Minute
+
 type Getter struct {
 	DB  *pgxpool.Pool
-	STG *s3.Client
+	STG storage.Storage
+
+	PresignExpires time.Duration
 }
 
-func NewGetter(db *pgxpool.Pool, stg *s3.Client) *Getter {
+func NewGetter(db *pgxpool.Pool, stg storage.Storage) *Getter {
 	return &Getter{
-		DB:  db,
-		STG: stg,
+		DB:             db,
+		STG:            stg,
+		PresignExpires: DefaultPresignExpires,
 	}
 }
 
@@ -45,6 +64,60 @@ func (g *Getter) Get(ctx context.Context, params *GetterGetParams) (*Build, erro
 	return b, nil
 }
 
+type GetterListParams struct {
+	UserID uuid.UUID
+
+	// Filters are optional. Builds match all of them.
+	Status        Status
+	Error         Error
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	Label         string
+
+	// Limit defaults to DefaultListLimit and is capped at MaxListLimit.
+	// Cursor is BuildPage.NextCursor of the previous page or empty for the first page.
+	Limit  int
+	Cursor string
+}
+
+type BuildPage struct {
+	Builds     []*Build
+	NextCursor string // empty if there are no more builds
+}
+
+// List returns builds of the user from newest to oldest.
+// Pages are keyset-paginated by creation time and ID,
+// so builds created while pages are requested don't shift later pages.
+func (g *Getter) List(ctx context.Context, params *GetterListParams) (*BuildPage, error) {
+	limit := params.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	var after *buildCursor
+	if params.Cursor != "" {
+		c, err := parseBuildCursor(params.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("build.Getter: %w", err)
+		}
+		after = c
+	}
+
+	// One more build is requested to know whether there is a next page.
+	builds, err := listBuilds(ctx, g.DB, params, after, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("build.Getter: listBuilds: %w", err)
+	}
+	page := &BuildPage{Builds: builds}
+	if len(builds) > limit {
+		page.Builds = builds[:limit]
+		last := page.Builds[limit-1]
+		page.NextCursor = (&buildCursor{CreatedAt: last.CreatedAt, ID: last.ID}).String()
+	}
+	return page, nil
+}
+
 func (g *Getter) GetFiles(ctx context.Context, params *GetterGetParams) ([]*File, error) {
 	b, err := g.Get(ctx, params)
 	if err != nil {
@@ -57,6 +130,59 @@ func (g *Getter) GetFiles(ctx context.Context, params *GetterGetParams) ([]*File
 	return files, nil
 }
 
+type GetterGetQuotaParams struct {
+	UserID uuid.UUID
+}
+
+// GetQuota returns the current usage and limits of the user.
+func (g *Getter) GetQuota(ctx context.Context, params *GetterGetQuotaParams) (*Quota, error) {
+	q, err := getQuota(ctx, g.DB, params.UserID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("build.Getter: %w", err)
+	}
+	return q, nil
+}
+
+// CopyInputArchive writes input files of the build to w as an archive in the format.
+// File data is streamed from storage, so an error can be returned after a partial write.
+func (g *Getter) CopyInputArchive(ctx context.Context, w io.Writer, params *GetterGetParams, format ArchiveFormat) error {
+	b, err := g.Get(ctx, params)
+	if err != nil {
+		return err
+	}
+	if b.Status == StatusReserved {
+		return fmt.Errorf("build.Getter: %w", ErrReserved)
+	}
+	if !b.InputsExpiredAt.IsZero() {
+		return fmt.Errorf("build.Getter: %w", ErrExpired)
+	}
+	files, err := getFiles(ctx, g.DB, b.ID)
+	if err != nil {
+		return fmt.Errorf("build.Getter: %w", err)
+	}
+	err = fillBlobDataKeys(ctx, g.DB, files)
+	if err != nil {
+		return fmt.Errorf("build.Getter: fillBlobDataKeys: %w", err)
+	}
+	err = writeArchive(ctx, w, g.STG, files, format)
+	if err != nil {
+		return fmt.Errorf("build.Getter: %w", expiredIfNotExist(err))
+	}
+	return nil
+}
+
+func (g *Getter) GetDiagnostics(ctx context.Context, params *GetterGetParams) ([]*Diagnostic, error) {
+	b, err := g.Get(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics, err := getDiagnostics(ctx, g.DB, b.ID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Getter: %w", err)
+	}
+	return diagnostics, nil
+}
+
 func (g *Getter) CopyOutputData(ctx context.Context, w io.Writer, params *GetterGetParams) error {
 	b, err := g.Get(ctx, params)
 	if err != nil {
@@ -68,13 +194,82 @@ func (g *Getter) CopyOutputData(ctx context.Context, w io.Writer, params *Getter
 	if b.Error != "" {
 		return fmt.Errorf("build.Getter: %w", ErrDoneWithError)
 	}
-	err = downloadData(ctx, g.STG, w, b.OutputDataKey)
+	if !b.OutputsExpiredAt.IsZero() {
+		return fmt.Errorf("build.Getter: %w", ErrExpired)
+	}
+	err = g.STG.Download(ctx, w, b.OutputDataKey)
 	if err != nil {
-		return fmt.Errorf("build.Getter: %w", err)
+		return fmt.Errorf("build.Getter: %w", expiredIfNotExist(err))
 	}
 	return nil
 }
 
+// PresignOutputData returns a short-lived URL that downloads the output PDF file.
+// It returns an error wrapping storage.ErrPresignUnsupported
+// if the storage can't presign URLs, CopyOutputData can be used then.
+func (g *Getter) PresignOutputData(ctx context.Context, params *GetterGetParams) (string, error) {
+	b, err := g.Get(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	if b.Status != StatusDone {
+		return "", fmt.Errorf("build.Getter: %w", ErrNotDone)
+	}
+	if b.Error != "" {
+		return "", fmt.Errorf("build.Getter: %w", ErrDoneWithError)
+	}
+	if !b.OutputsExpiredAt.IsZero() {
+		return "", fmt.Errorf("build.Getter: %w", ErrExpired)
+	}
+	u, err := g.STG.PresignGet(ctx, b.OutputDataKey, &storage.PresignGetParams{
+		Expires:     g.PresignExpires,
+		ContentType: OutputContentType,
+		Filename:    OutputFilename(b),
+	})
+	if err != nil {
+		return "", fmt.Errorf("build.Getter: %w", err)
+	}
+	return u, nil
+}
+
+// PresignLogData is like PresignOutputData but for the log file.
+func (g *Getter) PresignLogData(ctx context.Context, params *GetterGetParams) (string, error) {
+	b, err := g.Get(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	if b.Status != StatusDone {
+		return "", fmt.Errorf("build.Getter: %w", ErrNotDone)
+	}
+	if !b.LogsExpiredAt.IsZero() {
+		return "", fmt.Errorf("build.Getter: %w", ErrExpired)
+	}
+	u, err := g.STG.PresignGet(ctx, b.LogDataKey, &storage.PresignGetParams{
+		Expires:     g.PresignExpires,
+		ContentType: LogContentType,
+		Filename:    LogFilename(b),
+	})
+	if err != nil {
+		return "", fmt.Errorf("build.Getter: %w", err)
+	}
+	return u, nil
+}
+
+const (
+	OutputContentType = "application/pdf"
+	LogContentType    = "text/plain; charset=utf-8"
+)
+
+// OutputFilename returns the filename for downloads of the output PDF file.
+func OutputFilename(b *Build) string {
+	return fmt.Sprintf("brick-%s.pdf", b.ID)
+}
+
+// LogFilename returns the filename for downloads of the log file.
+func LogFilename(b *Build) string {
+	return fmt.Sprintf("brick-%s.log", b.ID)
+}
+
 func (g *Getter) CopyLogData(ctx context.Context, w io.Writer, params *GetterGetParams) error {
 	b, err := g.Get(ctx, params)
 	if err != nil {
@@ -83,9 +278,120 @@ func (g *Getter) CopyLogData(ctx context.Context, w io.Writer, params *GetterGet
 	if b.Status != StatusDone {
 		return fmt.Errorf("build.Getter: %w", ErrNotDone)
 	}
-	err = downloadData(ctx, g.STG, w, b.LogDataKey)
+	if !b.LogsExpiredAt.IsZero() {
+		return fmt.Errorf("build.Getter: %w", ErrExpired)
+	}
+	err = g.STG.Download(ctx, w, b.LogDataKey)
 	if err != nil {
-		return fmt.Errorf("build.Getter: %w", err)
+		return fmt.Errorf("build.Getter: %w", expiredIfNotExist(err))
 	}
 	return nil
 }
+
+// fillBlobDataKeys sets data keys of regular files without them to data keys of their blobs.
+// Files of reserved builds completed from cache used to be stored without data keys.
+func fillBlobDataKeys(ctx context.Context, db executor, files []*File) error {
+	for _, f := range files {
+		if f.Type != FileTypeRegular || f.DataKey != "" || f.SHA256 == "" {
+			continue
+		}
+		dataKey, err := getBlobDataKey(ctx, db, f.SHA256)
+		if err != nil {
+			return err
+		}
+		f.DataKey = dataKey
+	}
+	return nil
+}
+
+// expiredIfNotExist reports missing objects as expired
+// because Collector could delete them after the build was read.
+func expiredIfNotExist(err error) error {
+	if errors.Is(err, storage.ErrNotExist) {
+		return errors.Join(ErrExpired, err)
+	}
+	return err
+}
+
+// buildCursor is the position of a build in Getter.List pages.
+type buildCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// String returns the cursor as an opaque URL-safe string.
+func (c *buildCursor) String() string {
+	s := fmt.Sprintf("%d.%s", c.CreatedAt.UnixMicro(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseBuildCursor(s string) (*buildCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	createdAtString, idString, found := strings.Cut(string(data), ".")
+	if !found {
+		return nil, ErrInvalidCursor
+	}
+	createdAtMicro, err := strconv.ParseInt(createdAtString, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &buildCursor{CreatedAt: time.UnixMicro(createdAtMicro), ID: id}, nil
+}
+
+// listBuilds returns at most limit builds matching the params after the cursor.
+func listBuilds(ctx context.Context, db executor, params *GetterListParams, after *buildCursor, limit int) ([]*Build, error) {
+	args := []any{params.UserID}
+	conditions := []string{"user_id = $1"}
+	addCondition := func(format string, values ...any) {
+		placeholders := make([]any, 0, len(values))
+		for _, v := range values {
+			args = append(args, v)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		conditions = append(conditions, fmt.Sprintf(format, placeholders...))
+	}
+	if params.Status != "" {
+		addCondition("status = %s", string(params.Status))
+	}
+	if params.Error != "" {
+		addCondition("error = %s", string(params.Error))
+	}
+	if !params.CreatedAfter.IsZero() {
+		addCondition("created_at >= %s", params.CreatedAfter)
+	}
+	if !params.CreatedBefore.IsZero() {
+		addCondition("created_at < %s", params.CreatedBefore)
+	}
+	if params.Label != "" {
+		addCondition("labels @> ARRAY[%s]::text[]", params.Label)
+	}
+	if after != nil {
+		addCondition("(created_at, id) < (%s, %s)", after.CreatedAt, after.ID)
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`
+		SELECT id, created_at, idempotency_key, user_id, status, error, exit_code, log_data_key, output_data_key,
+		       preset, template_file, header_includes_file, bibliography_file, csl, engine, input_hash, cached_from_id,
+		       inputs_expired_at, outputs_expired_at, logs_expired_at, labels, wall_clock_seconds, parent_build_id, started_at, finished_at, stage, priority
+		FROM builds
+		WHERE %s
+		ORDER BY created_at DESC, id DESC
+		LIMIT $%d
+	`, strings.Join(conditions, " AND "), len(args))
+
+	rows, _ := db.Query(ctx, query, args...)
+	builds, err := pgx.CollectRows(rows, rowToBuild)
+	if err != nil {
+		return nil, err
+	}
+
+	return builds, nil
+}
@@ -0,0 +1,156 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestBuildCursor(t *testing.T) {
+	want := &buildCursor{CreatedAt: time.UnixMicro(1700000000123456), ID: uuid.New()}
+	got, err := parseBuildCursor(want.String())
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || got.ID != want.ID {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"", "not base64!", "MTIz", "YWJjLmRlZg"} {
+		if _, err = parseBuildCursor(s); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("got %v err for %q, want %q", err, s, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestGetterList(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+	g := NewGetter(c.DB, c.STG)
+
+	// create returns IDs of n new builds of the user from newest to oldest.
+	create := func(t *testing.T, userID uuid.UUID, n int) []uuid.UUID {
+		t.Helper()
+		ids := make([]uuid.UUID, n)
+		for i := range n {
+			labels := []string{"odd"}
+			if i%2 == 0 {
+				labels = []string{"even"}
+			}
+			b, err := c.Create(ctx, &CreatorCreateParams{
+				IdempotencyKey: uuid.New(),
+				UserID:         userID,
+				Files:          testFiles("main.md", fmt.Sprintf("# Build %d", i)),
+				Labels:         labels,
+			})
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			ids[n-1-i] = b.ID
+		}
+		return ids
+	}
+
+	// listAll returns IDs of builds from all pages.
+	listAll := func(t *testing.T, params GetterListParams) []uuid.UUID {
+		t.Helper()
+		var ids []uuid.UUID
+		for {
+			page, err := g.List(ctx, &params)
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			if len(page.Builds) > params.Limit {
+				t.Fatalf("got %d builds, want at most %d", len(page.Builds), params.Limit)
+			}
+			for _, b := range page.Builds {
+				ids = append(ids, b.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			params.Cursor = page.NextCursor
+		}
+	}
+
+	t.Run("pages builds from newest to oldest", func(t *testing.T) {
+		userID := uuid.New()
+		want := create(t, userID, 5)
+		create(t, uuid.New(), 1)
+
+		got := listAll(t, GetterListParams{UserID: userID, Limit: 2})
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("doesn't shift later pages when builds are created", func(t *testing.T) {
+		userID := uuid.New()
+		want := create(t, userID, 4)
+
+		first, err := g.List(ctx, &GetterListParams{UserID: userID, Limit: 2})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		create(t, userID, 1)
+		second, err := g.List(ctx, &GetterListParams{UserID: userID, Limit: 2, Cursor: first.NextCursor})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		var got []uuid.UUID
+		for _, b := range second.Builds {
+			got = append(got, b.ID)
+		}
+		if !slices.Equal(got, want[2:]) {
+			t.Errorf("got %v, want %v", got, want[2:])
+		}
+		if second.NextCursor != "" {
+			t.Errorf("got %q next cursor, want empty", second.NextCursor)
+		}
+	})
+
+	t.Run("pages builds created at the same time by ID", func(t *testing.T) {
+		userID := uuid.New()
+		want := create(t, userID, 4)
+		_, err := c.DB.Exec(ctx, "UPDATE builds SET created_at = '2025-01-01T00:00:00Z' WHERE user_id = $1", userID)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		slices.SortFunc(want, func(a, b uuid.UUID) int {
+			return bytes.Compare(b[:], a[:])
+		})
+
+		got := listAll(t, GetterListParams{UserID: userID, Limit: 3})
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("filters builds", func(t *testing.T) {
+		userID := uuid.New()
+		ids := create(t, userID, 5)
+
+		got := listAll(t, GetterListParams{UserID: userID, Label: "even", Limit: 2})
+		if want := []uuid.UUID{ids[0], ids[2], ids[4]}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		got = listAll(t, GetterListParams{UserID: userID, Status: StatusDone, Limit: 2})
+		if len(got) != 0 {
+			t.Errorf("got %v, want no builds", got)
+		}
+	})
+
+	t.Run("refuses invalid cursors", func(t *testing.T) {
+		_, err := g.List(ctx, &GetterListParams{UserID: uuid.New(), Cursor: "not base64!"})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("got %v err, want %q", err, ErrInvalidCursor)
+		}
+	})
+}
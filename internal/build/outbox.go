@@ -0,0 +1,272 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/k11v/brick/internal/app"
+)
+
+// BuildEventType is the type of a build lifecycle event and its routing key
+// on the app.AMQPExchangeBuildEvents exchange.
+type BuildEventType string
+
+const (
+	BuildEventStarted  BuildEventType = "build.started"  // Doer started the build
+	BuildEventFinished BuildEventType = "build.finished" // Doer finished the build, successfully or not
+	BuildEventCanceled BuildEventType = "build.canceled" // Canceler canceled the build or Collector expired its reservation before it started
+)
+
+// BuildEventSchemaVersion is the version of the JSON schema of build events.
+// It changes only when fields are removed or change their meaning, new fields can be added anytime.
+// It is also sent in the schema_version header.
+const BuildEventSchemaVersion = 3 // 2 renamed cpu_seconds to container_seconds, 3 renamed container_seconds to wall_clock_seconds
+
+// publishBatchSize is the number of outbox messages published by one Publisher.Publish call.
+const publishBatchSize = 100
+
+// publishConfirmTimeout is how long Publisher waits for the broker to confirm a batch.
+const publishConfirmTimeout = 30 * time.Second
+
+// ErrMessageNotConfirmed is returned by Publisher.Publish when the broker didn't accept
+// some messages. They stay in the outbox and are published again by the next call.
+var ErrMessageNotConfirmed = errors.New("message not confirmed")
+
+type buildEventJSON struct {
+	SchemaVersion int                 `json:"schema_version"`
+	ID            uuid.UUID           `json:"id"` // unique, consumers can use it to skip duplicates
+	Type          BuildEventType      `json:"type"`
+	OccurredAt    time.Time           `json:"occurred_at"`
+	Build         buildEventBuildJSON `json:"build"`
+}
+
+type buildEventBuildJSON struct {
+	ID               uuid.UUID `json:"id"`
+	CreatedAt        time.Time `json:"created_at"`
+	UserID           uuid.UUID `json:"user_id"`
+	Status           Status    `json:"status"`
+	Error            Error     `json:"error,omitempty"`
+	ExitCode         *int      `json:"exit_code"`
+	Labels           []string  `json:"labels"`
+	WallClockSeconds float64   `json:"wall_clock_seconds"`
+}
+
+func newBuildEventJSON(id uuid.UUID, typ BuildEventType, occurredAt time.Time, b *Build) *buildEventJSON {
+	var exitCode *int
+	if b.ExitCode >= 0 {
+		exitCode = &b.ExitCode
+	}
+	return &buildEventJSON{
+		SchemaVersion: BuildEventSchemaVersion,
+		ID:            id,
+		Type:          typ,
+		OccurredAt:    occurredAt,
+		Build: buildEventBuildJSON{
+			ID:               b.ID,
+			CreatedAt:        b.CreatedAt,
+			UserID:           b.UserID,
+			Status:           b.Status,
+			Error:            b.Error,
+			ExitCode:         exitCode,
+			Labels:           b.Labels,
+			WallClockSeconds: b.WallClockSeconds,
+		},
+	}
+}
+
+// Publisher relays build events and build created messages of AMQPQueue from the outbox to RabbitMQ.
+// Messages are written to the outbox in the transactions that change builds,
+// so they are published at least once if and only if the changes are committed.
+type Publisher struct {
+	DB *pgxpool.Pool
+	MQ *app.AMQPClient
+}
+
+func NewPublisher(db *pgxpool.Pool, mq *app.AMQPClient) *Publisher {
+	return &Publisher{DB: db, MQ: mq}
+}
+
+// Publish publishes a batch of outbox messages, oldest first, and returns the number of published ones.
+// Messages are published on one channel and are deleted from the outbox only once the broker confirms them.
+// Build created messages are mandatory, so they stay in the outbox until they reach their queue.
+// Build events aren't mandatory: the exchange may have no bound queues,
+// and events that no queue is bound for must not block messages behind them.
+// Messages are locked while they are published and locked messages are skipped,
+// so Publish can run concurrently with itself, but then messages can be published out of order.
+func (p *Publisher) Publish(ctx context.Context) (int, error) {
+	tx, err := p.DB.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("build.Publisher: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	messages, err := getOldestOutboxMessagesForUpdate(ctx, tx, publishBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("build.Publisher: getOldestOutboxMessagesForUpdate: %w", err)
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	confirmed, publishErr := p.publishConfirmed(ctx, messages)
+	if len(confirmed) > 0 {
+		if err = deleteOutboxMessages(ctx, tx, confirmed); err != nil {
+			return 0, fmt.Errorf("build.Publisher: deleteOutboxMessages: %w", err)
+		}
+		// If Commit fails, the messages are published again by the next call.
+		if err = tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("build.Publisher: %w", err)
+		}
+	}
+	if publishErr != nil {
+		return len(confirmed), fmt.Errorf("build.Publisher: %w", publishErr)
+	}
+	return len(confirmed), nil
+}
+
+// publishConfirmed publishes the messages and returns IDs of the ones confirmed by the broker.
+// Messages are published without waiting for each other's confirmations.
+func (p *Publisher) publishConfirmed(ctx context.Context, messages []*outboxMessage) ([]uuid.UUID, error) {
+	publisher, err := p.MQ.NewConfirmPublisher()
+	if err != nil {
+		return nil, err
+	}
+	defer publisher.Close()
+
+	// Build created messages are mandatory, so their queue is declared in case no worker declared it yet.
+	if err = publisher.DeclareQueue(app.NewAMQPQueueBuildCreatedDeclareParams()); err != nil {
+		return nil, err
+	}
+
+	confirmations := make([]*amqp091.DeferredConfirmation, 0, len(messages))
+	var publishErr error
+	for _, m := range messages {
+		msg := amqp091.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp091.Persistent,
+			MessageId:    m.ID.String(),
+			Timestamp:    m.CreatedAt,
+			Type:         m.RoutingKey,
+			Priority:     uint8(m.Priority),
+			Body:         m.Body,
+		}
+		mandatory := true
+		if m.Exchange == app.AMQPExchangeBuildEvents {
+			msg.Headers = amqp091.Table{"schema_version": int32(BuildEventSchemaVersion)}
+			mandatory = false
+		}
+		c, err := publisher.Publish(ctx, m.Exchange, m.RoutingKey, mandatory, msg)
+		if err != nil {
+			publishErr = fmt.Errorf("Publish: %w", err)
+			break
+		}
+		confirmations = append(confirmations, c)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, publishConfirmTimeout)
+	defer cancel()
+	acked := make([]bool, len(confirmations))
+	for i, c := range confirmations {
+		acked[i], err = c.WaitContext(waitCtx)
+		if err != nil {
+			publishErr = errors.Join(publishErr, fmt.Errorf("WaitContext: %w", err))
+			break
+		}
+	}
+
+	// Returned messages are acked too, but they didn't reach a queue.
+	returned := publisher.Returned()
+	var confirmed []uuid.UUID
+	notConfirmed := 0
+	for i, m := range messages {
+		if i >= len(acked) || !acked[i] {
+			notConfirmed++
+			continue
+		}
+		if _, ok := returned[m.ID.String()]; ok {
+			notConfirmed++
+			continue
+		}
+		confirmed = append(confirmed, m.ID)
+	}
+	if notConfirmed > 0 && publishErr == nil {
+		publishErr = fmt.Errorf("%d messages: %w", notConfirmed, ErrMessageNotConfirmed)
+	}
+	return confirmed, publishErr
+}
+
+// createBuildEvent writes the build event to the outbox.
+// It must be called in the transaction that changed the build.
+func createBuildEvent(ctx context.Context, db executor, typ BuildEventType, b *Build) error {
+	id := uuid.New()
+	body, err := json.Marshal(newBuildEventJSON(id, typ, time.Now(), b))
+	if err != nil {
+		return err
+	}
+
+	return createOutboxMessage(ctx, db, id, app.AMQPExchangeBuildEvents, string(typ), 0, body)
+}
+
+// createOutboxMessage writes a message to the outbox, it is published once the transaction is committed.
+// The ID is the message ID of the published message.
+func createOutboxMessage(ctx context.Context, db executor, id uuid.UUID, exchange string, routingKey string, priority uint8, body []byte) error {
+	query := `
+		INSERT INTO outbox_messages (id, exchange, routing_key, priority, body)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	args := []any{id, exchange, routingKey, int16(priority), body}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
+
+type outboxMessage struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	Exchange   string
+	RoutingKey string
+	Priority   int16
+	Body       []byte
+}
+
+// getOldestOutboxMessagesForUpdate returns up to limit oldest outbox messages.
+// Messages locked by other transactions are skipped.
+func getOldestOutboxMessagesForUpdate(ctx context.Context, db executor, limit int) ([]*outboxMessage, error) {
+	query := `
+		SELECT id, created_at, exchange, routing_key, priority, body
+		FROM outbox_messages
+		ORDER BY created_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`
+	args := []any{limit}
+
+	rows, _ := db.Query(ctx, query, args...)
+	messages, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByPos[outboxMessage])
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func deleteOutboxMessages(ctx context.Context, db executor, ids []uuid.UUID) error {
+	query := `
+		DELETE FROM outbox_messages
+		WHERE id = ANY($1)
+	`
+	args := []any{ids}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
@@ -0,0 +1,111 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/k11v/brick/internal/app"
+	"github.com/k11v/brick/internal/app/apptest"
+)
+
+func TestNewBuildEventJSON(t *testing.T) {
+	b := &Build{ID: uuid.New(), Status: StatusDone, Error: ErrorCanceled, ExitCode: -1, Labels: []string{}}
+	data, err := json.Marshal(newBuildEventJSON(uuid.New(), BuildEventCanceled, time.Now(), b))
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+
+	var got map[string]any
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	if got["schema_version"] != float64(BuildEventSchemaVersion) {
+		t.Errorf("got %v schema version, want %d", got["schema_version"], BuildEventSchemaVersion)
+	}
+	if got["type"] != string(BuildEventCanceled) {
+		t.Errorf("got %v type, want %q", got["type"], BuildEventCanceled)
+	}
+	gotBuild, _ := got["build"].(map[string]any)
+	if exitCode, ok := gotBuild["exit_code"]; !ok || exitCode != nil {
+		t.Errorf("got %v exit code, want null", exitCode)
+	}
+	if gotBuild["error"] != string(ErrorCanceled) {
+		t.Errorf("got %v error, want %q", gotBuild["error"], ErrorCanceled)
+	}
+}
+
+func TestPublisherPublish(t *testing.T) {
+	t.Run("publishes build created messages behind unroutable events", func(t *testing.T) {
+		ctx := context.Background()
+		db := apptest.NewPostgresPool(t)
+		mqConnectionString := apptest.NewRabbitMQ(t)
+
+		// No queue is bound to the build events exchange, so the events can't be routed.
+		b := &Build{ID: uuid.New(), UserID: uuid.New(), Status: StatusDone, ExitCode: 0, Labels: []string{}}
+		for range publishBatchSize + 1 {
+			if err := createBuildEvent(ctx, db, BuildEventFinished, b); err != nil {
+				t.Fatalf("got %q err", err)
+			}
+		}
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if err = NewAMQPQueue(nil, nil).Send(ctx, tx, &Build{ID: uuid.New(), UserID: uuid.New(), Status: StatusTodo}); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if err = tx.Commit(ctx); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		mq := app.NewAMQPExchangeClient(mqConnectionString, &app.AMQPExchangeDeclareParams{
+			Name:    app.AMQPExchangeBuildEvents,
+			Kind:    "topic",
+			Durable: true,
+		})
+		publisher := NewPublisher(db, mq)
+		total := 0
+		for range 2 {
+			published, err := publisher.Publish(ctx)
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			total += published
+		}
+		if got, want := total, publishBatchSize+2; got != want {
+			t.Errorf("got %d published messages, want %d", got, want)
+		}
+
+		var left int
+		if err = db.QueryRow(ctx, "SELECT count(*) FROM outbox_messages").Scan(&left); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if left != 0 {
+			t.Errorf("got %d messages left in the outbox, want 0", left)
+		}
+
+		conn, err := amqp091.Dial(mqConnectionString)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		_, ok, err := ch.Get(app.AMQPQueueBuildCreated, true)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if !ok {
+			t.Errorf("got no build created message")
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rabbitmq/amqp091-go"
+
+	"github.com/k11v/brick/internal/app"
+)
+
+// QueueKind names a Queue implementation in configuration.
+type QueueKind string
+
+const (
+	QueueKindAMQP     QueueKind = "amqp"     // AMQPQueue
+	QueueKindPostgres QueueKind = "postgres" // PostgresQueue
+)
+
+func ParseQueueKind(s string) (kind QueueKind, known bool) {
+	kind = QueueKind(s)
+	switch kind {
+	case QueueKindAMQP, QueueKindPostgres:
+		return kind, true
+	default:
+		return kind, false
+	}
+}
+
+// QueueKindEnv parses the env as a QueueKind or returns QueueKindAMQP if the env is empty.
+// The server and workers must use the same queue, so both read it with QueueKindEnv.
+func QueueKindEnv(env string) (QueueKind, error) {
+	s := os.Getenv(env)
+	if s == "" {
+		return QueueKindAMQP, nil
+	}
+	kind, known := ParseQueueKind(s)
+	if !known {
+		return "", fmt.Errorf("%s env: unknown queue %q", env, s)
+	}
+	return kind, nil
+}
+
+// Queue delivers builds to do from Creator to workers running Doer.
+type Queue interface {
+	// Send tells workers that the build is to do.
+	// It is called in the transaction that created the build or changed its status to todo.
+	Send(ctx context.Context, tx pgx.Tx, b *Build) error
+
+	// Consume runs builds with the doer as they are sent.
+	// It returns an error when it can't consume anymore, for example when the connection is lost,
+	// and the caller can retry then.
+	Consume(ctx context.Context, doer *Doer) error
+}
+
+// AMQPQueue sends a message to the app.AMQPQueueBuildCreated queue for each build.
+// Messages are written to the outbox and published by Publisher once the transaction is committed,
+// so workers never get messages of builds that weren't committed.
+// Message priorities are given by messagePriority.
+// Messages of builds that can't be started because of the running builds limit
+// are delayed with the app.AMQPQueueBuildCreatedDelayed queue.
+type AMQPQueue struct {
+	MQ        *app.AMQPClient // client of the build created queue
+	DelayedMQ *app.AMQPClient // client of the delayed build created queue
+}
+
+func NewAMQPQueue(mq *app.AMQPClient, delayedMQ *app.AMQPClient) *AMQPQueue {
+	return &AMQPQueue{MQ: mq, DelayedMQ: delayedMQ}
+}
+
+type buildCreatedMessage struct {
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	IdempotencyKey uuid.UUID `json:"idempotency_key"`
+	UserID         uuid.UUID `json:"user_id"`
+
+	Status        string `json:"status"`
+	Error         string `json:"error"`
+	ExitCode      int    `json:"exit_code"`
+	LogDataKey    string `json:"log_data_key"`
+	OutputDataKey string `json:"output_data_key"`
+}
+
+func (q *AMQPQueue) Send(ctx context.Context, tx pgx.Tx, b *Build) error {
+	queued, err := countQueuedBuilds(ctx, tx, b.UserID, b.ID)
+	if err != nil {
+		return err
+	}
+
+	msg := buildCreatedMessage{
+		ID:             b.ID,
+		CreatedAt:      b.CreatedAt,
+		IdempotencyKey: b.IdempotencyKey,
+		UserID:         b.UserID,
+
+		Status:        string(b.Status),
+		Error:         string(b.Error),
+		ExitCode:      b.ExitCode,
+		LogDataKey:    b.LogDataKey,
+		OutputDataKey: b.OutputDataKey,
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return createOutboxMessage(ctx, tx, uuid.New(), "", app.AMQPQueueBuildCreated, messagePriority(b.Priority, queued), body)
+}
+
+func (q *AMQPQueue) Consume(ctx context.Context, doer *Doer) error {
+	err := q.MQ.Consume(ctx, func(m amqp091.Delivery) {
+		id, err := parseBuildCreatedMessage(m)
+		if err != nil {
+			slog.Error("invalid message", "err", err)
+			_ = m.Nack(false, false)
+			return
+		}
+
+		_, err = doer.Do(ctx, &DoerDoParams{ID: id})
+		if errors.Is(err, ErrLimitExceeded) {
+			slog.Info("delaying message", "id", id, "err", err)
+			q.delay(ctx, m)
+			return
+		}
+		if err != nil {
+			slog.Error("didn't do build", "id", id, "err", err)
+			_ = m.Nack(false, false)
+			return
+		}
+
+		_ = m.Ack(false)
+	})
+	if err != nil {
+		return fmt.Errorf("build.AMQPQueue: %w", err)
+	}
+	return nil
+}
+
+// delay moves the message to the delayed queue, so it is consumed again after app.AMQPQueueBuildCreatedDelay.
+// Requeueing it instead would put it back at the head of the queue and workers would spin on it.
+// The message is requeued only if it can't be delayed.
+func (q *AMQPQueue) delay(ctx context.Context, m amqp091.Delivery) {
+	err := q.DelayedMQ.Publish(ctx, "", app.AMQPQueueBuildCreatedDelayed, false, false, amqp091.Publishing{
+		ContentType: m.ContentType,
+		Priority:    m.Priority,
+		Headers:     m.Headers,
+		Body:        m.Body,
+	})
+	if err != nil {
+		slog.Error("didn't delay message", "err", err)
+		_ = m.Nack(false, true)
+		return
+	}
+	_ = m.Ack(false)
+}
+
+// parseBuildCreatedMessage returns the build ID of the message.
+func parseBuildCreatedMessage(m amqp091.Delivery) (uuid.UUID, error) {
+	type message struct {
+		ID *uuid.UUID `json:"id"`
+	}
+
+	err := m.Headers.Validate()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	var msg message
+	dec := json.NewDecoder(bytes.NewReader(m.Body))
+	err = dec.Decode(&msg)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid body: %w", err)
+	}
+	if dec.More() {
+		err = errors.New("multiple top-level values")
+		return uuid.Nil, fmt.Errorf("invalid body: %w", err)
+	}
+
+	// Body field id.
+	if msg.ID == nil {
+		return uuid.Nil, fmt.Errorf("missing %s body field", "id")
+	}
+
+	return *msg.ID, nil
+}
+
+// postgresChannelBuildTodo is the notification channel of PostgresQueue.
+const postgresChannelBuildTodo = "build_todo"
+
+// DefaultPollInterval is how often PostgresQueue.Consume looks for builds without notifications.
+const DefaultPollInterval = 5 * time.Second
+
+// PostgresQueue takes builds to do from the builds table, so deployments don't need RabbitMQ.
+// Send notifies listening workers and Consume runs builds with Doer.DoNext,
+// which locks the build with FOR UPDATE SKIP LOCKED.
+// Unlike AMQPQueue, builds are scheduled when they are taken rather than when they are sent,
+// so priorities and running builds limits are applied exactly.
+type PostgresQueue struct {
+	DB *pgxpool.Pool
+
+	// PollInterval bounds how long builds wait when a notification is missed,
+	// for example when it is sent while no worker listens, or when a user running builds limit frees up.
+	PollInterval time.Duration
+}
+
+func NewPostgresQueue(db *pgxpool.Pool) *PostgresQueue {
+	return &PostgresQueue{DB: db, PollInterval: DefaultPollInterval}
+}
+
+// Send notifies listening workers when tx is committed.
+func (q *PostgresQueue) Send(ctx context.Context, tx pgx.Tx, b *Build) error {
+	query := `
+		SELECT pg_notify($1, $2)
+	`
+	args := []any{postgresChannelBuildTodo, b.ID.String()}
+
+	_, err := tx.Exec(ctx, query, args...)
+	return err
+}
+
+func (q *PostgresQueue) Consume(ctx context.Context, doer *Doer) error {
+	conn, err := q.DB.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("build.PostgresQueue: %w", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+postgresChannelBuildTodo)
+	if err != nil {
+		return fmt.Errorf("build.PostgresQueue: %w", err)
+	}
+
+	for {
+		b, err := doer.DoNext(ctx)
+		if err == nil {
+			slog.Info("did build", "id", b.ID)
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			slog.Error("didn't do build", "err", err)
+		}
+
+		// Wait for a notification.
+		// Notifications sent while a build runs are buffered, so builds sent meanwhile aren't missed.
+		waitCtx, cancel := context.WithTimeout(ctx, q.PollInterval)
+		_, err = conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("build.PostgresQueue: %w", ctxErr)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return fmt.Errorf("build.PostgresQueue: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseBuildCreatedMessage(t *testing.T) {
+	t.Run("parses sent messages", func(t *testing.T) {
+		want := uuid.New()
+		body, err := json.Marshal(&buildCreatedMessage{ID: want})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		got, err := parseBuildCreatedMessage(amqp091.Delivery{Body: body})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	})
+
+	t.Run("rejects invalid messages", func(t *testing.T) {
+		for _, body := range []string{`{}`, `{"id":"x"}`, `{"id":"` + uuid.NewString() + `"} {}`} {
+			if _, err := parseBuildCreatedMessage(amqp091.Delivery{Body: []byte(body)}); err == nil {
+				t.Errorf("got nil err for %s", body)
+			}
+		}
+	})
+}
+
+func TestQueueKindEnv(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    QueueKind
+		wantErr bool
+	}{
+		{"", QueueKindAMQP, false},
+		{"amqp", QueueKindAMQP, false},
+		{"postgres", QueueKindPostgres, false},
+		{"kafka", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_QUEUE", tt.env)
+		got, err := QueueKindEnv("TEST_QUEUE")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("got %v err for %q, want err %t", err, tt.env, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("got %q for %q, want %q", got, tt.env, tt.want)
+		}
+	}
+}
+
+func TestPostgresQueue(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCreator(t)
+	q := NewPostgresQueue(c.DB)
+
+	create := func(t *testing.T, userID uuid.UUID, priority Priority) *Build {
+		t.Helper()
+		b, err := c.Create(ctx, &CreatorCreateParams{
+			IdempotencyKey: uuid.New(),
+			UserID:         userID,
+			Files:          testFiles("main.md", "# "+uuid.NewString()),
+			Priority:       priority,
+		})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		return b
+	}
+
+	// finishTodo marks builds left to do by earlier subtests done, so they aren't taken.
+	finishTodo := func(t *testing.T) {
+		t.Helper()
+		_, err := c.DB.Exec(ctx, "UPDATE builds SET status = $1 WHERE status = $2", string(StatusDone), string(StatusTodo))
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+	}
+
+	// next returns the next build in a transaction that stays open until the test finishes.
+	next := func(t *testing.T) (*Build, error) {
+		t.Helper()
+		tx, err := c.DB.Begin(ctx)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		t.Cleanup(func() {
+			_ = tx.Rollback(ctx)
+		})
+		return getNextForUpdate(ctx, tx)
+	}
+
+	t.Run("notifies listeners when sent builds are committed", func(t *testing.T) {
+		conn, err := c.DB.Acquire(ctx)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		defer conn.Release()
+		if _, err = conn.Exec(ctx, "LISTEN "+postgresChannelBuildTodo); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		defer func() {
+			_, _ = conn.Exec(ctx, "UNLISTEN *")
+		}()
+
+		b := &Build{ID: uuid.New()}
+		tx, err := c.DB.Begin(ctx)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		defer func() {
+			_ = tx.Rollback(ctx)
+		}()
+		if err = q.Send(ctx, tx, b); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		_, err = conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v err before commit, want %q", err, context.DeadlineExceeded)
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+		n, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := n.Payload, b.ID.String(); got != want {
+			t.Errorf("got %q payload, want %q", got, want)
+		}
+	})
+
+	t.Run("skips builds locked by other workers", func(t *testing.T) {
+		finishTodo(t)
+		create(t, uuid.New(), PriorityInteractive)
+		create(t, uuid.New(), PriorityInteractive)
+
+		first, err := next(t)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		second, err := next(t)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if first.ID == second.ID {
+			t.Errorf("got %s build twice", first.ID)
+		}
+		if _, err = next(t); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v err, want %q", err, ErrNotFound)
+		}
+	})
+
+	t.Run("takes interactive builds before batch builds", func(t *testing.T) {
+		finishTodo(t)
+		create(t, uuid.New(), PriorityBatch)
+		interactive := create(t, uuid.New(), PriorityInteractive)
+
+		b, err := next(t)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := b.ID, interactive.ID; got != want {
+			t.Errorf("got %s build, want interactive %s", got, want)
+		}
+	})
+
+	t.Run("skips users at the running builds limit", func(t *testing.T) {
+		finishTodo(t)
+		userID := uuid.New()
+		runningBuilds := int64(1)
+		err := NewQuotaSetter(c.DB).SetUserQuota(ctx, &QuotaSetterSetUserQuotaParams{UserID: userID, RunningBuilds: &runningBuilds})
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		running := create(t, userID, PriorityInteractive)
+		if _, err = updateStatus(ctx, c.DB, running.ID, StatusDoing, ""); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		create(t, userID, PriorityInteractive)
+
+		if _, err = next(t); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v err, want %q", err, ErrNotFound)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrQuotaPlanNotFound = errors.New("quota plan not found")
+	ErrInvalidQuotaLimit = errors.New("invalid quota limit")
+)
+
+// QuotaLimitName identifies a dimension of quotas.
+type QuotaLimitName string
+
+const (
+	QuotaLimitBuilds           QuotaLimitName = "builds"             // builds created within the window, cache hits excluded
+	QuotaLimitConcurrentBuilds QuotaLimitName = "concurrent_builds"  // builds to do or being done
+	QuotaLimitWallClockSeconds QuotaLimitName = "wall_clock_seconds" // wall-clock time containers of builds created within the window ran, not CPU time
+	QuotaLimitStoredBytes      QuotaLimitName = "stored_bytes"       // size of unexpired input files, files with the same content are counted once
+	QuotaLimitRunningBuilds    QuotaLimitName = "running_builds"     // builds being done, checked by Doer, see checkRunningBuilds
+)
+
+// Quota is the usage and the limits of a user.
+// Limits come from the user plan, the default plan is "default".
+// Users can have overrides of plan limits.
+type Quota struct {
+	Plan   string
+	Window time.Duration // rolling window of builds and wall-clock seconds limits
+	Limits []*QuotaLimit
+}
+
+type QuotaLimit struct {
+	Name QuotaLimitName
+	Max  int64 // -1 if unlimited
+	Used int64
+
+	// ResetsAt is when the usage starts to decrease as builds leave the window.
+	// It is zero if the limit isn't windowed or nothing is used.
+	ResetsAt time.Time
+}
+
+// Exceeded reports whether new builds are refused by the limit.
+func (l *QuotaLimit) Exceeded() bool {
+	return l.Max >= 0 && l.Used >= l.Max
+}
+
+// LimitError is returned when a quota limit is exceeded.
+// It wraps ErrLimitExceeded.
+type LimitError struct {
+	Limit *QuotaLimit
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s %s: %d of %d used", e.Limit.Name, ErrLimitExceeded, e.Limit.Used, e.Limit.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// Err returns a LimitError for the first exceeded limit or nil.
+func (q *Quota) Err() error {
+	for _, l := range q.Limits {
+		if l.Exceeded() {
+			return &LimitError{Limit: l}
+		}
+	}
+	return nil
+}
+
+// storedBytesErr returns a LimitError if the stored bytes limit is exceeded or nil.
+// It is checked after files of a new build are created, so they are included in the usage
+// and, unlike Err, reaching the limit exactly is allowed.
+func (q *Quota) storedBytesErr() error {
+	for _, l := range q.Limits {
+		if l.Name == QuotaLimitStoredBytes && l.Max >= 0 && l.Used > l.Max {
+			return &LimitError{Limit: l}
+		}
+	}
+	return nil
+}
+
+// getQuota returns the quota of the user at the time.
+func getQuota(ctx context.Context, db executor, userID uuid.UUID, now time.Time) (*Quota, error) {
+	query := `
+		SELECT p.name, extract(epoch FROM p.window_duration)::double precision,
+		       coalesce(q.builds, p.builds, -1), coalesce(q.concurrent_builds, p.concurrent_builds, -1),
+		       coalesce(q.wall_clock_seconds, p.wall_clock_seconds, -1), coalesce(q.stored_bytes, p.stored_bytes, -1)
+		FROM quota_plans p
+		LEFT JOIN user_quotas q ON q.user_id = $1
+		WHERE p.name = coalesce(q.plan_name, 'default')
+	`
+	args := []any{userID}
+
+	type plan struct {
+		Name             string
+		WindowSeconds    float64
+		Builds           int64
+		ConcurrentBuilds int64
+		WallClockSeconds int64
+		StoredBytes      int64
+	}
+	rows, _ := db.Query(ctx, query, args...)
+	p, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[plan])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = ErrQuotaPlanNotFound
+		}
+		return nil, err
+	}
+	window := time.Duration(p.WindowSeconds * float64(time.Second))
+
+	query = `
+		SELECT count(*) FILTER (WHERE created_at >= $2 AND cached_from_id IS NULL),
+		       min(created_at) FILTER (WHERE created_at >= $2 AND cached_from_id IS NULL),
+		       count(*) FILTER (WHERE status IN ($3, $4)),
+		       coalesce(sum(wall_clock_seconds) FILTER (WHERE created_at >= $2), 0),
+		       min(created_at) FILTER (WHERE created_at >= $2 AND wall_clock_seconds IS NOT NULL)
+		FROM builds
+		WHERE user_id = $1
+	`
+	args = []any{userID, now.Add(-window), string(StatusTodo), string(StatusDoing)}
+
+	type buildsUsage struct {
+		Builds                   int64
+		BuildsOldestAt           *time.Time
+		ConcurrentBuilds         int64
+		WallClockSeconds         float64
+		WallClockSecondsOldestAt *time.Time
+	}
+	rows, _ = db.Query(ctx, query, args...)
+	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[buildsUsage])
+	if err != nil {
+		return nil, err
+	}
+
+	// Files with the same content share a blob, so each blob is counted once.
+	// Files without checksums aren't stored as blobs and are counted separately.
+	query = `
+		SELECT coalesce(sum(size), 0)::bigint
+		FROM (
+			SELECT DISTINCT coalesce(f.sha256, f.id::text), coalesce(f.size, bl.size) AS size
+			FROM build_files f
+			JOIN builds b ON b.id = f.build_id
+			LEFT JOIN blobs bl ON bl.sha256 = f.sha256
+			WHERE b.user_id = $1 AND b.inputs_expired_at IS NULL AND f.type = $2
+		) s
+	`
+	args = []any{userID, string(FileTypeRegular)}
+
+	rows, _ = db.Query(ctx, query, args...)
+	storedBytes, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, err
+	}
+
+	resetsAt := func(oldestAt *time.Time) time.Time {
+		if oldestAt == nil {
+			return time.Time{}
+		}
+		return oldestAt.Add(window)
+	}
+	return &Quota{
+		Plan:   p.Name,
+		Window: window,
+		Limits: []*QuotaLimit{
+			{Name: QuotaLimitBuilds, Max: p.Builds, Used: u.Builds, ResetsAt: resetsAt(u.BuildsOldestAt)},
+			{Name: QuotaLimitConcurrentBuilds, Max: p.ConcurrentBuilds, Used: u.ConcurrentBuilds},
+			{Name: QuotaLimitWallClockSeconds, Max: p.WallClockSeconds, Used: int64(math.Ceil(u.WallClockSeconds)), ResetsAt: resetsAt(u.WallClockSecondsOldestAt)},
+			{Name: QuotaLimitStoredBytes, Max: p.StoredBytes, Used: storedBytes},
+		},
+	}, nil
+}
+
+// QuotaSetter manages quota plans and quota overrides of users.
+type QuotaSetter struct {
+	DB *pgxpool.Pool
+}
+
+func NewQuotaSetter(db *pgxpool.Pool) *QuotaSetter {
+	return &QuotaSetter{DB: db}
+}
+
+type QuotaSetterSetPlanParams struct {
+	Name   string
+	Window time.Duration // rolling window of builds and wall-clock seconds limits
+
+	// Limits are -1 if unlimited.
+	Builds           int64
+	ConcurrentBuilds int64
+	RunningBuilds    int64
+	WallClockSeconds int64
+	StoredBytes      int64
+}
+
+// SetPlan creates or updates the plan.
+// Users without a plan use the plan named "default".
+func (s *QuotaSetter) SetPlan(ctx context.Context, params *QuotaSetterSetPlanParams) error {
+	if params.Name == "" || params.Window <= 0 {
+		return fmt.Errorf("build.QuotaSetter: %w", ErrInvalidQuotaLimit)
+	}
+
+	query := `
+		INSERT INTO quota_plans (name, window_duration, builds, concurrent_builds, running_builds, wall_clock_seconds, stored_bytes)
+		VALUES ($1, $2 * interval '1 second', $3, $4, $5, $6, $7)
+		ON CONFLICT (name) DO UPDATE
+		SET window_duration = excluded.window_duration, builds = excluded.builds,
+		    concurrent_builds = excluded.concurrent_builds, running_builds = excluded.running_builds,
+		    wall_clock_seconds = excluded.wall_clock_seconds, stored_bytes = excluded.stored_bytes
+	`
+	args := []any{
+		params.Name, params.Window.Seconds(),
+		planLimitArg(params.Builds), planLimitArg(params.ConcurrentBuilds), planLimitArg(params.RunningBuilds),
+		planLimitArg(params.WallClockSeconds), planLimitArg(params.StoredBytes),
+	}
+
+	_, err := s.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("build.QuotaSetter: %w", err)
+	}
+	return nil
+}
+
+type QuotaSetterSetUserQuotaParams struct {
+	UserID uuid.UUID
+	Plan   string // defaults to "default"
+
+	// Limits override limits of the plan, nil limits are taken from the plan.
+	Builds           *int64
+	ConcurrentBuilds *int64
+	RunningBuilds    *int64
+	WallClockSeconds *int64
+	StoredBytes      *int64
+}
+
+// SetUserQuota sets the plan of the user and overrides of its limits.
+// It returns ErrQuotaPlanNotFound if the plan doesn't exist.
+func (s *QuotaSetter) SetUserQuota(ctx context.Context, params *QuotaSetterSetUserQuotaParams) error {
+	for _, limit := range []*int64{params.Builds, params.ConcurrentBuilds, params.RunningBuilds, params.WallClockSeconds, params.StoredBytes} {
+		if limit != nil && *limit < 0 {
+			return fmt.Errorf("build.QuotaSetter: %w", ErrInvalidQuotaLimit)
+		}
+	}
+	plan := params.Plan
+	if plan == "" {
+		plan = "default"
+	}
+
+	query := `
+		INSERT INTO user_quotas (user_id, plan_name, builds, concurrent_builds, running_builds, wall_clock_seconds, stored_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id) DO UPDATE
+		SET plan_name = excluded.plan_name, builds = excluded.builds,
+		    concurrent_builds = excluded.concurrent_builds, running_builds = excluded.running_builds,
+		    wall_clock_seconds = excluded.wall_clock_seconds, stored_bytes = excluded.stored_bytes
+	`
+	args := []any{
+		params.UserID, plan,
+		params.Builds, params.ConcurrentBuilds, params.RunningBuilds, params.WallClockSeconds, params.StoredBytes,
+	}
+
+	_, err := s.DB.Exec(ctx, query, args...)
+	if err != nil {
+		if pgErr := (*pgconn.PgError)(nil); errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			err = ErrQuotaPlanNotFound
+		}
+		return fmt.Errorf("build.QuotaSetter: %w", err)
+	}
+	return nil
+}
+
+// planLimitArg returns the limit as stored in quota_plans, where unlimited is NULL.
+func planLimitArg(limit int64) *int64 {
+	if limit < 0 {
+		return nil
+	}
+	return &limit
+}
+
+// updateWallClockSeconds records the wall-clock time the build container ran for quotas.
+func updateWallClockSeconds(ctx context.Context, db executor, id uuid.UUID, seconds float64) error {
+	query := `
+		UPDATE builds
+		SET wall_clock_seconds = $2
+		WHERE id = $1
+	`
+	args := []any{id, seconds}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
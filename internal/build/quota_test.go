@@ -0,0 +1,83 @@
+package build
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuotaErr(t *testing.T) {
+	t.Run("ignores unlimited and unexceeded limits", func(t *testing.T) {
+		q := &Quota{Limits: []*QuotaLimit{
+			{Name: QuotaLimitBuilds, Max: -1, Used: 100},
+			{Name: QuotaLimitConcurrentBuilds, Max: 2, Used: 1},
+		}}
+		if err := q.Err(); err != nil {
+			t.Errorf("got %q err, want nil", err)
+		}
+	})
+
+	t.Run("reports the exceeded limit", func(t *testing.T) {
+		q := &Quota{Limits: []*QuotaLimit{
+			{Name: QuotaLimitBuilds, Max: 10, Used: 3},
+			{Name: QuotaLimitWallClockSeconds, Max: 60, Used: 61},
+		}}
+		err := q.Err()
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("got %v err, want %q", err, ErrLimitExceeded)
+		}
+		limitErr := (*LimitError)(nil)
+		if !errors.As(err, &limitErr) || limitErr.Limit.Name != QuotaLimitWallClockSeconds {
+			t.Errorf("got %v err, want %s limit", err, QuotaLimitWallClockSeconds)
+		}
+	})
+}
+
+func TestQuotaLimitExceeded(t *testing.T) {
+	for _, tt := range []struct {
+		limit *QuotaLimit
+		want  bool
+	}{
+		{&QuotaLimit{Max: -1, Used: 1 << 40}, false},
+		{&QuotaLimit{Max: 0, Used: 0}, true},
+		{&QuotaLimit{Max: 2, Used: 1}, false},
+		{&QuotaLimit{Max: 2, Used: 2}, true},
+	} {
+		if got := tt.limit.Exceeded(); got != tt.want {
+			t.Errorf("got %t for %d of %d used, want %t", got, tt.limit.Used, tt.limit.Max, tt.want)
+		}
+	}
+}
+
+func TestLimitErrorError(t *testing.T) {
+	err := &LimitError{Limit: &QuotaLimit{Name: QuotaLimitStoredBytes, Max: 10, Used: 12}}
+	if got, want := err.Error(), "stored_bytes limit exceeded: 12 of 10 used"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPlanLimitArg(t *testing.T) {
+	if got := planLimitArg(-1); got != nil {
+		t.Errorf("got %d, want nil", *got)
+	}
+	if got := planLimitArg(0); got == nil || *got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
+
+func TestQuotaStoredBytesErr(t *testing.T) {
+	for _, tt := range []struct {
+		limit   *QuotaLimit
+		wantErr bool
+	}{
+		{&QuotaLimit{Name: QuotaLimitStoredBytes, Max: -1, Used: 1 << 40}, false},
+		{&QuotaLimit{Name: QuotaLimitStoredBytes, Max: 10, Used: 10}, false},
+		{&QuotaLimit{Name: QuotaLimitStoredBytes, Max: 10, Used: 11}, true},
+		{&QuotaLimit{Name: QuotaLimitBuilds, Max: 10, Used: 11}, false},
+	} {
+		q := &Quota{Limits: []*QuotaLimit{tt.limit}}
+		err := q.storedBytesErr()
+		if got := errors.Is(err, ErrLimitExceeded); got != tt.wantErr {
+			t.Errorf("got %v err for %s %d of %d used, want err %t", err, tt.limit.Name, tt.limit.Used, tt.limit.Max, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package build
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/k11v/brick/internal/app"
+)
+
+// priorityLevels is the number of message priorities of each Priority.
+// Interactive builds take the upper half of the build created queue priorities
+// and batch builds take the lower half.
+const priorityLevels = (app.AMQPQueueBuildCreatedMaxPriority + 1) / 2
+
+// normalizePriority checks the priority and defaults it to PriorityInteractive.
+func normalizePriority(priority Priority) (Priority, error) {
+	if priority == "" {
+		return PriorityInteractive, nil
+	}
+	if _, known := ParsePriority(string(priority)); !known {
+		return "", ErrUnknownPriority
+	}
+	return priority, nil
+}
+
+// messagePriority returns the priority of the build created message.
+// Interactive builds always get higher priorities than batch builds.
+// Within a Priority, the message priority decreases with the number of builds
+// the user already has queued, so workers take the first builds of other users
+// before the rest of a large submission and one user can't starve everyone else.
+//
+// The fairness is weak. The priority is fixed when the message is sent, so it doesn't rise
+// when earlier builds of the user are done, and with priorityLevels levels a user with that many
+// queued builds is no different from a user with many more. Messages of the same priority
+// are taken in the order they were sent. PostgresQueue schedules builds when they are taken
+// and should be used when fairness matters.
+func messagePriority(priority Priority, queued int) uint8 {
+	top := priorityLevels - 1
+	if priority != PriorityBatch {
+		top += priorityLevels
+	}
+	return uint8(top - min(queued, priorityLevels-1))
+}
+
+// countQueuedBuilds returns the number of builds of the user to do, except the excluded build.
+func countQueuedBuilds(ctx context.Context, db executor, userID uuid.UUID, excludeID uuid.UUID) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM builds
+		WHERE user_id = $1 AND status = $2 AND id != $3
+	`
+	args := []any{userID, string(StatusTodo), excludeID}
+
+	rows, _ := db.Query(ctx, query, args...)
+	n, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// checkRunningBuilds returns a LimitError if the user can't start another build.
+// Unlike other limits of the quota, it is checked by Doer before the build is started.
+// The user builds must be locked with lockBuilds.
+func checkRunningBuilds(ctx context.Context, db executor, userID uuid.UUID) error {
+	query := `
+		SELECT coalesce(q.running_builds, p.running_builds, -1)::bigint,
+		       (SELECT count(*) FROM builds WHERE user_id = $1 AND status = $2)
+		FROM quota_plans p
+		LEFT JOIN user_quotas q ON q.user_id = $1
+		WHERE p.name = coalesce(q.plan_name, 'default')
+	`
+	args := []any{userID, string(StatusDoing)}
+
+	type usage struct {
+		Max  int64
+		Used int64
+	}
+	rows, _ := db.Query(ctx, query, args...)
+	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[usage])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = ErrQuotaPlanNotFound
+		}
+		return err
+	}
+
+	l := &QuotaLimit{Name: QuotaLimitRunningBuilds, Max: u.Max, Used: u.Used}
+	if l.Exceeded() {
+		return &LimitError{Limit: l}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMessagePriority(t *testing.T) {
+	tests := []struct {
+		priority Priority
+		queued   int
+		want     uint8
+	}{
+		{PriorityInteractive, 0, 9},
+		{PriorityInteractive, 2, 7},
+		{PriorityInteractive, 200, 5},
+		{PriorityBatch, 0, 4},
+		{PriorityBatch, 1, 3},
+		{PriorityBatch, 200, 0},
+	}
+	for _, tt := range tests {
+		if got := messagePriority(tt.priority, tt.queued); got != tt.want {
+			t.Errorf("got %d priority of %s build with %d queued, want %d", got, tt.priority, tt.queued, tt.want)
+		}
+	}
+}
+
+func TestNormalizePriority(t *testing.T) {
+	got, err := normalizePriority("")
+	if err != nil || got != PriorityInteractive {
+		t.Errorf("got %q, %v, want %q, nil", got, err, PriorityInteractive)
+	}
+
+	_, err = normalizePriority("urgent")
+	if !errors.Is(err, ErrUnknownPriority) {
+		t.Errorf("got %v err, want %q", err, ErrUnknownPriority)
+	}
+}
+
+func TestComputeRequestFingerprintPriority(t *testing.T) {
+	files := []*inputHashFile{{Name: "main.md", Type: FileTypeRegular, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}}
+	fingerprint := func(priority Priority) string {
+		opts, err := newOptions("", "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		opts.Labels = []string{}
+		opts.Priority = priority
+		got, err := computeRequestFingerprint(opts, files, false)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		return got
+	}
+
+	// Fingerprints stored before priorities were added are of interactive requests.
+	opts, _ := newOptions("", "", "", "", "", "")
+	opts.Labels = []string{}
+	inputHash, err := computeInputHash("", opts, files)
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	data, _ := json.Marshal(map[string]any{"input_hash": inputHash, "no_cache": false, "labels": []string{}})
+	sum := sha256.Sum256(data)
+	if got, want := fingerprint(PriorityInteractive), hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("got %s interactive fingerprint, want %s", got, want)
+	}
+
+	if fingerprint(PriorityBatch) == fingerprint(PriorityInteractive) {
+		t.Error("got the same batch and interactive fingerprints")
+	}
+}
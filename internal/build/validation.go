@@ -0,0 +1,166 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrNoFiles           = errors.New("no files")
+	ErrTooManyFiles      = errors.New("too many files")
+	ErrFilesTooLarge     = errors.New("files too large")
+	ErrInvalidFileName   = errors.New("invalid file name")
+	ErrDuplicateFileName = errors.New("duplicate file name")
+	ErrUnknownFileType   = errors.New("unknown file type")
+	ErrInvalidLabel      = errors.New("invalid label")
+	ErrTooManyLabels     = errors.New("too many labels")
+)
+
+// FileLimits limit input files of a build.
+type FileLimits struct {
+	MaxFiles     int   // max number of files and dirs
+	MaxFileSize  int64 // max size of one file
+	MaxTotalSize int64 // max total size of all files
+}
+
+const (
+	MaxLabels   = 16
+	MaxLabelLen = 64 // in bytes
+)
+
+var DefaultFileLimits = FileLimits{
+	MaxFiles:     1000,
+	MaxFileSize:  64 * 1024 * 1024,  // 64MB
+	MaxTotalSize: 256 * 1024 * 1024, // 256MB
+}
+
+// fileValidator checks names, types and sizes of files as they are added.
+type fileValidator struct {
+	limits    *FileLimits
+	count     int
+	fileSize  *sizeBudget // of the file last passed to LimitReader
+	totalSize *sizeBudget
+	regular   map[string]struct{}
+	dirs      map[string]bool // true if the dir was added explicitly, false if only implied by paths
+}
+
+func newFileValidator(limits *FileLimits) *fileValidator {
+	return &fileValidator{
+		limits:    limits,
+		fileSize:  &sizeBudget{n: limits.MaxFileSize},
+		totalSize: &sizeBudget{n: limits.MaxTotalSize},
+		regular:   make(map[string]struct{}),
+		dirs:      make(map[string]bool),
+	}
+}
+
+// Add checks the file.
+// Size is the declared size of a regular file or -1 if it is unknown,
+// then the size is checked while the data is read through LimitReader.
+func (v *fileValidator) Add(name string, typ FileType, size int64) error {
+	v.count++
+	if v.count > v.limits.MaxFiles {
+		return fmt.Errorf("more than %d: %w", v.limits.MaxFiles, ErrTooManyFiles)
+	}
+	if _, known := ParseFileType(string(typ)); !known {
+		return fmt.Errorf("%s: %q: %w", name, typ, ErrUnknownFileType)
+	}
+	if err := validateFileName(name); err != nil {
+		return err
+	}
+
+	// Parent dirs are implied by paths, they can't be regular files.
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, exist := v.regular[dir]; exist {
+			return fmt.Errorf("%s: %w", dir, ErrDuplicateFileName)
+		}
+		if _, exist := v.dirs[dir]; !exist {
+			v.dirs[dir] = false
+		}
+	}
+
+	_, regularExist := v.regular[name]
+	explicit, dirExist := v.dirs[name]
+	switch typ {
+	case FileTypeDirectory:
+		if regularExist || explicit {
+			return fmt.Errorf("%s: %w", name, ErrDuplicateFileName)
+		}
+		v.dirs[name] = true
+	case FileTypeRegular:
+		if regularExist || dirExist {
+			return fmt.Errorf("%s: %w", name, ErrDuplicateFileName)
+		}
+		v.regular[name] = struct{}{}
+		if size >= 0 {
+			if size > v.limits.MaxFileSize {
+				return fmt.Errorf("%s: %w", name, ErrFileTooLarge)
+			}
+			v.totalSize.n -= size
+			if v.totalSize.n < 0 {
+				return fmt.Errorf("more than %d bytes: %w", v.limits.MaxTotalSize, ErrFilesTooLarge)
+			}
+		}
+	}
+	return nil
+}
+
+// RegularFileExist returns names of added regular files.
+func (v *fileValidator) RegularFileExist() map[string]struct{} {
+	return v.regular
+}
+
+// LimitReader returns a reader of data of the regular file last added with an unknown size.
+// The reader fails when the file or all files together exceed the limits.
+func (v *fileValidator) LimitReader(r io.Reader) io.Reader {
+	v.fileSize = &sizeBudget{n: v.limits.MaxFileSize}
+	r = &budgetReader{r: r, budget: v.fileSize, err: ErrFileTooLarge}
+	return &budgetReader{r: r, budget: v.totalSize, err: ErrFilesTooLarge}
+}
+
+// LimitErr returns the error of the reader last returned by LimitReader if it exceeded the limits.
+// Storages don't necessarily wrap reader errors, so it is used to report them.
+func (v *fileValidator) LimitErr() error {
+	switch {
+	case v.fileSize.n < 0:
+		return ErrFileTooLarge
+	case v.totalSize.n < 0:
+		return fmt.Errorf("more than %d bytes: %w", v.limits.MaxTotalSize, ErrFilesTooLarge)
+	default:
+		return nil
+	}
+}
+
+// validateFileName checks that name is a normalized relative slash-separated path
+// without control characters, like "images/figure.png".
+func validateFileName(name string) error {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, "\\") || strings.ContainsFunc(name, unicode.IsControl) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidFileName)
+	}
+	return nil
+}
+
+// normalizeLabels checks labels and returns them sorted without duplicates.
+// Labels are non-empty strings without control characters.
+func normalizeLabels(labels []string) ([]string, error) {
+	normalized := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label == "" || len(label) > MaxLabelLen || !utf8.ValidString(label) || strings.ContainsFunc(label, unicode.IsControl) {
+			return nil, fmt.Errorf("%q: %w", label, ErrInvalidLabel)
+		}
+		normalized = append(normalized, label)
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > MaxLabels {
+		return nil, fmt.Errorf("more than %d: %w", MaxLabels, ErrTooManyLabels)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,98 @@
+package build
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFileValidator(t *testing.T) {
+	limits := &FileLimits{MaxFiles: 3, MaxFileSize: 10, MaxTotalSize: 15}
+
+	type file struct {
+		name string
+		typ  FileType
+		size int64
+	}
+	tests := []struct {
+		name  string
+		files []file
+		want  error
+	}{
+		{"accepts files", []file{{"main.md", FileTypeRegular, 10}, {"images", FileTypeDirectory, 0}, {"images/a.png", FileTypeRegular, 5}}, nil},
+		{"accepts implied dirs", []file{{"images/a.png", FileTypeRegular, 1}, {"images", FileTypeDirectory, 0}}, nil},
+		{"rejects parent paths", []file{{"../main.md", FileTypeRegular, 1}}, ErrInvalidFileName},
+		{"rejects absolute paths", []file{{"/main.md", FileTypeRegular, 1}}, ErrInvalidFileName},
+		{"rejects unclean paths", []file{{"images/./a.png", FileTypeRegular, 1}}, ErrInvalidFileName},
+		{"rejects backslashes", []file{{"images\\a.png", FileTypeRegular, 1}}, ErrInvalidFileName},
+		{"rejects control characters", []file{{"main\n.md", FileTypeRegular, 1}}, ErrInvalidFileName},
+		{"rejects empty names", []file{{"", FileTypeRegular, 1}}, ErrInvalidFileName},
+		{"rejects unknown types", []file{{"main.md", "symlink", 1}}, ErrUnknownFileType},
+		{"rejects duplicate files", []file{{"main.md", FileTypeRegular, 1}, {"main.md", FileTypeRegular, 1}}, ErrDuplicateFileName},
+		{"rejects duplicate dirs", []file{{"images", FileTypeDirectory, 0}, {"images", FileTypeDirectory, 0}}, ErrDuplicateFileName},
+		{"rejects files in files", []file{{"main.md", FileTypeRegular, 1}, {"main.md/a.png", FileTypeRegular, 1}}, ErrDuplicateFileName},
+		{"rejects files over dirs", []file{{"images/a.png", FileTypeRegular, 1}, {"images", FileTypeRegular, 1}}, ErrDuplicateFileName},
+		{"rejects too many files", []file{{"a", FileTypeDirectory, 0}, {"b", FileTypeDirectory, 0}, {"c", FileTypeDirectory, 0}, {"d", FileTypeDirectory, 0}}, ErrTooManyFiles},
+		{"rejects too large files", []file{{"main.md", FileTypeRegular, 11}}, ErrFileTooLarge},
+		{"rejects too large totals", []file{{"a.png", FileTypeRegular, 10}, {"b.png", FileTypeRegular, 10}}, ErrFilesTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newFileValidator(limits)
+			var err error
+			for _, f := range tt.files {
+				if err = v.Add(f.name, f.typ, f.size); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v err, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("limits readers", func(t *testing.T) {
+		v := newFileValidator(limits)
+		for _, data := range []string{"0123456789", "01234", "0"} {
+			if err := v.Add("f"+data, FileTypeRegular, -1); err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			_, err := io.Copy(io.Discard, v.LimitReader(strings.NewReader(data)))
+			if len(data) == 1 {
+				if !errors.Is(err, ErrFilesTooLarge) || !errors.Is(v.LimitErr(), ErrFilesTooLarge) {
+					t.Errorf("got %v err and %v limit err, want %q", err, v.LimitErr(), ErrFilesTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+		}
+	})
+}
+
+func TestNormalizeLabels(t *testing.T) {
+	got, err := normalizeLabels([]string{"thesis", "draft", "thesis"})
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	if want := []string{"draft", "thesis"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, labels := range [][]string{{""}, {"a\nb"}, {strings.Repeat("a", MaxLabelLen+1)}} {
+		if _, err = normalizeLabels(labels); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("got %v err for %q, want %q", err, labels, ErrInvalidLabel)
+		}
+	}
+
+	tooMany := make([]string, 0, MaxLabels+1)
+	for i := range MaxLabels + 1 {
+		tooMany = append(tooMany, strings.Repeat("a", i+1))
+	}
+	if _, err = normalizeLabels(tooMany); !errors.Is(err, ErrTooManyLabels) {
+		t.Errorf("got %v err, want %q", err, ErrTooManyLabels)
+	}
+}
@@ -0,0 +1,797 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrInvalidWebhookURL       = errors.New("invalid webhook URL")
+	ErrWebhookAddressNotPublic = errors.New("webhook address isn't public")
+)
+
+// Headers of webhook requests.
+// HeaderWebhookSignature is "t=<unix seconds>,v1=<hex>" where the hex is
+// a HMAC-SHA256 of "<unix seconds>.<body>" keyed with the webhook secret, see SignWebhook.
+const (
+	HeaderWebhookSignature = "Brick-Signature"
+	HeaderWebhookEvent     = "Brick-Event"
+	HeaderWebhookDelivery  = "Brick-Delivery"
+)
+
+// Defaults of Notifier retries.
+// Delays double after each failed attempt starting with DefaultRetryBackoff.
+const (
+	DefaultMaxAttempts     = 8
+	DefaultRetryBackoff    = 30 * time.Second
+	DefaultMaxRetryBackoff = time.Hour
+	DefaultWebhookTimeout  = 10 * time.Second
+)
+
+// deliverBatchSize is the number of deliveries attempted by one Notifier.Deliver call.
+const deliverBatchSize = 100
+
+// deliveryLease is how long a claimed delivery isn't claimed again.
+// It is longer than DefaultWebhookTimeout, so an attempt is retried
+// only if the notifier making it stopped.
+const deliveryLease = 5 * time.Minute
+
+// WebhookEvent is a change of a build that webhooks are notified about.
+type WebhookEvent string
+
+const (
+	WebhookEventBuildDoing WebhookEvent = "build.doing"
+	WebhookEventBuildDone  WebhookEvent = "build.done"
+)
+
+// Webhook is an HTTP endpoint of the user notified about changes of builds.
+type Webhook struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+
+	BuildID uuid.UUID // uuid.Nil if the webhook is for all builds of the user
+	URL     string
+	Secret  string // key of request signatures
+}
+
+// WebhookDelivery is an event sent to a webhook.
+// Failed deliveries are retried until Notifier.MaxAttempts is reached.
+type WebhookDelivery struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	WebhookID uuid.UUID
+
+	// Event and the build fields are a snapshot taken when the build changed.
+	Event         WebhookEvent
+	BuildID       uuid.UUID
+	BuildStatus   Status
+	BuildError    Error
+	BuildExitCode int // -1 if unknown
+
+	State          WebhookDeliveryState
+	Attempts       int
+	NextAttemptAt  time.Time // zero unless pending
+	LastAttemptAt  time.Time // zero if not attempted
+	LastStatusCode int       // 0 if no response was received
+	LastError      string    // empty if the last attempt succeeded
+}
+
+type WebhookDeliveryState string
+
+const (
+	WebhookDeliveryStatePending   WebhookDeliveryState = "pending"
+	WebhookDeliveryStateDelivered WebhookDeliveryState = "delivered"
+	WebhookDeliveryStateFailed    WebhookDeliveryState = "failed" // attempts were exhausted
+)
+
+func ParseWebhookDeliveryState(s string) (state WebhookDeliveryState, known bool) {
+	state = WebhookDeliveryState(s)
+	switch state {
+	case WebhookDeliveryStatePending, WebhookDeliveryStateDelivered, WebhookDeliveryStateFailed:
+		return state, true
+	default:
+		return state, false
+	}
+}
+
+// Notifier manages webhooks and delivers their events.
+// Deliveries are created in the same transactions that change builds, see createWebhookDeliveries.
+type Notifier struct {
+	DB         *pgxpool.Pool
+	HTTPClient *http.Client
+
+	// BaseURL is the public URL of the API, links in events are relative to it.
+	BaseURL string
+
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+type NotifierParams struct {
+	BaseURL string
+}
+
+func NewNotifier(db *pgxpool.Pool, params *NotifierParams) *Notifier {
+	return &Notifier{
+		DB:              db,
+		HTTPClient:      NewWebhookHTTPClient(),
+		BaseURL:         params.BaseURL,
+		MaxAttempts:     DefaultMaxAttempts,
+		RetryBackoff:    DefaultRetryBackoff,
+		MaxRetryBackoff: DefaultMaxRetryBackoff,
+	}
+}
+
+// NewWebhookHTTPClient returns a client that connects only to public addresses,
+// so webhooks can't be used to reach services of the internal network.
+// Addresses are checked when connections are dialed, including connections of redirects,
+// because DNS records of webhook URLs can change after they are checked.
+func NewWebhookHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: DefaultWebhookTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would dial the webhook address instead
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialPublic(ctx, dialer, network, addr)
+	}
+	return &http.Client{Transport: transport, Timeout: DefaultWebhookTimeout}
+}
+
+// dialPublic resolves the host of addr and dials its first public IP that accepts the connection.
+// The IP is dialed directly, so it isn't resolved again.
+func dialPublic(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			errs = append(errs, fmt.Errorf("%s: %w", ip, ErrWebhookAddressNotPublic))
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return conn, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("%s: no addresses", host)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// nonPublicPrefixes are special-purpose ranges that netip.Addr methods don't report.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network
+	netip.MustParsePrefix("100.64.0.0/10"), // shared address space of carrier-grade NAT
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, it can embed private IPv4 addresses
+}
+
+// isPublicIP reports whether the IP isn't loopback, private, link-local, multicast or unspecified.
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type NotifierCreateWebhookParams struct {
+	UserID uuid.UUID
+
+	// BuildID is optional. The webhook is notified only about the build if it is set.
+	BuildID uuid.UUID
+	URL     string // absolute HTTP or HTTPS URL
+}
+
+// CreateWebhook creates a webhook with a random secret.
+func (n *Notifier) CreateWebhook(ctx context.Context, params *NotifierCreateWebhookParams) (*Webhook, error) {
+	u, err := url.Parse(params.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("build.Notifier: %w", ErrInvalidWebhookURL)
+	}
+	if params.BuildID != uuid.Nil {
+		b, err := getBuild(ctx, n.DB, params.BuildID)
+		if err != nil {
+			return nil, fmt.Errorf("build.Notifier: %w", err)
+		}
+		if b.UserID != params.UserID {
+			return nil, fmt.Errorf("build.Notifier: %w", ErrAccessDenied)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("build.Notifier: %w", err)
+	}
+
+	w, err := createWebhook(ctx, n.DB, params.UserID, params.BuildID, params.URL, hex.EncodeToString(secret))
+	if err != nil {
+		return nil, fmt.Errorf("build.Notifier: createWebhook: %w", err)
+	}
+	return w, nil
+}
+
+type NotifierListWebhooksParams struct {
+	UserID uuid.UUID
+}
+
+func (n *Notifier) ListWebhooks(ctx context.Context, params *NotifierListWebhooksParams) ([]*Webhook, error) {
+	webhooks, err := getWebhooks(ctx, n.DB, params.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Notifier: getWebhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+type NotifierDeleteWebhookParams struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+}
+
+// DeleteWebhook deletes the webhook with its deliveries.
+func (n *Notifier) DeleteWebhook(ctx context.Context, params *NotifierDeleteWebhookParams) error {
+	w, err := getWebhook(ctx, n.DB, params.ID)
+	if err != nil {
+		return fmt.Errorf("build.Notifier: %w", err)
+	}
+	if w.UserID != params.UserID {
+		return fmt.Errorf("build.Notifier: %w", ErrAccessDenied)
+	}
+	if err = deleteWebhook(ctx, n.DB, w.ID); err != nil {
+		return fmt.Errorf("build.Notifier: deleteWebhook: %w", err)
+	}
+	return nil
+}
+
+type NotifierListDeliveriesParams struct {
+	WebhookID uuid.UUID
+	UserID    uuid.UUID
+
+	// Limit defaults to DefaultListLimit and is capped at MaxListLimit.
+	Limit int
+}
+
+// ListDeliveries returns the latest deliveries of the webhook, newest first.
+func (n *Notifier) ListDeliveries(ctx context.Context, params *NotifierListDeliveriesParams) ([]*WebhookDelivery, error) {
+	w, err := getWebhook(ctx, n.DB, params.WebhookID)
+	if err != nil {
+		return nil, fmt.Errorf("build.Notifier: %w", err)
+	}
+	if w.UserID != params.UserID {
+		return nil, fmt.Errorf("build.Notifier: %w", ErrAccessDenied)
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	deliveries, err := getWebhookDeliveries(ctx, n.DB, w.ID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("build.Notifier: getWebhookDeliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// Deliver attempts pending deliveries that are due and returns the number of attempts.
+// Deliveries are claimed for deliveryLease before they are attempted and claimed deliveries are skipped,
+// so Deliver can run concurrently with itself.
+func (n *Notifier) Deliver(ctx context.Context) (int, error) {
+	attempted := 0
+	for attempted < deliverBatchSize {
+		ok, err := n.deliverOne(ctx)
+		if err != nil {
+			return attempted, fmt.Errorf("build.Notifier: %w", err)
+		}
+		if !ok {
+			break
+		}
+		attempted++
+	}
+	return attempted, nil
+}
+
+// deliverOne attempts a due delivery and reports whether there was one.
+// The delivery is claimed in one transaction and its attempt is recorded in another,
+// so no transaction is open while the webhook is waited for.
+func (n *Notifier) deliverOne(ctx context.Context) (bool, error) {
+	d, w, err := n.claim(ctx, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if d == nil {
+		return false, nil
+	}
+	if w == nil {
+		return true, nil
+	}
+
+	now := time.Now()
+	statusCode, sendErr := n.send(ctx, w, d, now)
+	claimedAttempts := d.Attempts
+	n.recordAttempt(d, now, statusCode, sendErr)
+	if err = updateWebhookDeliveryAttempt(ctx, n.DB, d, claimedAttempts); err != nil {
+		return false, fmt.Errorf("updateWebhookDeliveryAttempt: %w", err)
+	}
+	return true, nil
+}
+
+// claim gets a due delivery with its webhook and makes it due again only after deliveryLease.
+// The claim counts as an attempt, so deliveries whose attempts are interrupted still fail eventually.
+// Deliveries that exhausted attempts this way are failed instead, they are returned without the webhook.
+// It returns a nil delivery if there is none due.
+func (n *Notifier) claim(ctx context.Context, now time.Time) (*WebhookDelivery, *Webhook, error) {
+	tx, err := n.DB.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	d, w, err := getDueWebhookDeliveryForUpdate(ctx, tx, now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getDueWebhookDeliveryForUpdate: %w", err)
+	}
+	if d == nil {
+		return nil, nil, nil
+	}
+
+	claimedAttempts := d.Attempts
+	if d.Attempts >= n.MaxAttempts {
+		d.State = WebhookDeliveryStateFailed
+		d.NextAttemptAt = time.Time{}
+		d.LastError = "attempt was interrupted"
+		w = nil
+	} else {
+		d.Attempts++
+		d.NextAttemptAt = now.Add(deliveryLease)
+	}
+	if err = updateWebhookDeliveryAttempt(ctx, tx, d, claimedAttempts); err != nil {
+		return nil, nil, fmt.Errorf("updateWebhookDeliveryAttempt: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return d, w, nil
+}
+
+// recordAttempt updates the claimed delivery with the result of its attempt.
+// Successful deliveries are delivered, failed ones are retried after retryDelay
+// until Notifier.MaxAttempts is reached.
+func (n *Notifier) recordAttempt(d *WebhookDelivery, now time.Time, statusCode int, sendErr error) {
+	d.LastAttemptAt = now
+	d.LastStatusCode = statusCode
+	d.LastError = ""
+	switch {
+	case sendErr == nil:
+		d.State = WebhookDeliveryStateDelivered
+		d.NextAttemptAt = time.Time{}
+	case d.Attempts >= n.MaxAttempts:
+		d.State = WebhookDeliveryStateFailed
+		d.NextAttemptAt = time.Time{}
+		d.LastError = sendErr.Error()
+	default:
+		d.State = WebhookDeliveryStatePending
+		d.NextAttemptAt = now.Add(retryDelay(d.Attempts, n.RetryBackoff, n.MaxRetryBackoff))
+		d.LastError = sendErr.Error()
+	}
+}
+
+// send posts the signed event of the delivery to the webhook.
+// It returns the response status code, which is 0 if there was no response,
+// and an error if the event wasn't accepted with a 2xx response.
+func (n *Notifier) send(ctx context.Context, w *Webhook, d *WebhookDelivery, now time.Time) (int, error) {
+	body, err := json.Marshal(n.newWebhookEventJSON(d))
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Brick-Webhook")
+	req.Header.Set(HeaderWebhookEvent, string(d.Event))
+	req.Header.Set(HeaderWebhookDelivery, d.ID.String())
+	req.Header.Set(HeaderWebhookSignature, SignWebhook(w.Secret, now, body))
+
+	resp, err := n.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the value of the HeaderWebhookSignature header.
+// Receivers should compute it from the timestamp and the body they got and compare it
+// in constant time, and they should reject old timestamps to prevent replays.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// retryDelay returns the delay before the next attempt after the number of failed attempts.
+func retryDelay(attempts int, backoff, maxBackoff time.Duration) time.Duration {
+	delay := backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+type webhookEventJSON struct {
+	ID        uuid.UUID        `json:"id"` // delivery ID, the same for retries
+	Type      WebhookEvent     `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Build     webhookBuildJSON `json:"build"`
+}
+
+type webhookBuildJSON struct {
+	ID       uuid.UUID         `json:"id"`
+	Status   Status            `json:"status"`
+	Error    Error             `json:"error,omitempty"`
+	ExitCode *int              `json:"exit_code"`
+	Links    map[string]string `json:"links"`
+}
+
+func (n *Notifier) newWebhookEventJSON(d *WebhookDelivery) *webhookEventJSON {
+	var exitCode *int
+	if d.BuildExitCode >= 0 {
+		exitCode = &d.BuildExitCode
+	}
+
+	buildURL := n.BaseURL + "/v1/builds/" + d.BuildID.String()
+	links := map[string]string{"self": buildURL}
+	if d.BuildStatus == StatusDone {
+		links["log"] = buildURL + "/log"
+		if d.BuildError == "" {
+			links["output"] = buildURL + "/output.pdf"
+		}
+	}
+
+	return &webhookEventJSON{
+		ID:        d.ID,
+		Type:      d.Event,
+		CreatedAt: d.CreatedAt,
+		Build: webhookBuildJSON{
+			ID:       d.BuildID,
+			Status:   d.BuildStatus,
+			Error:    d.BuildError,
+			ExitCode: exitCode,
+			Links:    links,
+		},
+	}
+}
+
+// createWebhookDeliveries creates pending deliveries of the build change
+// for webhooks of the build and webhooks of all builds of its user.
+// Builds changing to other statuses than doing and done don't have events.
+func createWebhookDeliveries(ctx context.Context, db executor, b *Build) error {
+	var event WebhookEvent
+	switch b.Status {
+	case StatusDoing:
+		event = WebhookEventBuildDoing
+	case StatusDone:
+		event = WebhookEventBuildDone
+	default:
+		return nil
+	}
+	var errorArg *string
+	if b.Error != "" {
+		errorArg = new(string)
+		*errorArg = string(b.Error)
+	}
+	var exitCodeArg *int
+	if b.ExitCode >= 0 {
+		exitCodeArg = &b.ExitCode
+	}
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, build_id, build_status, build_error, build_exit_code,
+		                                state, next_attempt_at)
+		SELECT id, $3, $2, $4, $5, $6, $7, now()
+		FROM webhooks
+		WHERE user_id = $1 AND (build_id IS NULL OR build_id = $2)
+	`
+	args := []any{b.UserID, b.ID, string(event), string(b.Status), errorArg, exitCodeArg, string(WebhookDeliveryStatePending)}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
+
+func createWebhook(ctx context.Context, db executor, userID uuid.UUID, buildID uuid.UUID, url string, secret string) (*Webhook, error) {
+	var buildIDArg *uuid.UUID
+	if buildID != uuid.Nil {
+		buildIDArg = &buildID
+	}
+
+	query := `
+		INSERT INTO webhooks (user_id, build_id, url, secret)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, user_id, build_id, url, secret
+	`
+	args := []any{userID, buildIDArg, url, secret}
+
+	rows, _ := db.Query(ctx, query, args...)
+	w, err := pgx.CollectExactlyOneRow(rows, rowToWebhook)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func getWebhook(ctx context.Context, db executor, id uuid.UUID) (*Webhook, error) {
+	query := `
+		SELECT id, created_at, user_id, build_id, url, secret
+		FROM webhooks
+		WHERE id = $1
+	`
+	args := []any{id}
+
+	rows, _ := db.Query(ctx, query, args...)
+	w, err := pgx.CollectExactlyOneRow(rows, rowToWebhook)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func getWebhooks(ctx context.Context, db executor, userID uuid.UUID) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, user_id, build_id, url, secret
+		FROM webhooks
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`
+	args := []any{userID}
+
+	rows, _ := db.Query(ctx, query, args...)
+	webhooks, err := pgx.CollectRows(rows, rowToWebhook)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func deleteWebhook(ctx context.Context, db executor, id uuid.UUID) error {
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+	`
+	args := []any{id}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
+
+func getWebhookDeliveries(ctx context.Context, db executor, webhookID uuid.UUID, limit int) ([]*WebhookDelivery, error) {
+	query := `
+		SELECT id, created_at, webhook_id, event, build_id, build_status, build_error, build_exit_code,
+		       state, attempts, next_attempt_at, last_attempt_at, last_status_code, last_error
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`
+	args := []any{webhookID, limit}
+
+	rows, _ := db.Query(ctx, query, args...)
+	deliveries, err := pgx.CollectRows(rows, rowToWebhookDelivery)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// getDueWebhookDeliveryForUpdate returns the oldest pending delivery that is due with its webhook
+// or nil if there is none. Deliveries locked by other transactions are skipped.
+func getDueWebhookDeliveryForUpdate(ctx context.Context, db executor, now time.Time) (*WebhookDelivery, *Webhook, error) {
+	query := `
+		SELECT id, created_at, webhook_id, event, build_id, build_status, build_error, build_exit_code,
+		       state, attempts, next_attempt_at, last_attempt_at, last_status_code, last_error
+		FROM webhook_deliveries
+		WHERE state = $1 AND next_attempt_at <= $2
+		ORDER BY next_attempt_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`
+	args := []any{string(WebhookDeliveryStatePending), now}
+
+	rows, _ := db.Query(ctx, query, args...)
+	d, err := pgx.CollectExactlyOneRow(rows, rowToWebhookDelivery)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	w, err := getWebhook(ctx, db, d.WebhookID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return d, w, nil
+}
+
+// updateWebhookDeliveryAttempt updates the delivery if its attempts weren't changed since they were claimedAttempts.
+// The delivery isn't updated if another notifier claimed it after the lease expired.
+func updateWebhookDeliveryAttempt(ctx context.Context, db executor, d *WebhookDelivery, claimedAttempts int) error {
+	var nextAttemptAtArg *time.Time
+	if !d.NextAttemptAt.IsZero() {
+		nextAttemptAtArg = &d.NextAttemptAt
+	}
+	var lastStatusCodeArg *int
+	if d.LastStatusCode != 0 {
+		lastStatusCodeArg = &d.LastStatusCode
+	}
+	var lastAttemptAtArg *time.Time
+	if !d.LastAttemptAt.IsZero() {
+		lastAttemptAtArg = &d.LastAttemptAt
+	}
+	var lastErrorArg *string
+	if d.LastError != "" {
+		lastErrorArg = &d.LastError
+	}
+
+	query := `
+		UPDATE webhook_deliveries
+		SET state = $2, attempts = $3, next_attempt_at = $4, last_attempt_at = $5, last_status_code = $6, last_error = $7
+		WHERE id = $1 AND attempts = $8
+	`
+	args := []any{d.ID, string(d.State), d.Attempts, nextAttemptAtArg, lastAttemptAtArg, lastStatusCodeArg, lastErrorArg, claimedAttempts}
+
+	_, err := db.Exec(ctx, query, args...)
+	return err
+}
+
+func rowToWebhook(collectableRow pgx.CollectableRow) (*Webhook, error) {
+	type row struct {
+		ID        uuid.UUID `db:"id"`
+		CreatedAt time.Time `db:"created_at"`
+		UserID    uuid.UUID `db:"user_id"`
+
+		BuildID *uuid.UUID `db:"build_id"`
+		URL     string     `db:"url"`
+		Secret  string     `db:"secret"`
+	}
+	collectedRow, err := pgx.RowToStructByName[row](collectableRow)
+	if err != nil {
+		return nil, err
+	}
+
+	var buildID uuid.UUID
+	if collectedRow.BuildID != nil {
+		buildID = *collectedRow.BuildID
+	}
+
+	return &Webhook{
+		ID:        collectedRow.ID,
+		CreatedAt: collectedRow.CreatedAt,
+		UserID:    collectedRow.UserID,
+
+		BuildID: buildID,
+		URL:     collectedRow.URL,
+		Secret:  collectedRow.Secret,
+	}, nil
+}
+
+func rowToWebhookDelivery(collectableRow pgx.CollectableRow) (*WebhookDelivery, error) {
+	type row struct {
+		ID        uuid.UUID `db:"id"`
+		CreatedAt time.Time `db:"created_at"`
+		WebhookID uuid.UUID `db:"webhook_id"`
+
+		Event         string    `db:"event"`
+		BuildID       uuid.UUID `db:"build_id"`
+		BuildStatus   string    `db:"build_status"`
+		BuildError    *string   `db:"build_error"`
+		BuildExitCode *int      `db:"build_exit_code"`
+
+		State          string     `db:"state"`
+		Attempts       int        `db:"attempts"`
+		NextAttemptAt  *time.Time `db:"next_attempt_at"`
+		LastAttemptAt  *time.Time `db:"last_attempt_at"`
+		LastStatusCode *int       `db:"last_status_code"`
+		LastError      *string    `db:"last_error"`
+	}
+	collectedRow, err := pgx.RowToStructByName[row](collectableRow)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &WebhookDelivery{
+		ID:        collectedRow.ID,
+		CreatedAt: collectedRow.CreatedAt,
+		WebhookID: collectedRow.WebhookID,
+
+		Event:         WebhookEvent(collectedRow.Event),
+		BuildID:       collectedRow.BuildID,
+		BuildStatus:   Status(collectedRow.BuildStatus),
+		BuildExitCode: -1,
+
+		Attempts: collectedRow.Attempts,
+	}
+	if collectedRow.BuildError != nil {
+		d.BuildError = Error(*collectedRow.BuildError)
+	}
+	if collectedRow.BuildExitCode != nil {
+		d.BuildExitCode = *collectedRow.BuildExitCode
+	}
+
+	state, known := ParseWebhookDeliveryState(collectedRow.State)
+	if !known {
+		slog.Warn("unknown webhook delivery state", "state", state)
+	}
+	d.State = state
+	if collectedRow.NextAttemptAt != nil {
+		d.NextAttemptAt = *collectedRow.NextAttemptAt
+	}
+	if collectedRow.LastAttemptAt != nil {
+		d.LastAttemptAt = *collectedRow.LastAttemptAt
+	}
+	if collectedRow.LastStatusCode != nil {
+		d.LastStatusCode = *collectedRow.LastStatusCode
+	}
+	if collectedRow.LastError != nil {
+		d.LastError = *collectedRow.LastError
+	}
+	return d, nil
+}
@@ -0,0 +1,218 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNotifierSend(t *testing.T) {
+	w := &Webhook{ID: uuid.New(), Secret: "secret"}
+	d := &WebhookDelivery{
+		ID:            uuid.New(),
+		Event:         WebhookEventBuildDone,
+		BuildID:       uuid.New(),
+		BuildStatus:   StatusDone,
+		BuildExitCode: 0,
+	}
+	now := time.Unix(1700000000, 0)
+
+	t.Run("posts signed events", func(t *testing.T) {
+		var gotHeader http.Header
+		var gotBody []byte
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			gotHeader = r.Header
+			gotBody, _ = io.ReadAll(r.Body)
+			rw.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+		w.URL = server.URL
+
+		n := &Notifier{HTTPClient: server.Client(), BaseURL: "https://brick.example"}
+		statusCode, err := n.send(context.Background(), w, d, now)
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if statusCode != http.StatusNoContent {
+			t.Errorf("got %d status code, want %d", statusCode, http.StatusNoContent)
+		}
+
+		if got, want := gotHeader.Get(HeaderWebhookSignature), SignWebhook("secret", now, gotBody); got != want {
+			t.Errorf("got %q signature, want %q", got, want)
+		}
+		if got := gotHeader.Get(HeaderWebhookEvent); got != string(WebhookEventBuildDone) {
+			t.Errorf("got %q event, want %q", got, WebhookEventBuildDone)
+		}
+		if got := gotHeader.Get(HeaderWebhookDelivery); got != d.ID.String() {
+			t.Errorf("got %q delivery, want %q", got, d.ID)
+		}
+
+		var event webhookEventJSON
+		if err = json.Unmarshal(gotBody, &event); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if event.Build.ExitCode == nil || *event.Build.ExitCode != 0 {
+			t.Errorf("got %v exit code, want 0", event.Build.ExitCode)
+		}
+		wantOutput := "https://brick.example/v1/builds/" + d.BuildID.String() + "/output.pdf"
+		if got := event.Build.Links["output"]; got != wantOutput {
+			t.Errorf("got %q output link, want %q", got, wantOutput)
+		}
+	})
+
+	t.Run("fails on non-2xx responses", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+		w.URL = server.URL
+
+		n := &Notifier{HTTPClient: server.Client()}
+		statusCode, err := n.send(context.Background(), w, d, now)
+		if err == nil {
+			t.Fatal("got nil err")
+		}
+		if statusCode != http.StatusInternalServerError {
+			t.Errorf("got %d status code, want %d", statusCode, http.StatusInternalServerError)
+		}
+	})
+}
+
+func TestSignWebhook(t *testing.T) {
+	// Computed with: printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	want := "t=1700000000,v1=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := SignWebhook("secret", time.Unix(1700000000, 0), []byte("{}")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{10, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts, 30*time.Second, time.Hour); got != tt.want {
+			t.Errorf("got %v delay after %d attempts, want %v", got, tt.attempts, tt.want)
+		}
+	}
+
+	// Backoff longer than the maximum is capped.
+	if got := retryDelay(1, 2*time.Hour, time.Hour); got != time.Hour {
+		t.Errorf("got %v delay, want %v", got, time.Hour)
+	}
+}
+
+func TestNotifierRecordAttempt(t *testing.T) {
+	n := &Notifier{MaxAttempts: 3, RetryBackoff: 30 * time.Second, MaxRetryBackoff: time.Hour}
+	now := time.Unix(1700000000, 0)
+	sendErr := errors.New("unexpected status 500 Internal Server Error")
+
+	tests := []struct {
+		name       string
+		attempts   int
+		statusCode int
+		sendErr    error
+
+		wantState         WebhookDeliveryState
+		wantNextAttemptAt time.Time
+		wantLastError     string
+	}{
+		{"delivers on success", 1, http.StatusNoContent, nil, WebhookDeliveryStateDelivered, time.Time{}, ""},
+		{"delivers on last attempt", 3, http.StatusOK, nil, WebhookDeliveryStateDelivered, time.Time{}, ""},
+		{"retries on failure", 1, http.StatusInternalServerError, sendErr, WebhookDeliveryStatePending, now.Add(30 * time.Second), sendErr.Error()},
+		{"backs off retries", 2, 0, sendErr, WebhookDeliveryStatePending, now.Add(time.Minute), sendErr.Error()},
+		{"fails when attempts are exhausted", 3, http.StatusInternalServerError, sendErr, WebhookDeliveryStateFailed, time.Time{}, sendErr.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Claimed deliveries are pending with the lease as the next attempt and the claim counted.
+			d := &WebhookDelivery{
+				State:         WebhookDeliveryStatePending,
+				Attempts:      tt.attempts,
+				NextAttemptAt: now.Add(deliveryLease),
+				LastError:     "previous error",
+			}
+			n.recordAttempt(d, now, tt.statusCode, tt.sendErr)
+
+			if d.State != tt.wantState {
+				t.Errorf("got %q state, want %q", d.State, tt.wantState)
+			}
+			if d.Attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", d.Attempts, tt.attempts)
+			}
+			if !d.NextAttemptAt.Equal(tt.wantNextAttemptAt) {
+				t.Errorf("got %v next attempt, want %v", d.NextAttemptAt, tt.wantNextAttemptAt)
+			}
+			if !d.LastAttemptAt.Equal(now) {
+				t.Errorf("got %v last attempt, want %v", d.LastAttemptAt, now)
+			}
+			if d.LastStatusCode != tt.statusCode {
+				t.Errorf("got %d last status code, want %d", d.LastStatusCode, tt.statusCode)
+			}
+			if d.LastError != tt.wantLastError {
+				t.Errorf("got %q last error, want %q", d.LastError, tt.wantLastError)
+			}
+		})
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("got %t for %s, want %t", got, tt.ip, tt.want)
+		}
+	}
+}
+
+func TestDialPublic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	defer listener.Close()
+
+	_, err = dialPublic(context.Background(), &net.Dialer{}, "tcp", listener.Addr().String())
+	if !errors.Is(err, ErrWebhookAddressNotPublic) {
+		t.Errorf("got %v err, want %v", err, ErrWebhookAddressNotPublic)
+	}
+}
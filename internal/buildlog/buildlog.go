@@ -0,0 +1,173 @@
+// Package buildlog parses build logs into diagnostics.
+//
+// A build log is the combined output of build stages.
+// Each stage starts with a "$ <stage>" line, for example "$ pandoc" or "$ latexmk".
+// Pandoc messages and LaTeX messages printed with -file-line-error are recognized.
+package buildlog
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxDiagnostics is the maximum number of diagnostics collected by a Parser.
+// Runaway TeX runs can print the same warning thousands of times.
+const MaxDiagnostics = 1000
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityInfo    Severity = "info"
+)
+
+func ParseSeverity(s string) (severity Severity, known bool) {
+	severity = Severity(s)
+	switch severity {
+	case SeverityError, SeverityWarning, SeverityInfo:
+		return severity, true
+	default:
+		return severity, false
+	}
+}
+
+type Diagnostic struct {
+	Severity Severity
+	File     string // optional
+	Line     int    // optional, 0 if unknown
+	Message  string
+	Stage    string // optional, stage of the log line
+}
+
+var (
+	stageRegexp        = regexp.MustCompile(`^\$ (\S+)$`)
+	fileLineRegexp     = regexp.MustCompile(`^(\S+?\.(?:tex|sty|cls|latex|ltx|bib|bbl|aux)):(\d+): (.+)$`)
+	latexErrorRegexp   = regexp.MustCompile(`^! (.+)$`)
+	latexWarningRegexp = regexp.MustCompile(`^((?:LaTeX|Package \S+|Class \S+)(?: Font)? Warning: .+?)(?: on input line (\d+))?\.?$`)
+	pandocRegexp       = regexp.MustCompile(`^\[(WARNING|ERROR)\] (.+)$`)
+	pandocLineRegexp   = regexp.MustCompile(`\(line (\d+), column \d+\)`)
+	pandocFatalRegexp  = regexp.MustCompile(`^pandoc: (.+)$`)
+	buildRegexp        = regexp.MustCompile(`^(error|warning): (.+)$`)
+)
+
+// Parser is an io.Writer that parses written log lines into diagnostics.
+type Parser struct {
+	// OnStage is an optional function called with the stage of each "$ <stage>" line
+	// as soon as the line is written.
+	OnStage func(stage string)
+
+	stage       string
+	partial     []byte
+	diagnostics []*Diagnostic
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// Write parses complete lines from p and keeps the incomplete rest.
+// It never returns an error.
+func (p *Parser) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		p.parseLine(string(bytes.TrimRight(p.partial[:i], "\r")))
+		p.partial = p.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// Diagnostics parses the incomplete rest and returns the collected diagnostics.
+func (p *Parser) Diagnostics() []*Diagnostic {
+	if len(p.partial) > 0 {
+		p.parseLine(string(p.partial))
+		p.partial = nil
+	}
+	return p.diagnostics
+}
+
+// Parse reads the whole log from r and returns its diagnostics.
+func Parse(r io.Reader) ([]*Diagnostic, error) {
+	p := NewParser()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		p.parseLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p.Diagnostics(), nil
+}
+
+func (p *Parser) parseLine(line string) {
+	if m := stageRegexp.FindStringSubmatch(line); m != nil {
+		p.stage = m[1]
+		if p.OnStage != nil {
+			p.OnStage(p.stage)
+		}
+		return
+	}
+	if len(p.diagnostics) >= MaxDiagnostics {
+		return
+	}
+
+	d := parseDiagnostic(line)
+	if d == nil {
+		return
+	}
+	d.Stage = p.stage
+	if d.File == "" && d.Line != 0 && p.stage == "pandoc" {
+		d.File = "main.md"
+	}
+	p.diagnostics = append(p.diagnostics, d)
+}
+
+func parseDiagnostic(line string) *Diagnostic {
+	if m := fileLineRegexp.FindStringSubmatch(line); m != nil {
+		lineNumber, _ := strconv.Atoi(m[2])
+		return &Diagnostic{
+			Severity: SeverityError,
+			File:     strings.TrimPrefix(m[1], "./"),
+			Line:     lineNumber,
+			Message:  m[3],
+		}
+	}
+	if m := latexErrorRegexp.FindStringSubmatch(line); m != nil {
+		return &Diagnostic{Severity: SeverityError, Message: m[1]}
+	}
+	if m := latexWarningRegexp.FindStringSubmatch(line); m != nil {
+		lineNumber := 0
+		if m[2] != "" {
+			lineNumber, _ = strconv.Atoi(m[2])
+		}
+		return &Diagnostic{Severity: SeverityWarning, Line: lineNumber, Message: m[1]}
+	}
+	if m := pandocRegexp.FindStringSubmatch(line); m != nil {
+		severity := SeverityWarning
+		if m[1] == "ERROR" {
+			severity = SeverityError
+		}
+		lineNumber := 0
+		if lm := pandocLineRegexp.FindStringSubmatch(m[2]); lm != nil {
+			lineNumber, _ = strconv.Atoi(lm[1])
+		}
+		return &Diagnostic{Severity: severity, Line: lineNumber, Message: m[2]}
+	}
+	if m := pandocFatalRegexp.FindStringSubmatch(line); m != nil {
+		return &Diagnostic{Severity: SeverityError, Message: m[1]}
+	}
+	if m := buildRegexp.FindStringSubmatch(line); m != nil {
+		severity, _ := ParseSeverity(m[1])
+		return &Diagnostic{Severity: severity, Message: m[2]}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package buildlog
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	log := `$ untar
+main.md
+$ build
+$ pandoc
+[INFO] Loaded main.md
+[WARNING] Could not fetch resource missing.png: replacing image with description
+[WARNING] Citeproc: citation knuth1984 not found
+warning: citations not found in bibliography: knuth1984
+$ latexmk
+Latexmk: applying rule 'lualatex'...
+LaTeX Warning: Reference ` + "`fig:one'" + ` on page 1 undefined on input line 42.
+/user/cache/pandoc-output/main.tex:57: Undefined control sequence.
+l.57 \foo
+`
+
+	got, err := Parse(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("got %q err", err)
+	}
+	want := []*Diagnostic{
+		{Severity: SeverityWarning, Message: "Could not fetch resource missing.png: replacing image with description", Stage: "pandoc"},
+		{Severity: SeverityWarning, Message: "Citeproc: citation knuth1984 not found", Stage: "pandoc"},
+		{Severity: SeverityWarning, Message: "citations not found in bibliography: knuth1984", Stage: "pandoc"},
+		{Severity: SeverityWarning, Line: 42, Message: "LaTeX Warning: Reference `fig:one' on page 1 undefined", Stage: "latexmk"},
+		{Severity: SeverityError, File: "/user/cache/pandoc-output/main.tex", Line: 57, Message: "Undefined control sequence.", Stage: "latexmk"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("got %+v diagnostic, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestParserWrite(t *testing.T) {
+	p := NewParser()
+	for _, chunk := range []string{"$ pan", "doc\n[WARN", "ING] first\n[WARNING] second"} {
+		if _, err := p.Write([]byte(chunk)); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+	}
+
+	got := p.Diagnostics()
+	want := []*Diagnostic{
+		{Severity: SeverityWarning, Message: "first", Stage: "pandoc"},
+		{Severity: SeverityWarning, Message: "second", Stage: "pandoc"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParserOnStage(t *testing.T) {
+	var got []string
+	p := NewParser()
+	p.OnStage = func(stage string) {
+		got = append(got, stage)
+	}
+	for _, chunk := range []string{"$ untar\nmain.md\n$ pan", "doc\n[WARNING] first\n$ latexmk\n"} {
+		if _, err := p.Write([]byte(chunk)); err != nil {
+			t.Fatalf("got %q err", err)
+		}
+	}
+
+	want := []string{"untar", "pandoc", "latexmk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FS implements Storage with a directory on the local file system.
+// It lets Brick run on a single machine and in tests without MinIO.
+type FS struct {
+	Dir string
+}
+
+func NewFS(dir string) *FS {
+	return &FS{Dir: dir}
+}
+
+// Upload writes data to a temporary file next to the object file
+// and renames it, so readers never see a partially written object.
+func (s *FS) Upload(ctx context.Context, key string, r io.Reader) error {
+	file, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0o777); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = io.Copy(tmp, contextReader{ctx: ctx, r: r}); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func (s *FS) Download(ctx context.Context, w io.Writer, key string) error {
+	file, err := s.file(key)
+	if err != nil {
+		return err
+	}
+
+	openFile, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errors.Join(ErrNotExist, err)
+		}
+		return err
+	}
+	defer openFile.Close()
+
+	_, err = io.Copy(w, contextReader{ctx: ctx, r: openFile})
+	return err
+}
+
+func (s *FS) Delete(_ context.Context, key string) error {
+	file, err := s.file(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// PresignGet always returns ErrPresignUnsupported
+// because files are served only through the application.
+func (s *FS) PresignGet(_ context.Context, _ string, _ *PresignGetParams) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+// PresignPut always returns ErrPresignUnsupported like PresignGet.
+func (s *FS) PresignPut(_ context.Context, _ string, _ *PresignPutParams) (*PresignedRequest, error) {
+	return nil, ErrPresignUnsupported
+}
+
+func (s *FS) Stat(_ context.Context, key string) (*ObjectInfo, error) {
+	file, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errors.Join(ErrNotExist, err)
+		}
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), ModifiedAt: info.ModTime()}, nil
+}
+
+// List walks the directory of the prefix.
+// Temporary files of uploads in progress are skipped.
+func (s *FS) List(ctx context.Context, prefix string) iter.Seq2[*ObjectInfo, error] {
+	return func(yield func(*ObjectInfo, error) bool) {
+		dirKey := "."
+		if i := strings.LastIndex(prefix, "/"); i >= 0 {
+			dirKey = prefix[:i]
+		}
+		dir, err := s.file(dirKey)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		err = filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+			rel, err := filepath.Rel(s.Dir, file)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !yield(&ObjectInfo{Key: key, Size: info.Size(), ModifiedAt: info.ModTime()}, nil) {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// file returns the file path for the key.
+// It fails if the key would point outside of Dir.
+func (s *FS) file(key string) (string, error) {
+	cleanKey := path.Clean(key)
+	if !filepath.IsLocal(filepath.FromSlash(cleanKey)) {
+		return "", fmt.Errorf("storage: %q key is invalid", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(cleanKey)), nil
+}
+
+// contextReader stops reading from r when ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFS(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("uploads, downloads and deletes", func(t *testing.T) {
+		stg := NewFS(t.TempDir())
+
+		err := stg.Upload(ctx, "builds/1/log", strings.NewReader("log"))
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+
+		buf := new(bytes.Buffer)
+		err = stg.Download(ctx, buf, "builds/1/log")
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if got, want := buf.String(), "log"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		err = stg.Delete(ctx, "builds/1/log")
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		err = stg.Download(ctx, new(bytes.Buffer), "builds/1/log")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("got %q err, want %q", err, ErrNotExist)
+		}
+	})
+
+	t.Run("rejects keys outside dir", func(t *testing.T) {
+		stg := NewFS(t.TempDir())
+
+		err := stg.Upload(ctx, "../outside", strings.NewReader(""))
+		if err == nil {
+			t.Error("got nil err")
+		}
+	})
+	t.Run("doesn't presign", func(t *testing.T) {
+		stg := NewFS(t.TempDir())
+
+		_, err := stg.PresignGet(ctx, "builds/1/log", &PresignGetParams{})
+		if !errors.Is(err, ErrPresignUnsupported) {
+			t.Errorf("got %q err, want %q", err, ErrPresignUnsupported)
+		}
+		_, err = stg.PresignPut(ctx, "builds/1/log", &PresignPutParams{})
+		if !errors.Is(err, ErrPresignUnsupported) {
+			t.Errorf("got %q err, want %q", err, ErrPresignUnsupported)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stg := NewFS(t.TempDir())
+
+		_, err := stg.Stat(ctx, "builds/1/log")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("got %q err, want %q", err, ErrNotExist)
+		}
+
+		err = stg.Upload(ctx, "builds/1/log", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		info, err := stg.Stat(ctx, "builds/1/log")
+		if err != nil {
+			t.Fatalf("got %q err", err)
+		}
+		if info.Size != 5 {
+			t.Errorf("got %d size, want %d", info.Size, 5)
+		}
+	})
+	t.Run("lists", func(t *testing.T) {
+		stg := NewFS(t.TempDir())
+
+		for _, key := range []string{"builds/1/input/a", "builds/1/log", "builds/2/input/b", "other"} {
+			err := stg.Upload(ctx, key, strings.NewReader("hello"))
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+		}
+
+		var keys []string
+		for info, err := range stg.List(ctx, "builds/") {
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			keys = append(keys, info.Key)
+		}
+		if want := []string{"builds/1/input/a", "builds/1/log", "builds/2/input/b"}; !slices.Equal(keys, want) {
+			t.Errorf("got %q keys, want %q", keys, want)
+		}
+
+		for _, err := range stg.List(ctx, "missing/") {
+			t.Errorf("got %v err, want no objects", err)
+		}
+	})
+}
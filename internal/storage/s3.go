@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"iter"
+	"mime"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3 implements Storage with an S3-compatible object storage like MinIO.
+type S3 struct {
+	Client *s3.Client
+	Bucket string
+}
+
+func NewS3(client *s3.Client, bucket string) *S3 {
+	return &S3{
+		Client: client,
+		Bucket: bucket,
+	}
+}
+
+// uploadPartSize should be greater than or equal 5MB.
+// See github.com/aws/aws-sdk-go-v2/feature/s3/manager.
+const uploadPartSize = 10 * 1024 * 1024 // 10MB
+
+func (s *S3) Upload(ctx context.Context, key string, r io.Reader) error {
+	uploader := manager.NewUploader(s.Client, func(u *manager.Uploader) {
+		u.PartSize = uploadPartSize
+	})
+
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+		Body:   r,
+	})
+	if err != nil {
+		if apiErr := smithy.APIError(nil); errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooLarge" {
+			err = errors.Join(ErrTooLarge, err)
+		}
+		return err
+	}
+
+	err = s3.NewObjectExistsWaiter(s.Client).Wait(ctx, &s3.HeadObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	}, time.Minute)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// downloadPartSize should be greater than or equal 5MB.
+// See github.com/aws/aws-sdk-go-v2/feature/s3/manager.
+const downloadPartSize = 10 * 1024 * 1024 // 10MB
+
+func (s *S3) Download(ctx context.Context, w io.Writer, key string) error {
+	downloader := manager.NewDownloader(s.Client, func(d *manager.Downloader) {
+		d.PartSize = int64(downloadPartSize)
+		d.Concurrency = 1
+	})
+
+	// fakeWriterAt needs manager.Downloader.Concurrency set to 1.
+	_, err := downloader.Download(ctx, fakeWriterAt{w}, &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if noSuchKeyErr := (*types.NoSuchKey)(nil); errors.As(err, &noSuchKeyErr) {
+			err = errors.Join(ErrNotExist, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *S3) PresignGet(ctx context.Context, key string, params *PresignGetParams) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	}
+	if params.ContentType != "" {
+		input.ResponseContentType = &params.ContentType
+	}
+	if params.Filename != "" {
+		contentDisposition := mime.FormatMediaType("attachment", map[string]string{"filename": params.Filename})
+		input.ResponseContentDisposition = &contentDisposition
+	}
+
+	req, err := s3.NewPresignClient(s.Client).PresignGetObject(ctx, input, s3.WithPresignExpires(params.Expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3) PresignPut(ctx context.Context, key string, params *PresignPutParams) (*PresignedRequest, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        &s.Bucket,
+		Key:           &key,
+		ContentLength: &params.Size,
+	}
+	if params.SHA256 != nil {
+		checksum := base64.StdEncoding.EncodeToString(params.SHA256)
+		input.ChecksumSHA256 = &checksum
+	}
+
+	req, err := s3.NewPresignClient(s.Client).PresignPutObject(ctx, input, s3.WithPresignExpires(params.Expires))
+	if err != nil {
+		return nil, err
+	}
+
+	// Host is set by HTTP clients from the URL.
+	header := req.SignedHeader.Clone()
+	header.Del("Host")
+	return &PresignedRequest{URL: req.URL, Header: header}, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	out, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if notFoundErr := (*types.NotFound)(nil); errors.As(err, &notFoundErr) {
+			err = errors.Join(ErrNotExist, err)
+		}
+		return nil, err
+	}
+
+	info := &ObjectInfo{Key: key}
+	if out.ContentLength != nil {
+		info.Size = *out.ContentLength
+	}
+	if out.LastModified != nil {
+		info.ModifiedAt = *out.LastModified
+	}
+	return info, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) iter.Seq2[*ObjectInfo, error] {
+	return func(yield func(*ObjectInfo, error) bool) {
+		paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+			Bucket: &s.Bucket,
+			Prefix: &prefix,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, object := range page.Contents {
+				info := &ObjectInfo{}
+				if object.Key != nil {
+					info.Key = *object.Key
+				}
+				if object.Size != nil {
+					info.Size = *object.Size
+				}
+				if object.LastModified != nil {
+					info.ModifiedAt = *object.LastModified
+				}
+				if !yield(info, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// fakeWriterAt wraps an io.Writer to provide a fake WriteAt method.
+// This method simply calls w.Write ignoring the offset parameter.
+// It can be used with github.com/aws/aws-sdk-go-v2/feature/s3/manager.Downloader.Download
+// if its concurrency is set to 1 because this guarantees the sequential writes.
+type fakeWriterAt struct {
+	w io.Writer // required
+}
+
+func (writerAt fakeWriterAt) WriteAt(p []byte, _ int64) (n int, err error) {
+	return writerAt.w.Write(p)
+}
@@ -0,0 +1,101 @@
+// Package storage provides object storage for build inputs and outputs.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/k11v/brick/internal/app"
+)
+
+var (
+	ErrNotExist           = errors.New("object doesn't exist")
+	ErrTooLarge           = errors.New("object too large")
+	ErrPresignUnsupported = errors.New("presign unsupported")
+)
+
+// Storage stores objects by keys.
+// Keys are slash-separated paths like "builds/{id}/log".
+type Storage interface {
+	// Upload creates or replaces the object with data from r.
+	// The object is either fully written or not written at all.
+	Upload(ctx context.Context, key string, r io.Reader) error
+
+	// Download writes the object data to w.
+	// It returns ErrNotExist if the object doesn't exist.
+	Download(ctx context.Context, w io.Writer, key string) error
+
+	// Delete deletes the object.
+	// It doesn't return an error if the object doesn't exist.
+	Delete(ctx context.Context, key string) error
+
+	// PresignGet returns a URL that downloads the object without credentials
+	// until it expires. It returns ErrPresignUnsupported if the storage
+	// can't be accessed directly by clients.
+	PresignGet(ctx context.Context, key string, params *PresignGetParams) (string, error)
+
+	// PresignPut returns a PUT request that uploads the object without credentials
+	// until it expires. It returns ErrPresignUnsupported like PresignGet.
+	PresignPut(ctx context.Context, key string, params *PresignPutParams) (*PresignedRequest, error)
+
+	// Stat returns information about the object.
+	// It returns ErrNotExist if the object doesn't exist.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// List returns information about objects with keys that start with prefix.
+	// Objects uploaded or deleted while they are listed may be missed.
+	List(ctx context.Context, prefix string) iter.Seq2[*ObjectInfo, error]
+}
+
+type PresignGetParams struct {
+	Expires     time.Duration
+	ContentType string // optional
+	Filename    string // optional, sets Content-Disposition to attachment
+}
+
+type PresignPutParams struct {
+	Expires time.Duration
+	Size    int64  // required Content-Length of the upload
+	SHA256  []byte // optional checksum the storage verifies on upload
+}
+
+// PresignedRequest is a request that clients send as is.
+type PresignedRequest struct {
+	URL    string
+	Header http.Header // headers the client must send, they are part of the signature
+}
+
+type ObjectInfo struct {
+	Key        string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+// New creates a Storage using the provided connection string.
+// Connection strings with the file scheme, like file:///var/lib/brick,
+// create FS. Other connection strings, like http://key:secret@s3:9000?bucket=brick,
+// create S3 with the bucket of the connection string, see app.NewS3Client for their format.
+func New(connectionString string) (Storage, error) {
+	u, err := url.Parse(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("storage: %s connection string has no path", u.Scheme)
+		}
+		return NewFS(u.Path), nil
+	case "http", "https":
+		return NewS3(app.NewS3Client(connectionString), app.S3BucketName(connectionString)), nil
+	default:
+		return nil, fmt.Errorf("storage: unknown %q scheme", u.Scheme)
+	}
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/k11v/brick/internal/app"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name             string
+		connectionString string
+		wantBucket       string
+	}{
+		{"bucket", "http://key:secret@s3:9000?bucket=inputs", "inputs"},
+		{"default bucket", "http://key:secret@s3:9000", app.DefaultS3BucketName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stg, err := New(tt.connectionString)
+			if err != nil {
+				t.Fatalf("got %q err", err)
+			}
+			s3, ok := stg.(*S3)
+			if !ok {
+				t.Fatalf("got %T, want *S3", stg)
+			}
+			if got, want := s3.Bucket, tt.wantBucket; got != want {
+				t.Errorf("got %q bucket, want %q", got, want)
+			}
+		})
+	}
+}